@@ -3,12 +3,35 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
 
 	app "github.com/canonical-dev/package_statistics/internal/app"
+	"github.com/canonical-dev/package_statistics/internal/cache"
+)
+
+// Build information, set with -ldflags "-X main.version=... -X main.commit=... -X main.date=..." (see Makefile)
+var (
+	version = "dev"
+	commit  = "unknown"
+	date    = "unknown"
+)
+
+// Exit statuses besides 0 (success) and 1 (any other failure), documented in the README
+const (
+	// exitNoPackages is the exit status when the contents held no packages, so scripts can tell it from other failures
+	exitNoPackages = 3
+	// exitFromCache replaces 0 with -cache-exit-status when nothing was downloaded
+	exitFromCache = 4
+	// exitArchFailed is the exit status when at least one of several architectures failed, after printing the others
+	exitArchFailed = 5
+	// exitCancelled is the standard exit status for Ctrl+C
+	exitCancelled = 130
 )
 
 // main is the entry point for the package_statistics command-line tool.
@@ -17,9 +40,58 @@ func main() {
 	if err != nil {
 		log.Fatalf("invalid args: %v", err)
 	}
+	if cfg.Command == app.CommandVersion {
+		fmt.Printf("package_statistics %s (commit %s, built %s)\n", version, commit, date)
+		return
+	}
+	out, err := app.OpenOutput(cfg.Output)
+	if err != nil {
+		log.Fatalf("invalid -output: %v", err)
+	}
+	defer out.Close()
 
-	if err := os.MkdirAll(cfg.CacheDir, 0o755); err != nil {
-		log.Fatalf("failed to create cache dir: %v", err)
+	if cfg.Command == app.CommandDiffFiles {
+		if err := app.RunDiffFiles(out, cfg); err != nil {
+			log.Fatalf("diff failed: %v", err)
+		}
+		return
+	}
+
+	if cfg.Command == app.CommandClearCache {
+		removed, err := cache.ClearAll(cfg.CacheDir)
+		if err != nil {
+			log.Fatalf("clear-cache failed: %v", err)
+		}
+		fmt.Fprintf(out, "Removed %d cache files from %s\n", removed, cfg.CacheDir)
+		return
+	}
+
+	if cfg.Command == app.CommandListCache {
+		app.RunListCache(out, cfg, log.Default())
+		return
+	}
+
+	if cfg.Command == app.CommandInfo {
+		if err := app.RunInfo(out, cfg); err != nil {
+			log.Fatalf("info failed: %v", err)
+		}
+		return
+	}
+
+	if cfg.Repeat > 0 {
+		if err := app.RunRepeat(context.Background(), out, cfg); err != nil {
+			log.Fatalf("repeat failed: %v", err)
+		}
+		return
+	}
+
+	if !cfg.NoCache && !cfg.DryRun {
+		if err := os.MkdirAll(cfg.CacheDir, 0o755); err != nil {
+			log.Fatalf("failed to create cache dir: %v", err)
+		}
+		if removed, err := cache.CleanupStaleTemp(cfg.CacheDir, cache.TempStaleTTL); err == nil && removed > 0 && !cfg.Quiet {
+			log.Printf("Removed %d stale temp files from %s", removed, cfg.CacheDir)
+		}
 	}
 
 	// Set up graceful shutdown
@@ -36,15 +108,147 @@ func main() {
 		cancel()
 	}()
 
-	a := app.NewApp(cfg, nil)
-	stats, err := a.AnalyzeWithCache(ctx)
+	var opts []app.Option
+	if cfg.MetricsAddr != "" {
+		metrics := app.NewMetrics()
+		srv, err := metrics.Serve(cfg.MetricsAddr)
+		if err != nil {
+			log.Fatalf("failed to start metrics server: %v", err)
+		}
+		// stopped when the signal handler cancels ctx, or when main returns
+		stopMetrics := func() {
+			if err := srv.Shutdown(); err != nil {
+				log.Printf("Failed to stop metrics server: %v", err)
+			}
+		}
+		defer stopMetrics()
+		go func() {
+			<-ctx.Done()
+			stopMetrics()
+		}()
+		if !cfg.Quiet {
+			log.Printf("Serving metrics on http://%s%s", srv.Addr(), app.MetricsPath)
+		}
+		opts = append(opts, app.WithMetrics(metrics))
+	}
+
+	a := app.NewApp(cfg, opts...)
+	if cfg.Command == app.CommandDetectMirror {
+		if err := a.RunDetectMirror(ctx, out); err != nil {
+			log.Fatalf("detect-mirror failed: %v", err)
+		}
+		return
+	}
+	if cfg.PrintCachePath {
+		fmt.Fprintln(os.Stderr, a.CacheFile())
+	}
+	if cfg.DiffArch {
+		before, after := cfg.Architectures[0], cfg.Architectures[1]
+		diffs, err := a.DiffArchitectures(ctx, before, after)
+		if err != nil {
+			if ctx.Err() == context.Canceled {
+				log.Println("Operation cancelled")
+				os.Exit(exitCancelled)
+			}
+			log.Fatalf("diff-arch failed: %v", err)
+		}
+		if err := app.PrintArchDiff(out, before, after, diffs, cfg); err != nil {
+			log.Fatalf("failed to print results: %v", err)
+		}
+		return
+	}
+	if len(cfg.Architectures) > 1 {
+		results := a.AnalyzeArchitectures(ctx, cfg.Architectures)
+		if ctx.Err() == context.Canceled {
+			log.Println("Operation cancelled")
+			os.Exit(exitCancelled)
+		}
+		if cfg.DryRun {
+			// each architecture logged what it would do
+			return
+		}
+		if err := app.PrintArchReport(out, results, cfg); err != nil {
+			log.Fatalf("failed to print results: %v", err)
+		}
+		failed := 0
+		for _, r := range results {
+			if r.Err != nil {
+				log.Printf("%s failed: %v", r.Architecture, r.Err)
+				failed++
+			}
+		}
+		if failed > 0 {
+			// os.Exit skips the deferred Close
+			_ = out.Close()
+			os.Exit(exitArchFailed)
+		}
+		return
+	}
+
+	if cfg.Watch > 0 {
+		_ = a.Watch(ctx, func(res app.Result) {
+			if cfg.Porcelain {
+				_ = a.PrintPorcelain(out)
+				return
+			}
+			if !cfg.PrintEach {
+				return
+			}
+			if err := app.PrintResultsWithTotals(out, res.Stats, res.Totals, cfg); err != nil {
+				log.Printf("failed to print results: %v", err)
+			}
+		})
+		if !cfg.Quiet {
+			log.Println("Watch stopped")
+		}
+		return
+	}
+
+	res, err := a.Analyze(ctx)
 	if err != nil {
 		if ctx.Err() == context.Canceled {
 			log.Println("Operation cancelled")
-			os.Exit(130) // Standard exit code for Ctrl+C
+			os.Exit(exitCancelled)
+		}
+		if errors.Is(err, app.ErrNoPackages) {
+			log.Printf("analysis failed: %v", err)
+			os.Exit(exitNoPackages)
 		}
 		log.Fatalf("analysis failed: %v", err)
 	}
+	if cfg.DryRun {
+		if cfg.Porcelain {
+			// the token the real run would print, from the HEAD alone
+			if err := a.PrintPorcelain(out); err != nil {
+				log.Fatalf("failed to print results: %v", err)
+			}
+		}
+		return
+	}
+	// runs before the other deferred calls, which os.Exit skips, so it closes the output itself
+	defer exitForSource(cfg, res, out)
+
+	if cfg.Porcelain {
+		if err := a.PrintPorcelain(out); err != nil {
+			log.Fatalf("failed to print results: %v", err)
+		}
+		return
+	}
+	if err := app.PrintResultsWithTotals(out, res.Stats, res.Totals, cfg); err != nil {
+		log.Fatalf("failed to print results: %v", err)
+	}
 
-	app.PrintTop(stats, cfg.TopCount)
+	if cfg.OutputArchive != "" {
+		if err := a.WriteArchive(cfg.OutputArchive, res.Stats); err != nil {
+			log.Fatalf("failed to write archive: %v", err)
+		}
+	}
+}
+
+// exitForSource exits with exitFromCache when -cache-exit-status is set and res came from the cache
+func exitForSource(cfg *app.Config, res app.Result, out io.Closer) {
+	if cfg.CacheExitStatus && res.FromCache {
+		_ = out.Close()
+		os.Exit(exitFromCache)
+	}
 }
@@ -3,12 +3,18 @@ package app
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strings"
 	"time"
 
@@ -21,35 +27,373 @@ type PackageStats = cache.PackageStats // reuse struct
 // CacheEntry represents a cached data entry.
 type CacheEntry = cache.CacheEntry
 
+// Totals counts the file entries and packages a parse saw.
+type Totals = cache.Totals
+
+// Logger is what App logs through, satisfied by *log.Logger and the JSON logger from NewJSONLogger
+type Logger = cache.Logger
+
 // Config holds application configuration settings.
 type Config struct {
-	Architecture     string
+	Architecture string
+	// Architectures lists every architecture to analyze, more than one runs them together
+	Architectures    []string
 	CacheDir         string
 	CacheTTL         time.Duration
 	ForceRefresh     bool
 	TopCount         int
 	ShortCacheWindow time.Duration
 	DownloadTimeout  time.Duration
+	RequestTimeout   time.Duration
+	// MaxRetries, RetryBaseDelay and RetryJitter shape GetRequestWithRetry, see RetryPolicy
+	MaxRetries       int
+	RetryBaseDelay   time.Duration
+	RetryJitter      bool
+	SummaryOnly      bool
+	LowMemory        bool
+	DeltaThreshold   int
+	PrintCachePath   bool
+	Clean            CleanPipeline `json:"-"`
+	NoProgress       bool
+	AllArches        bool
+	Combined         bool
+	SourceFormat     string
+	SampleRate       float64
+	Seed             int64
+	PathDepth        int
+	Format           string
+	OutputArchive    string
+	Watch            time.Duration
+	WatchMaxInterval time.Duration
+	PackagePrefix    string
+	ProgressFile     string
+	Suite            string
+	AllowEmpty       bool
+	Mirror           string
+	Repeat           int
+	Compression      string
+	Bottom           int
+	HeaderLegend     string
+	// ProvidersHistogram counts files by how many packages provide them instead of by package
+	ProvidersHistogram bool
+	// Filter keeps only package names matching the -filter regular expression (nil keeps all)
+	Filter *regexp.Regexp `json:"-"`
+	// PathPrefix only counts files whose path starts with it, e.g. usr/bin/
+	PathPrefix string
+	// ShowPercentDelta adds the percent change column to diff output, DiffSort orders diff rows
+	ShowPercentDelta bool
+	DiffSort         string
+	// Quiet discards info logging and the progress bar, errors still reach stderr from main
+	Quiet bool
+	// Components are the archive areas whose contents are merged (main if empty)
+	Components []string
+	// File is a local contents file analyzed instead of downloading, no cache is read or written
+	File string
+	// Workers is the number of goroutines counting lines (1 = single threaded)
+	Workers int
+	// MaxRate caps the download speed in bytes per second (0 = unlimited)
+	MaxRate int64
+	// StripSection aggregates packages by bare name, dropping the section ("admin/cron" -> "cron")
+	StripSection bool
+	// Output is the file results are written to, stdout when empty or "-"
+	Output string
+	// Proxy routes every request through this URL, HTTP_PROXY/HTTPS_PROXY/NO_PROXY apply when empty
+	Proxy string
+	// LogFormat selects the log backend: text (default) or json
+	LogFormat string
+	// Porcelain prints a CHANGED/UNCHANGED token after each run instead of the results
+	Porcelain bool
+	// PrintEach prints the results after every -watch run, otherwise watch only refreshes the cache
+	PrintEach bool
+	// CompressCache stores caches as gzip-compressed .json.gz files
+	CompressCache bool
+	// ArchConcurrency bounds how many architectures are analyzed at once (defaultArchConcurrency if < 1)
+	ArchConcurrency int
+	// NoCache downloads and parses without reading, writing or locking any cache
+	NoCache bool
+	// GroupBy selects what files are counted by: GroupByPackage or GroupByExtension
+	GroupBy string
+	// AuthUser with AuthPass, or AuthToken, authenticate requests to the mirror (see Credentials)
+	// the secrets are never written out, e.g. into the -output-archive config
+	AuthUser  string
+	AuthPass  string `json:"-"`
+	AuthToken string `json:"-"`
+	// CacheDirPerSuite keeps caches in CacheDir/<suite>/<component>/contents-<arch>.json instead of the flat layout
+	CacheDirPerSuite bool
+	// Sort orders the reported packages: SortCount (most files first) or SortName (alphabetical), -top applies after it
+	Sort string
+	// CacheExitStatus makes a run served from the cache exit with status 4 instead of 0 (see Result.FromCache)
+	CacheExitStatus bool
+	// Dedupe counts a path listed twice for the same package once, at the cost of remembering every path
+	Dedupe bool
+	// IncludeUdeb counts debian-installer packages, skipped by default (see IsUdeb)
+	IncludeUdeb bool
+	// RawNumbers prints the text table's counts as plain digits instead of grouping thousands (15432, not 15,432)
+	RawNumbers bool
+	// NameWidth is the minimum width of the text table's package name column (0 = fit the longest name)
+	NameWidth int
+	// Color selects ANSI styling of the text table: ColorAuto, ColorAlways or ColorNever, see UseColor
+	Color string
+	// OpTimeout bounds each whole analysis, lock wait, cache IO and HEAD included (0 = no limit)
+	// DownloadTimeout still applies to the download within it
+	OpTimeout time.Duration
+	// DryRun checks the cache and sends the HEAD request, then logs whether it would download, without the GET
+	DryRun bool
+	// MaxCacheSize evicts the oldest caches after each save once CacheDir holds more bytes (0 = unbounded)
+	MaxCacheSize int64
+	// MinCount drops packages with fewer files before -top or -bottom picks the rows (0 keeps all)
+	MinCount int
+	// CacheTTLOverrides replaces CacheTTL for an architecture or suite, see ResolvedCacheTTL
+	CacheTTLOverrides map[string]time.Duration
+	// MetricsAddr is where Prometheus metrics are served, e.g. :9100 (empty = no server)
+	MetricsAddr string
+	// DiffArch compares the two given architectures instead of reporting each one
+	DiffArch bool
+	// Command selects a subcommand ("" runs the analysis), Args holds its operands
+	Command string
+	Args    []string
+}
+
+// Compression codecs accepted by -compression.
+const (
+	CompressionAuto  = "auto"
+	CompressionGzip  = "gzip"
+	CompressionXZ    = "xz"
+	CompressionBzip2 = "bzip2"
+	CompressionNone  = "none"
+)
+
+// SourceFormatAuto enables source-format parsing only for the source architecture.
+const SourceFormatAuto = "auto"
+
+// UseSourceFormat resolves the -source-format setting for the configured architecture.
+func (c *Config) UseSourceFormat() bool {
+	switch c.SourceFormat {
+	case "true":
+		return true
+	case "false":
+		return false
+	default:
+		return c.Architecture == "source"
+	}
+}
+
+// parser returns the LineParser for the parse options in c
+func (c *Config) parser() LineParser {
+	return LineParser{
+		SourceFormat: c.UseSourceFormat(),
+		SampleRate:   c.SampleRate,
+		Seed:         c.Seed,
+		PathDepth:    c.PathDepth,
+		Providers:    c.ProvidersHistogram,
+		PathPrefix:   c.PathPrefix,
+		// applied while parsing so the counts map never holds the other packages, the cache is keyed on it
+		PackagePrefix: c.PackagePrefix,
+		Legend:        c.HeaderLegend,
+		StripSection:  c.StripSection,
+		Workers:       c.Workers,
+		GroupBy:       c.GroupBy,
+		Dedupe:        c.Dedupe,
+		IncludeUdeb:   c.IncludeUdeb,
+	}
+}
+
+// KnownSuites lists the Debian suites accepted by -suite.
+var KnownSuites = []string{"oldstable", "stable", "testing", "unstable", "experimental"}
+
+// KnownComponents lists the archive areas accepted by -components.
+var KnownComponents = []string{"main", "contrib", "non-free", "non-free-firmware"}
+
+// Credentials returns the mirror credentials from -auth-user, -auth-pass and -auth-token
+func (c *Config) Credentials() Credentials {
+	return Credentials{User: c.AuthUser, Password: c.AuthPass, Token: c.AuthToken}
+}
+
+// ResolvedComponent returns the single component this config downloads, DefaultComponent unless exactly one is set.
+// several components are downloaded one at a time by loadComponents
+func (c *Config) ResolvedComponent() string {
+	if len(c.Components) == 1 {
+		return c.Components[0]
+	}
+	return DefaultComponent
+}
+
+// ResolvedSuite returns the configured suite, DefaultSuite if unset.
+func (c *Config) ResolvedSuite() string {
+	if c.Suite == "" {
+		return DefaultSuite
+	}
+	return c.Suite
+}
+
+// ResolvedCacheTTL returns how long the cache of the configured architecture and suite stays valid:
+// an override for the architecture wins over one for the suite, CacheTTL applies when neither is set
+func (c *Config) ResolvedCacheTTL() time.Duration {
+	return c.cacheTTLFor(c.Architecture, c.ResolvedSuite())
+}
+
+// cacheTTLFor is ResolvedCacheTTL for the cache of any architecture and suite, e.g. one listed by list-cache
+func (c *Config) cacheTTLFor(arch, suite string) time.Duration {
+	if ttl, ok := c.CacheTTLOverrides[arch]; ok {
+		return ttl
+	}
+	if ttl, ok := c.CacheTTLOverrides[suite]; ok {
+		return ttl
+	}
+	return c.CacheTTL
+}
+
+// cacheTTLFlag collects repeated -cache-ttl values:
+// a bare duration sets the default, key=duration overrides it for an architecture or suite
+type cacheTTLFlag struct {
+	ttl time.Duration
+	// set records whether the default was given, not just overrides
+	set       bool
+	overrides map[string]time.Duration
+}
+
+// String returns the default TTL, shown as the flag default
+func (f *cacheTTLFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.ttl.String()
+}
+
+// Set parses one -cache-ttl value, "24h" or "unstable=1h"
+func (f *cacheTTLFlag) Set(value string) error {
+	key, duration, override := strings.Cut(value, "=")
+	if !override {
+		duration = key
+	}
+	ttl, err := time.ParseDuration(strings.TrimSpace(duration))
+	if err != nil {
+		return err
+	}
+	if ttl < 0 {
+		return fmt.Errorf("negative TTL %v", ttl)
+	}
+	if !override {
+		f.ttl, f.set = ttl, true
+		return nil
+	}
+	if key = strings.TrimSpace(key); key == "" {
+		return fmt.Errorf("missing architecture or suite in %q", value)
+	}
+	if f.overrides == nil {
+		f.overrides = make(map[string]time.Duration)
+	}
+	f.overrides[key] = ttl
+	return nil
+}
+
+// retryPolicy returns the GET retry settings, zero values fall back to the defaults
+func (c *Config) retryPolicy() RetryPolicy {
+	return RetryPolicy{MaxRetries: c.MaxRetries, BaseDelay: c.RetryBaseDelay, Jitter: c.RetryJitter}
+}
+
+// Sampling reports whether only a fraction of lines is parsed.
+func (c *Config) Sampling() bool {
+	return c.SampleRate > 0 && c.SampleRate < 1
 }
 
 // App is the main application struct that handles package statistics analysis.
 type App struct {
-	client *http.Client
-	cfg    *Config
-	logger *log.Logger
+	client  *http.Client
+	cfg     *Config
+	logger  Logger
+	baseURL string
+	// changed records whether the last analysis got new data rather than the cached copy
+	changed bool
+	// etag is the ETag of the data returned by the last analysis
+	etag string
+	// fromCache records whether the last analysis was served from the cache without downloading, see Result
+	fromCache bool
+	// totals is what the parse behind the last analysis counted, see Result
+	totals Totals
+	// metrics records downloads, parses and cache use (nil = not recorded)
+	metrics *Metrics
+	// clock is what cache ages are measured with (nil = the system clock), see WithClock
+	clock Clock
 }
 
-// NewApp creates a new App instance with the given configuration and logger.
-func NewApp(cfg *Config, logger *log.Logger) *App {
-	if logger == nil {
-		logger = log.New(os.Stderr, "", log.LstdFlags)
+// Option customizes an App built by NewApp.
+type Option func(*App)
+
+// WithHTTPClient makes the App send every request through client,
+// e.g. to inject a custom transport, tracing or a test RoundTripper.
+// The client's transport is used as is, -proxy only applies to the default client,
+// and client itself is never modified: -auth-* credentials wrap a copy of it.
+// A nil client keeps the default.
+func WithHTTPClient(client *http.Client) Option {
+	return func(a *App) {
+		if client != nil {
+			a.client = client
+		}
 	}
-	return &App{
+}
+
+// WithLogger sends the App's logging to logger instead of stderr.
+// -quiet still discards it, a nil logger keeps the default picked by -log-format.
+func WithLogger(logger Logger) Option {
+	return func(a *App) {
+		a.logger = logger
+	}
+}
+
+// WithClock makes the App read the time from clock: cache ages, the short cache window,
+// the timestamp of saved caches and archives, e.g. to test expiry without waiting.
+// A nil clock keeps the system clock.
+func WithClock(clock Clock) Option {
+	return func(a *App) {
+		if clock != nil {
+			a.clock = clock
+		}
+	}
+}
+
+// NewApp creates a new App instance with the given configuration, customized by opts.
+func NewApp(cfg *Config, opts ...Option) *App {
+	a := &App{
 		// No timeout - allow streaming downloads with context cancellation
-		client: &http.Client{},
-		cfg:    cfg,
-		logger: logger,
+		client:  &http.Client{Transport: newTransport(cfg.Proxy)},
+		cfg:     cfg,
+		baseURL: mirrorURL(cfg.Mirror),
+		clock:   realClock{},
+	}
+	for _, opt := range opts {
+		opt(a)
 	}
+	switch {
+	case cfg.Quiet:
+		a.logger = log.New(io.Discard, "", 0)
+	case a.logger == nil && cfg.LogFormat == LogFormatJSON:
+		a.logger = NewJSONLogger(os.Stderr, cfg.Architecture)
+	case a.logger == nil:
+		a.logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	// after the options so an injected client is authenticated too
+	a.withCredentials(cfg.Credentials())
+	return a
+}
+
+// newTransport returns the default transport routed through proxy, or the environment's proxy when empty
+// proxy is validated by parseFlags, an unparsable value falls back to the environment
+func newTransport(proxy string) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = http.ProxyFromEnvironment
+	if u, err := url.Parse(proxy); proxy != "" && err == nil {
+		t.Proxy = http.ProxyURL(u)
+	}
+	return t
+}
+
+// mirrorURL returns the contents URL template for a mirror root, with or without a trailing slash
+func mirrorURL(mirror string) string {
+	if mirror == "" {
+		return BaseURL
+	}
+	return strings.TrimRight(mirror, "/") + "/" + contentsPath
 }
 
 // ParseFlags parses command line flags and returns a Config.
@@ -58,54 +402,516 @@ func ParseFlags() (*Config, error) {
 }
 
 const (
-	defaultCacheTTL        = 24 * time.Hour
-	defaultCacheDir        = ".cache/package-statistics"
-	defaultDownloadTimeout = 10 * time.Minute
-	// BaseURL is the template URL for Debian package contents files.
-	BaseURL = "http://ftp.uk.debian.org/debian/dists/stable/main/Contents-%s.gz"
+	defaultCacheTTL         = 24 * time.Hour
+	defaultCacheDir         = ".cache/package-statistics"
+	defaultDownloadTimeout  = 10 * time.Minute
+	defaultWatchMaxInterval = 6 * time.Hour
+	// DefaultMirror is the Debian archive root used when -mirror is not set.
+	DefaultMirror = "http://ftp.uk.debian.org/debian"
+	// contentsPath is appended to the mirror root, {suite}, {component}, {arch} and the compression {ext} are substituted.
+	contentsPath = "dists/{suite}/{component}/Contents-{arch}{ext}"
+	// BaseURL is the template URL for Debian package contents files on the default mirror.
+	BaseURL = DefaultMirror + "/" + contentsPath
+	// DefaultSuite is the Debian suite analyzed when -suite is not set.
+	DefaultSuite = "stable"
+	// DefaultComponent is the archive area analyzed when -components is not set.
+	DefaultComponent = "main"
 	// MaxRetries is the maximum number of download retry attempts.
 	MaxRetries = 3
+	// DefaultRetryBaseDelay is the wait after the first failed attempt, doubled after each one.
+	DefaultRetryBaseDelay = time.Second
+	// MaxRetryDelay caps the doubled wait between two attempts, before jitter.
+	MaxRetryDelay = 30 * time.Second
+	// maxRetriesLimit is the largest -max-retries accepted.
+	maxRetriesLimit = 100
+
+	// CommandDiffFiles compares two exported result files without downloading.
+	CommandDiffFiles = "diff-files"
+	// CommandDetectMirror probes mirrors for latency and prints them fastest first.
+	CommandDetectMirror = "detect-mirror"
+	// CommandClearCache removes every cache file in the cache dir.
+	CommandClearCache = "clear-cache"
+	// CommandListCache prints every cache in the cache dir with its age, set by -list-cache.
+	CommandListCache = "list-cache"
+	// CommandInfo prints the metadata of an architecture's cache without downloading, set by -info.
+	CommandInfo = "info"
+	// CommandVersion prints the build version, set by -version.
+	CommandVersion = "version"
 )
 
 // parseFlags handles the actual flag parsing logic.
 func parseFlags() (*Config, error) {
-	cacheTTL := flag.Duration("cache-ttl", defaultCacheTTL, "cache TTL")
+	cacheTTL := &cacheTTLFlag{ttl: defaultCacheTTL}
+	flag.Var(cacheTTL, "cache-ttl", "cache TTL, repeat as arch=TTL or suite=TTL to override it, e.g. -cache-ttl unstable=1h (an architecture wins over a suite)")
 	cacheDir := flag.String("cache-dir", defaultCacheDir, "cache directory")
 	force := flag.Bool("force-refresh", false, "force refresh cache")
-	top := flag.Int("top", 10, "number of top packages")
+	dryRun := flag.Bool("dry-run", false, "check the cache and send the HEAD request, log which URLs would be downloaded and which served from cache, then stop")
+	noCache := flag.Bool("no-cache", false, "don't read, write or lock any cache, nothing is left in -cache-dir (no fallback to a cache when the download fails)")
+	top := flag.Int("top", 10, "number of top packages (0 = all)")
 	downloadTimeout := flag.Duration("download-timeout", defaultDownloadTimeout, "download timeout (0 = no timeout)")
+	opTimeout := flag.Duration("op-timeout", 0, "bound each whole analysis, including the cache lock wait, cache IO and HEAD (0 = no limit); -download-timeout still applies within it")
+	requestTimeout := flag.Duration("request-timeout", 0, "timeout per HEAD/GET attempt waiting for a response (0 = no timeout)")
+	maxRetries := flag.Int("max-retries", MaxRetries, "GET attempts before giving up on network errors, 5xx responses and bodies cut off mid-transfer (resumed from the received bytes)")
+	retryBaseDelay := flag.Duration("retry-base-delay", DefaultRetryBaseDelay, "wait after the first failed GET, doubled after each further failure")
+	retryJitter := flag.Bool("retry-jitter", false, "randomize each retry wait between half and all of it, spreading out many instances")
+	color := flag.String("color", ColorAuto, "color the text table (auto|always|never), auto = only when stdout is a terminal and NO_COLOR is unset")
+	nameWidth := flag.Int("name-width", 0, "minimum width of the text table's package name column, longer names still widen it (0 = fit the longest name)")
+	rawNumbers := flag.Bool("raw-numbers", false, "print text table counts without thousands separators (15432 instead of 15,432), for scripts parsing the table")
+	summaryOnly := flag.Bool("summary-only", false, "print only the summary metrics, without the ranked table")
+	dedupe := flag.Bool("dedupe", false, "count a path listed more than once for the same package only once (keeps every path in memory, not with -low-memory)")
+	includeUdeb := flag.Bool("include-udeb", false, "count debian-installer (udeb) packages, detected by their debian-installer section or -udeb suffix")
+	lowMemory := flag.Bool("low-memory", false, "spill package counts to disk shards to bound memory (keeps only the top packages)")
+	deltaThreshold := flag.Int("delta-threshold", 0, "hide diff rows whose absolute file count change is below this value")
+	printCachePath := flag.Bool("print-cache-path", false, "print the resolved cache file path to stderr")
+	clean := flag.String("clean", "", "comma separated package name cleaning steps (tabs,trim,section,lower,arch)")
+	maxCacheSize := flag.String("max-cache-size", "", "after saving a cache, evict the least recently updated ones until the cache dir is under this size, e.g. 500MB (empty = unbounded)")
+	cacheDirPerSuite := flag.Bool("cache-dir-per-suite", false, "keep caches in <cache-dir>/<suite>/<component>/contents-<arch>.json instead of one flat directory")
+	compressCache := flag.Bool("compress-cache", false, "store caches gzip-compressed (.json.gz), existing uncompressed caches are still read")
+	noProgress := flag.Bool("no-progress", false, "disable the download progress bar")
+	allowUnknownArch := flag.Bool("allow-unknown-arch", false, "accept architectures missing from the known list, e.g. a new port")
+	allArches := flag.Bool("all-arches", false, "analyze every known architecture instead of a single one, an optional argument selects the suite (-all-arches testing)")
+	archConcurrency := flag.Int("arch-concurrency", defaultArchConcurrency, "with -all-arches or several architectures, how many are downloaded at once")
+	diffArch := flag.Bool("diff-arch", false, "compare two architectures (e.g. -diff-arch amd64 arm64) and print the packages whose file counts differ most")
+	combined := flag.Bool("combined", false, "with -all-arches or several architectures, also print a combined cross-architecture top list")
+	sourceFormat := flag.String("source-format", SourceFormatAuto, "parse lines as Contents-source (true|false|auto = only for the source architecture)")
+	sampleRate := flag.Float64("sample-rate", 0, "parse only this fraction of lines, e.g. 0.1 (0 = all lines)")
+	seed := flag.Int64("seed", 0, "seed for -sample-rate so sampled results are reproducible (0 = time based)")
+	groupBy := flag.String("group-by", GroupByPackage, "count files by package or by file extension (package|extension)")
+	pathDepth := flag.Int("path-depth", 0, "count files by their first N path components instead of by package (0 = by package)")
+	format := flag.String("format", FormatText, "output format: text, json, csv, tsv, map (JSON object of package -> count, all packages if -top 0) or markdown")
+	outputArchive := flag.String("output-archive", "", "write a tar.gz bundle with results, run manifest and resolved config to this file")
+	watch := flag.Duration("watch", 0, "re-run the analysis on this interval until interrupted (0 = run once)")
+	printEach := flag.Bool("print-each", false, "with -watch, print the results after every run (default: only log each run's outcome)")
+	watchMax := flag.Duration("watch-max-interval", defaultWatchMaxInterval, "upper bound for the -watch interval when backing off on unchanged data")
+	packagePrefix := flag.String("package-prefix", "", "only count packages whose name starts with this prefix (matched against the full section/name if it contains /)")
+	progressFile := flag.String("progress-to-file", "", "write download progress samples as CSV (timestamp,bytes,bytes_per_sec) to this file")
+	suite := flag.String("suite", DefaultSuite, "Debian suite to analyze: "+strings.Join(KnownSuites, ", "))
+	allowEmpty := flag.Bool("allow-empty", false, "accept a download that yields no packages (logged as a warning) instead of failing with exit status 3")
+	mirror := flag.String("mirror", DefaultMirror, "Debian mirror root URL, dists/<suite>/main/Contents-<arch>.gz is appended automatically")
+	repeat := flag.Int("repeat", 0, "parse the local contents file given as argument N times and report parse timings (no download)")
+	compression := flag.String("compression", CompressionAuto, "contents compression: gzip, xz, bzip2, none or auto (URL suffix, then sniffed); also selects the file suffix downloaded")
+	minCount := flag.Int("min-count", 0, "hide packages with fewer files than this, -top then counts from the remaining ones")
+	bottom := flag.Int("bottom", 0, "show the N packages with the fewest files instead of the top packages")
+	headerLegend := flag.String("header-legend", DefaultLegend, "columns of the legend line ending the Contents header, everything up to it is skipped")
+	providersHistogram := flag.Bool("providers-histogram", false, "print how many files are provided by 1, 2, ... N packages instead of the package ranking")
+	components := flag.String("components", DefaultComponent, "comma-separated archive areas to merge: "+strings.Join(KnownComponents, ", "))
+	file := flag.String("file", "", "analyze this local contents file (.gz, .xz, .bz2 or plain) instead of downloading, the architecture argument is optional")
+	workers := flag.Int("workers", 1, "goroutines counting contents lines, more helps CPU-bound parses of big files (ignored with -low-memory)")
+	maxRate := flag.String("max-rate", "", "cap the download speed in bytes per second, e.g. 2MB or 512K (empty = unlimited)")
+	stripSection := flag.Bool("strip-section", false, "count packages by bare name, dropping the section/area prefix (admin/cron -> cron)")
+	output := flag.String("output", "", "write results to this file instead of stdout (\"-\" = stdout), parent directories are created")
+	authUser := flag.String("auth-user", "", "basic auth user for the mirror (default $"+credentialEnv["auth-user"]+")")
+	authPass := flag.String("auth-pass", "", "basic auth password for the mirror (default $"+credentialEnv["auth-pass"]+", safer than the flag)")
+	authToken := flag.String("auth-token", "", "bearer token for the mirror (default $"+credentialEnv["auth-token"]+", safer than the flag)")
+	proxy := flag.String("proxy", "", "proxy URL for all requests (default: HTTP_PROXY/HTTPS_PROXY from the environment)")
+	logFormat := flag.String("log-format", LogFormatText, "log format: text or json (one object per event)")
+	metricsAddr := flag.String("metrics-addr", "", "serve Prometheus metrics on this address at /metrics, e.g. :9100 (most useful with -watch)")
+	sortBy := flag.String("sort", SortCount, "order packages by file count (descending) or name (ascending), -top keeps the first N (count|name)")
+	cacheExitStatus := flag.Bool("cache-exit-status", false, "exit with status 4 instead of 0 when the results were served from the cache without downloading")
+	porcelain := flag.Bool("porcelain", false, "print only \"CHANGED <etag>\" or \"UNCHANGED <etag>\" after each run, for scripts")
+	quiet := flag.Bool("quiet", false, "suppress progress and info logging, only results (and errors) are printed")
+	showPercentDelta := flag.Bool("show-percent-delta", false, "add the percent change (delta/old*100, \"new\" for added packages) to diff output")
+	diffSort := flag.String("diff-sort", DiffSortDelta, "order diff rows by absolute delta or percent change (delta|percent)")
+	pathPrefix := flag.String("path-prefix", "", "only count files whose path starts with this prefix, e.g. usr/bin/")
+	filter := flag.String("filter", "", "only keep packages whose name matches this regular expression, e.g. ^lib")
+	profile := flag.String("profile", "", "apply a named bundle of output settings ("+profileNames(nil)+" or a [profile.NAME] table of the config file), explicit flags override it")
+	configFile := flag.String("config", "", "TOML file with default settings (cache_dir, cache_ttl, mirror, suite, top), flags override it (default "+DefaultConfigFile+" if present)")
 	help := flag.Bool("help", false, "show help")
+	version := flag.Bool("version", false, "print the version, commit and build date")
+	info := flag.Bool("info", false, "print when the architecture's cache was fetched, from where, its ETag and package count, without downloading (any age)")
+	listCache := flag.Bool("list-cache", false, "list the caches in -cache-dir with their age and whether they are past -cache-ttl, without downloading")
 	flag.Parse()
 
 	if *help {
 		flag.Usage()
 		os.Exit(0)
 	}
+	if *version {
+		return &Config{Command: CommandVersion}, nil
+	}
 
-	if flag.NArg() != 1 {
-		flag.Usage()
-		return nil, fmt.Errorf("architecture argument required")
+	dir, err := expandPath(*cacheDir)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cache dir: %w", err)
 	}
 
-	arch := strings.TrimSpace(flag.Arg(0))
-	if arch == "" {
-		return nil, fmt.Errorf("architecture cannot be empty")
+	pipeline, err := ParseCleanSteps(*clean)
+	if err != nil {
+		return nil, fmt.Errorf("invalid clean steps: %w", err)
 	}
 
-	dir, err := expandPath(*cacheDir)
+	var filterRe *regexp.Regexp
+	if *filter != "" {
+		if filterRe, err = regexp.Compile(*filter); err != nil {
+			return nil, fmt.Errorf("invalid -filter: %w", err)
+		}
+	}
+
+	cfg := &Config{
+		CacheDir:           dir,
+		CacheTTL:           cacheTTL.ttl,
+		CacheTTLOverrides:  cacheTTL.overrides,
+		ForceRefresh:       *force,
+		NoCache:            *noCache,
+		DryRun:             *dryRun,
+		TopCount:           *top,
+		ShortCacheWindow:   time.Hour,
+		DownloadTimeout:    *downloadTimeout,
+		RequestTimeout:     *requestTimeout,
+		OpTimeout:          *opTimeout,
+		MaxRetries:         *maxRetries,
+		RetryBaseDelay:     *retryBaseDelay,
+		RetryJitter:        *retryJitter,
+		SummaryOnly:        *summaryOnly,
+		RawNumbers:         *rawNumbers,
+		NameWidth:          *nameWidth,
+		Color:              *color,
+		LowMemory:          *lowMemory,
+		Dedupe:             *dedupe,
+		IncludeUdeb:        *includeUdeb,
+		DeltaThreshold:     *deltaThreshold,
+		PrintCachePath:     *printCachePath,
+		Clean:              pipeline,
+		NoProgress:         *noProgress,
+		CompressCache:      *compressCache,
+		CacheDirPerSuite:   *cacheDirPerSuite,
+		AllArches:          *allArches,
+		ArchConcurrency:    *archConcurrency,
+		Combined:           *combined,
+		DiffArch:           *diffArch,
+		SourceFormat:       *sourceFormat,
+		SampleRate:         *sampleRate,
+		Seed:               *seed,
+		PathDepth:          *pathDepth,
+		GroupBy:            *groupBy,
+		Format:             *format,
+		OutputArchive:      *outputArchive,
+		Watch:              *watch,
+		WatchMaxInterval:   *watchMax,
+		PrintEach:          *printEach,
+		PackagePrefix:      *packagePrefix,
+		ProgressFile:       *progressFile,
+		Suite:              strings.TrimSpace(*suite),
+		AllowEmpty:         *allowEmpty,
+		Mirror:             strings.TrimSpace(*mirror),
+		Repeat:             *repeat,
+		Compression:        *compression,
+		Bottom:             *bottom,
+		MinCount:           *minCount,
+		HeaderLegend:       *headerLegend,
+		ProvidersHistogram: *providersHistogram,
+		Filter:             filterRe,
+		PathPrefix:         strings.TrimPrefix(*pathPrefix, "/"),
+		ShowPercentDelta:   *showPercentDelta,
+		DiffSort:           *diffSort,
+		Quiet:              *quiet,
+		Porcelain:          *porcelain,
+		CacheExitStatus:    *cacheExitStatus,
+		Sort:               *sortBy,
+		MetricsAddr:        strings.TrimSpace(*metricsAddr),
+		LogFormat:          *logFormat,
+		Proxy:              *proxy,
+		Output:             *output,
+		StripSection:       *stripSection,
+		Workers:            *workers,
+		File:               *file,
+		Components:         splitList(*components),
+	}
+
+	if cfg.MaxRate, err = ParseByteRate(*maxRate); err != nil {
+		return nil, fmt.Errorf("invalid -max-rate: %w", err)
+	}
+	if cfg.MaxCacheSize, err = ParseByteSize(*maxCacheSize); err != nil {
+		return nil, fmt.Errorf("invalid -max-cache-size: %w", err)
+	}
+
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	// -cache-ttl arch=TTL alone leaves the default TTL to the config file
+	explicit["cache-ttl"] = cacheTTL.set
+
+	// precedence: flags, then -profile, then PKGSTATS_* variables, then the config file, then the built-in defaults
+	path, required := *configFile, true
+	if path == "" {
+		path, required = DefaultConfigFile, false
+	}
+	fc, err := LoadConfigFile(path, required)
 	if err != nil {
-		return nil, fmt.Errorf("invalid cache dir: %w", err)
+		return nil, err
+	}
+	env, err := LoadEnv()
+	if err != nil {
+		return nil, err
+	}
+	for _, defaults := range []*FileConfig{fc, env} {
+		if err := applyConfigFile(cfg, defaults, explicit); err != nil {
+			return nil, err
+		}
+	}
+	profiles, err := fc.profiles()
+	if err != nil {
+		return nil, err
+	}
+	if err := applyProfile(cfg, *profile, profiles, explicit); err != nil {
+		return nil, err
+	}
+	cfg.AuthUser = credentialOrEnv("auth-user", *authUser, explicit)
+	cfg.AuthPass = credentialOrEnv("auth-pass", *authPass, explicit)
+	cfg.AuthToken = credentialOrEnv("auth-token", *authToken, explicit)
+	if err := cfg.Credentials().validate(); err != nil {
+		return nil, err
+	}
+	if explicit["top"] && explicit["bottom"] {
+		return nil, fmt.Errorf("-top and -bottom are mutually exclusive")
+	}
+	if cfg.Workers < 1 {
+		return nil, fmt.Errorf("invalid -workers %d (want at least 1)", cfg.Workers)
+	}
+	if cfg.MaxRetries < 1 || cfg.MaxRetries > maxRetriesLimit {
+		return nil, fmt.Errorf("invalid -max-retries %d (want 1-%d)", cfg.MaxRetries, maxRetriesLimit)
+	}
+	if cfg.RetryBaseDelay < 0 {
+		return nil, fmt.Errorf("invalid -retry-base-delay %v", cfg.RetryBaseDelay)
+	}
+	if cfg.Dedupe && cfg.LowMemory {
+		return nil, fmt.Errorf("-dedupe keeps every path in memory and can't be combined with -low-memory")
+	}
+	// the low-memory parse drops everything below the top packages before these would run
+	// and before -combined sums or -diff-arch compares the architectures
+	if cfg.LowMemory && cfg.TopCount > 0 && (cfg.Bottom > 0 || cfg.Filter != nil || cfg.MinCount > 0 || len(cfg.Clean) > 0 || cfg.Combined || cfg.DiffArch) {
+		return nil, fmt.Errorf("-low-memory only keeps the -top packages, so -bottom, -filter, -min-count, -clean, -combined and -diff-arch need -top 0 with it")
+	}
+	if cfg.NameWidth < 0 {
+		return nil, fmt.Errorf("invalid -name-width %d", cfg.NameWidth)
+	}
+	if cfg.OpTimeout < 0 {
+		return nil, fmt.Errorf("invalid -op-timeout %v", cfg.OpTimeout)
+	}
+	if cfg.Bottom < 0 {
+		return nil, fmt.Errorf("invalid -bottom %d", cfg.Bottom)
+	}
+	if cfg.ArchConcurrency < 1 {
+		return nil, fmt.Errorf("invalid -arch-concurrency %d (want at least 1)", cfg.ArchConcurrency)
+	}
+	if cfg.MinCount < 0 {
+		return nil, fmt.Errorf("invalid -min-count %d", cfg.MinCount)
+	}
+	if cfg.DryRun && (cfg.File != "" || cfg.Repeat > 0 || cfg.Watch > 0 || cfg.DiffArch || cfg.OutputArchive != "") {
+		return nil, fmt.Errorf("-dry-run can't be combined with -file, -repeat, -watch, -diff-arch or -output-archive")
+	}
+
+	switch cfg.Format {
+	case FormatText, FormatJSON, FormatCSV, FormatTSV, FormatMap, FormatMarkdown:
+	default:
+		return nil, fmt.Errorf("invalid -format %q (want text, json, csv, tsv, map or markdown)", cfg.Format)
+	}
+
+	switch cfg.Color {
+	case ColorAuto, ColorAlways, ColorNever:
+	default:
+		return nil, fmt.Errorf("invalid -color %q (want auto, always or never)", cfg.Color)
+	}
+
+	switch cfg.Sort {
+	case SortCount:
+	case SortName:
+		if cfg.Bottom > 0 || cfg.LowMemory {
+			return nil, fmt.Errorf("-sort name can't be combined with -bottom or -low-memory, which pick packages by count")
+		}
+	default:
+		return nil, fmt.Errorf("invalid -sort %q (want count or name)", cfg.Sort)
 	}
 
-	return &Config{
-		Architecture:     arch,
-		CacheDir:         dir,
-		CacheTTL:         *cacheTTL,
-		ForceRefresh:     *force,
-		TopCount:         *top,
-		ShortCacheWindow: time.Hour,
-		DownloadTimeout:  *downloadTimeout,
-	}, nil
+	switch cfg.DiffSort {
+	case DiffSortDelta, DiffSortPercent:
+	default:
+		return nil, fmt.Errorf("invalid -diff-sort %q (want delta or percent)", cfg.DiffSort)
+	}
+
+	if cfg.Proxy != "" {
+		if u, err := url.Parse(cfg.Proxy); err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid -proxy %q (want a URL such as http://proxy:3128)", cfg.Proxy)
+		}
+	}
+
+	switch cfg.LogFormat {
+	case LogFormatText, LogFormatJSON:
+	default:
+		return nil, fmt.Errorf("invalid -log-format %q (want text or json)", cfg.LogFormat)
+	}
+
+	if u, err := url.Parse(cfg.Mirror); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid -mirror %q (want an http or https URL)", cfg.Mirror)
+	}
+	if _, ok := compressionExt[cfg.Compression]; !ok {
+		return nil, fmt.Errorf("invalid -compression %q (want auto, gzip, xz, bzip2 or none)", cfg.Compression)
+	}
+	if len(cfg.Components) == 0 {
+		return nil, fmt.Errorf("-components needs at least one of %s", strings.Join(KnownComponents, ", "))
+	}
+	for _, c := range cfg.Components {
+		if !slices.Contains(KnownComponents, c) {
+			return nil, fmt.Errorf("invalid component %q (want %s)", c, strings.Join(KnownComponents, ", "))
+		}
+	}
+	if !slices.Contains(KnownSuites, cfg.Suite) {
+		return nil, fmt.Errorf("invalid -suite %q (want %s)", cfg.Suite, strings.Join(KnownSuites, ", "))
+	}
+	if cfg.SampleRate < 0 || cfg.SampleRate > 1 {
+		return nil, fmt.Errorf("invalid -sample-rate %v (want 0-1)", cfg.SampleRate)
+	}
+	if cfg.PathDepth < 0 {
+		return nil, fmt.Errorf("invalid -path-depth %d", cfg.PathDepth)
+	}
+	if cfg.ProvidersHistogram && cfg.PathDepth > 0 {
+		return nil, fmt.Errorf("-providers-histogram and -path-depth are mutually exclusive")
+	}
+	switch cfg.GroupBy {
+	case GroupByPackage:
+	case GroupByExtension:
+		if cfg.ProvidersHistogram || cfg.PathDepth > 0 || cfg.StripSection || cfg.PackagePrefix != "" {
+			return nil, fmt.Errorf("-group-by %s can't be combined with -providers-histogram, -path-depth, -strip-section or -package-prefix", GroupByExtension)
+		}
+	default:
+		return nil, fmt.Errorf("invalid -group-by %q (want package or extension)", cfg.GroupBy)
+	}
+	if cfg.Seed == 0 {
+		cfg.Seed = time.Now().UnixNano()
+	}
+
+	switch cfg.SourceFormat {
+	case SourceFormatAuto, "true", "false":
+	default:
+		return nil, fmt.Errorf("invalid -source-format %q (want true, false or auto)", cfg.SourceFormat)
+	}
+
+	if *listCache {
+		cfg.Command = CommandListCache
+		return cfg, nil
+	}
+
+	// subcommands: diff-files A.json B.json
+	if flag.NArg() > 0 && flag.Arg(0) == CommandDiffFiles {
+		if flag.NArg() != 3 {
+			flag.Usage()
+			return nil, fmt.Errorf("%s requires exactly two result files", CommandDiffFiles)
+		}
+		cfg.Command = CommandDiffFiles
+		cfg.Args = flag.Args()[1:]
+		return cfg, nil
+	}
+	// detect-mirror [MIRROR...]
+	if flag.NArg() > 0 && flag.Arg(0) == CommandDetectMirror {
+		cfg.Command = CommandDetectMirror
+		cfg.Args = flag.Args()[1:]
+		return cfg, nil
+	}
+	// clear-cache
+	if flag.NArg() > 0 && flag.Arg(0) == CommandClearCache {
+		if flag.NArg() != 1 {
+			return nil, fmt.Errorf("%s takes no arguments", CommandClearCache)
+		}
+		cfg.Command = CommandClearCache
+		return cfg, nil
+	}
+
+	// -repeat N FILE benchmarks the parser on a local file
+	if cfg.Repeat < 0 {
+		return nil, fmt.Errorf("invalid -repeat %d", cfg.Repeat)
+	}
+	if cfg.Repeat > 0 {
+		if flag.NArg() != 1 {
+			return nil, fmt.Errorf("-repeat requires exactly one contents file")
+		}
+		cfg.Args = flag.Args()
+		return cfg, nil
+	}
+
+	// -file FILE analyzes a local contents file, an architecture only labels it
+	if cfg.File != "" {
+		if cfg.AllArches || flag.NArg() > 1 {
+			return nil, fmt.Errorf("-file reads a single contents file, give at most one architecture")
+		}
+		if flag.NArg() == 1 {
+			cfg.Architecture = strings.TrimSpace(flag.Arg(0))
+			cfg.Architectures = []string{cfg.Architecture}
+		}
+		return cfg, nil
+	}
+
+	if cfg.AllArches {
+		// -all-arches stable: the only argument allowed is the suite
+		switch {
+		case flag.NArg() > 1:
+			return nil, fmt.Errorf("-all-arches takes at most a suite argument")
+		case flag.NArg() == 1 && !slices.Contains(KnownSuites, flag.Arg(0)):
+			return nil, fmt.Errorf("-all-arches takes a suite (%s), not %q", strings.Join(KnownSuites, ", "), flag.Arg(0))
+		case flag.NArg() == 1 && explicit["suite"] && flag.Arg(0) != cfg.Suite:
+			return nil, fmt.Errorf("-all-arches %s conflicts with -suite %s", flag.Arg(0), cfg.Suite)
+		case flag.NArg() == 1:
+			cfg.Suite = flag.Arg(0)
+		}
+		cfg.Architectures = KnownArchitectures
+	} else {
+		if flag.NArg() == 0 {
+			flag.Usage()
+			return nil, fmt.Errorf("architecture argument required")
+		}
+		for _, arg := range flag.Args() {
+			arch := strings.TrimSpace(arg)
+			if arch == "" {
+				return nil, fmt.Errorf("architecture cannot be empty")
+			}
+			if !*allowUnknownArch && !ValidArchitecture(arch) {
+				return nil, fmt.Errorf("unknown architecture %q (want one of %s, %s; -allow-unknown-arch accepts others)",
+					arch, strings.Join(KnownArchitectures, ", "), strings.Join(OtherArchitectures, ", "))
+			}
+			if !slices.Contains(cfg.Architectures, arch) {
+				cfg.Architectures = append(cfg.Architectures, arch)
+			}
+		}
+		cfg.Architecture = cfg.Architectures[0]
+	}
+	if cfg.Combined && len(cfg.Architectures) < 2 {
+		return nil, fmt.Errorf("-combined requires -all-arches or several architectures")
+	}
+	if cfg.DiffArch && (cfg.AllArches || len(cfg.Architectures) != 2) {
+		return nil, fmt.Errorf("-diff-arch requires exactly two architectures")
+	}
+	if cfg.DiffArch && (cfg.Combined || cfg.Watch > 0) {
+		return nil, fmt.Errorf("-diff-arch can't be combined with -combined or -watch")
+	}
+	if cfg.PrintEach && cfg.Watch <= 0 {
+		return nil, fmt.Errorf("-print-each requires -watch")
+	}
+	if cfg.Watch > 0 && len(cfg.Architectures) > 1 {
+		return nil, fmt.Errorf("-watch works with a single architecture")
+	}
+	if cfg.Porcelain && len(cfg.Architectures) > 1 {
+		return nil, fmt.Errorf("-porcelain works with a single architecture")
+	}
+	if cfg.CacheExitStatus && (len(cfg.Architectures) > 1 || cfg.Watch > 0) {
+		return nil, fmt.Errorf("-cache-exit-status works with a single architecture and without -watch")
+	}
+	if *info {
+		if len(cfg.Architectures) != 1 {
+			return nil, fmt.Errorf("-info shows the cache of a single architecture")
+		}
+		cfg.Command = CommandInfo
+	}
+
+	return cfg, nil
+}
+
+// splitList splits a comma-separated flag value, dropping blanks and duplicates
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" && !slices.Contains(items, item) {
+			items = append(items, item)
+		}
+	}
+	return items
 }
 
 // expandPath expands ~ in file paths to the user's home directory.
@@ -120,6 +926,66 @@ func expandPath(path string) (string, error) {
 	return filepath.Abs(path)
 }
 
+// CacheFile returns the cache file path used for the configured suite and architecture.
+// stable keeps the original contents-<arch>.json name, other suites use contents-<suite>-<arch>.json
+// and components other than main add .<component>
+// datasets other than full package counts get their own files:
+// -path-prefix adds .under-<prefix>, -package-prefix .pkg-<prefix>, -path-depth adds .path<N>, -providers-histogram adds .providers,
+// -group-by extension adds .ext, -strip-section adds .nosection, then -dedupe adds .dedupe and -include-udeb .udeb
+// -compress-cache stores the same name with a .gz suffix
+// -cache-dir-per-suite moves the suite and component into the directories: <suite>/<component>/contents-<arch>.json
+func (a *App) CacheFile() string {
+	dir := a.cfg.CacheDir
+	name := "contents-" + a.cfg.Architecture
+	suite, component := a.cfg.ResolvedSuite(), a.cfg.ResolvedComponent()
+	if a.cfg.CacheDirPerSuite {
+		dir = filepath.Join(dir, suite, component)
+	} else {
+		if suite != DefaultSuite {
+			name = "contents-" + suite + "-" + a.cfg.Architecture
+		}
+		if component != DefaultComponent {
+			name += "." + component
+		}
+	}
+	if a.cfg.PathPrefix != "" {
+		name += ".under-" + strings.ReplaceAll(strings.Trim(a.cfg.PathPrefix, "/"), "/", "_")
+	}
+	if a.cfg.PackagePrefix != "" {
+		name += ".pkg-" + strings.ReplaceAll(a.cfg.PackagePrefix, "/", "_")
+	}
+	switch {
+	case a.cfg.PathDepth > 0:
+		name += fmt.Sprintf(".path%d", a.cfg.PathDepth)
+	case a.cfg.ProvidersHistogram:
+		name += ".providers"
+	case a.cfg.GroupBy == GroupByExtension:
+		name += ".ext"
+	case a.cfg.StripSection:
+		name += ".nosection"
+	}
+	if a.cfg.Dedupe {
+		name += ".dedupe"
+	}
+	if a.cfg.IncludeUdeb {
+		name += ".udeb"
+	}
+	name += ".json"
+	if a.cfg.CompressCache {
+		name += cache.CompressedExt
+	}
+	return filepath.Join(dir, name)
+}
+
+// URL returns the contents file URL for the configured suite and architecture.
+func (a *App) URL() string {
+	ext, ok := compressionExt[a.cfg.Compression]
+	if !ok {
+		ext = compressionExt[CompressionAuto]
+	}
+	return strings.NewReplacer("{suite}", a.cfg.ResolvedSuite(), "{component}", a.cfg.ResolvedComponent(), "{arch}", a.cfg.Architecture, "{ext}", ext).Replace(a.baseURL)
+}
+
 /*
 	AnalyzeWithCache orchestrates cache loading, download, and stats processing.
 
@@ -132,10 +998,232 @@ Step 3: Load existing cache if exists
 Step 4: Check if cache is recent enough (ShortCacheDuration is 1hr for now)
 Step 5: Download new data if cache is not recent or if HEAD's request returns modified or cache doesn't exist
 Step 6: Save cache if new data was downloaded
-Step 7: Return stats
+Step 7: Apply post-load transforms (-filter, name cleaning, min count) and return stats
+
+a.cfg.OpTimeout > 0 runs every step under one deadline, an expired one is reported as ErrOpTimeout
 */
 func (a *App) AnalyzeWithCache(ctx context.Context) ([]PackageStats, error) {
-	cacheFile := filepath.Join(a.cfg.CacheDir, fmt.Sprintf("contents-%s.json", a.cfg.Architecture))
+	res, err := a.Analyze(ctx)
+	return res.Stats, err
+}
+
+// Result is the outcome of Analyze.
+type Result struct {
+	Stats []PackageStats
+	// FromCache is set when nothing was downloaded: the cache was recent or unchanged upstream,
+	// or the download failed and the cache was used instead (every component with -components)
+	FromCache bool
+	// Totals is what the parse counted before any filter, -min-count or low-memory truncation,
+	// the footer of the text table
+	Totals Totals
+}
+
+// Analyze is AnalyzeWithCache that also reports where the data came from and what the parse counted
+func (a *App) Analyze(ctx context.Context) (Result, error) {
+	res, _, err := a.analyze(ctx)
+	return res, err
+}
+
+// analyze is Analyze that also returns the loaded stats before refine, which -combined merges across architectures
+func (a *App) analyze(ctx context.Context) (Result, []PackageStats, error) {
+	a.fromCache, a.totals = false, Totals{}
+	load := a.loadStats
+	switch {
+	case a.cfg.File != "":
+		load = a.loadFile
+	case len(a.cfg.Components) > 1:
+		load = a.loadComponents
+	}
+	if a.cfg.OpTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, a.cfg.OpTimeout, ErrOpTimeout)
+		defer cancel()
+	}
+	raw, err := load(ctx)
+	if err != nil {
+		if context.Cause(ctx) == ErrOpTimeout {
+			return Result{}, nil, fmt.Errorf("%w after %v: %w", ErrOpTimeout, a.cfg.OpTimeout, err)
+		}
+		return Result{}, nil, err
+	}
+	res := Result{Stats: a.cfg.refine(raw), FromCache: a.fromCache, Totals: a.totals}
+	if a.cfg.File == "" {
+		a.metrics.observeCache(a.cfg.Architecture, res.FromCache)
+	}
+	if !a.cfg.ProvidersHistogram {
+		a.metrics.observePackages(a.cfg.Architecture, len(res.Stats))
+	}
+	return res, raw, nil
+}
+
+// refine applies the post-load transforms: -filter, name cleaning and min count
+// the package prefix is applied by the parse, cached and fresh data are otherwise unfiltered so any -filter can reuse one cache
+func (c *Config) refine(stats []PackageStats) []PackageStats {
+	if c.ProvidersHistogram {
+		// keys are provider counts, not package names
+		return stats
+	}
+	stats = FilterRegexp(stats, c.Filter)
+	stats = CleanStats(stats, c.Clean)
+	// after cleaning, which can merge names into bigger packages
+	return FilterMinCount(stats, c.MinCount)
+}
+
+// partialReason explains why a fresh download holds less than the full dataset ("" if it is complete)
+// partial results are never cached so the cache always holds the full data
+func (a *App) partialReason() string {
+	switch {
+	case a.cfg.LowMemory && a.cfg.TopCount > 0:
+		// low-memory mode only keeps the top packages
+		return "truncated low-memory"
+	case a.cfg.Sampling():
+		return "sampled"
+	}
+	return ""
+}
+
+// loadComponents loads every component through its own cache and sums the counts
+func (a *App) loadComponents(ctx context.Context) ([]PackageStats, error) {
+	a.changed, a.etag, a.fromCache, a.totals = false, "", true, Totals{}
+	sets := make([][]PackageStats, 0, len(a.cfg.Components))
+	for _, component := range a.cfg.Components {
+		sub := a.forComponent(component)
+		stats, err := sub.loadStats(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("component %s: %w", component, err)
+		}
+		a.changed = a.changed || sub.changed
+		a.fromCache = a.fromCache && sub.fromCache
+		// a package belongs to a single component, so the totals add up
+		a.totals.Files += sub.totals.Files
+		a.totals.Packages += sub.totals.Packages
+		sets = append(sets, stats)
+	}
+	return MergeStats(sets...), nil
+}
+
+// now returns the current time on the App's clock, the system clock for an App built without NewApp
+func (a *App) now() time.Time {
+	if a.clock == nil {
+		return time.Now()
+	}
+	return a.clock.Now()
+}
+
+// since is time.Since on the App's clock
+func (a *App) since(t time.Time) time.Duration {
+	return a.now().Sub(t)
+}
+
+// forComponent returns a copy of the app configured for a single component
+func (a *App) forComponent(component string) *App {
+	cfg := *a.cfg
+	cfg.Components = []string{component}
+	return &App{client: a.client, cfg: &cfg, logger: a.logger, baseURL: a.baseURL, metrics: a.metrics, clock: a.clock}
+}
+
+// downloadUncached is loadStats for -no-cache: no lock, no cache read or write, and so no fallback to one
+func (a *App) downloadUncached(ctx context.Context) ([]PackageStats, error) {
+	if a.cfg.DownloadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.cfg.DownloadTimeout)
+		defer cancel()
+	}
+	stats, etag, _, err := a.Download(ctx, a.URL(), nil)
+	if err != nil {
+		return nil, err
+	}
+	a.changed, a.etag = true, etag
+	return stats, nil
+}
+
+// ErrOpTimeout is returned by AnalyzeWithCache when -op-timeout ran out
+var ErrOpTimeout = errors.New("operation timed out")
+
+/*
+dryRun is loadStats for -dry-run: it makes the same cache and HEAD checks, logs the outcome and stops before the GET.
+a.changed and a.etag are set as the real run would set them, for -porcelain.
+
+The cache is read without locking or removing anything, and the stats are only returned when they would be used.
+*/
+func (a *App) dryRun(ctx context.Context) ([]PackageStats, error) {
+	a.changed, a.etag = false, ""
+	url := a.URL()
+	var cached *CacheEntry
+	if !a.cfg.ForceRefresh && !a.cfg.NoCache && !a.cfg.Sampling() {
+		cached = a.peekCache()
+	}
+	if cached != nil && a.cfg.ShortCacheWindow > 0 && a.since(cached.Timestamp) < a.cfg.ShortCacheWindow {
+		a.logger.Printf("Dry run: would use recent cached data for %s (age=%s)", url, a.since(cached.Timestamp).Truncate(time.Second))
+		a.etag, a.fromCache, a.totals = cached.ETag, true, entryTotals(cached)
+		return cached.Stats, nil
+	}
+
+	resp, err := HeadRequest(ctx, a.client, url, cached, a.cfg.RequestTimeout)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		logAt(a.logger, slog.LevelWarn, nil, "Dry run: HEAD %s failed (%v), would try to download it", url, err)
+		a.changed = true
+		return nil, nil
+	}
+	resp.Body.Close()
+	etag, lastMod := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	switch {
+	case cached != nil && (resp.StatusCode == http.StatusNotModified || (etag == cached.ETag && lastMod == cached.LastModified)):
+		a.logger.Printf("Dry run: %s is unchanged, would use cached data", url)
+		a.etag, a.fromCache, a.totals = cached.ETag, true, entryTotals(cached)
+		return cached.Stats, nil
+	case resp.StatusCode >= http.StatusBadRequest:
+		logAt(a.logger, slog.LevelWarn, nil, "Dry run: HEAD %s returned %s, the download would fail", url, resp.Status)
+	case resp.ContentLength > 0:
+		a.logger.Printf("Dry run: would download %s (%.1f MB)", url, float64(resp.ContentLength)/(1024*1024))
+	default:
+		a.logger.Printf("Dry run: would download %s (size unknown)", url)
+	}
+	// what -porcelain reports: the download would bring new data with this ETag
+	a.changed, a.etag = true, etag
+	return nil, nil
+}
+
+// entryTotals returns the totals stored with a cache entry, counted from its stats for an entry written without them
+func entryTotals(entry *CacheEntry) Totals {
+	if entry.Totals != nil {
+		return *entry.Totals
+	}
+	return TotalsOf(entry.Stats)
+}
+
+// peekCache returns the cache loadStats would start from, nil if there is none or it is past its TTL
+// unlike cache.LoadCache it never removes a corrupt file
+func (a *App) peekCache() *CacheEntry {
+	cacheFile := a.CacheFile()
+	entry, err := cache.ReadEntry(cacheFile)
+	if err != nil && a.cfg.CompressCache {
+		entry, err = cache.ReadEntry(strings.TrimSuffix(cacheFile, cache.CompressedExt))
+	}
+	if err != nil || a.since(entry.Timestamp) > a.cfg.ResolvedCacheTTL() {
+		return nil
+	}
+	return entry
+}
+
+// loadStats returns the raw stats from cache or a fresh download, updating the cache.
+func (a *App) loadStats(ctx context.Context) ([]PackageStats, error) {
+	if a.cfg.DryRun {
+		return a.dryRun(ctx)
+	}
+	cacheFile := a.CacheFile()
+	if a.cfg.CacheDirPerSuite {
+		// the partial download and the lock live next to the cache
+		if err := os.MkdirAll(filepath.Dir(cacheFile), 0o755); err != nil {
+			return nil, fmt.Errorf("create cache dir: %w", err)
+		}
+	}
+	if a.cfg.NoCache {
+		return a.downloadUncached(ctx)
+	}
 	lockFile := cacheFile + ".lock"
 
 	// cleanup old locks
@@ -147,21 +1235,29 @@ func (a *App) AnalyzeWithCache(ctx context.Context) ([]PackageStats, error) {
 		return nil, err
 	}
 	defer cache.ReleaseLock(lock, lockFile, a.logger)
+	a.changed = false
+	a.etag = ""
 
-	// load existing cache
+	// load existing cache, the full data it holds is not a sample
 	var cached *CacheEntry
-	if !a.cfg.ForceRefresh {
-		cached, _ = cache.LoadCache(cacheFile, a.cfg.CacheTTL)
+	if !a.cfg.ForceRefresh && !a.cfg.Sampling() {
+		ttl := a.cfg.ResolvedCacheTTL()
+		cached, _ = cache.LoadCacheAt(cacheFile, ttl, a.now())
+		if cached == nil && a.cfg.CompressCache {
+			// a cache written before -compress-cache, the next save writes a compressed one next to it
+			cached, _ = cache.LoadCacheAt(strings.TrimSuffix(cacheFile, cache.CompressedExt), ttl, a.now())
+		}
 	}
 
 	// use short cache window
-	if cached != nil && a.cfg.ShortCacheWindow > 0 && time.Since(cached.Timestamp) < a.cfg.ShortCacheWindow {
-		a.logger.Printf("Using recent cached data (age=%s)", time.Since(cached.Timestamp).Truncate(time.Second))
+	if cached != nil && a.cfg.ShortCacheWindow > 0 && a.since(cached.Timestamp) < a.cfg.ShortCacheWindow {
+		a.logger.Printf("Using recent cached data (age=%s, fetched=%s)", a.since(cached.Timestamp).Truncate(time.Second), FormatTimestamp(cached.Timestamp))
+		a.etag, a.fromCache, a.totals = cached.ETag, true, entryTotals(cached)
 		return cached.Stats, nil
 	}
 
 	// download new data with configurable timeout
-	url := fmt.Sprintf(BaseURL, a.cfg.Architecture)
+	url := a.URL()
 	downloadCtx := ctx
 	if a.cfg.DownloadTimeout > 0 {
 		var cancel context.CancelFunc
@@ -170,28 +1266,46 @@ func (a *App) AnalyzeWithCache(ctx context.Context) ([]PackageStats, error) {
 	}
 	stats, etag, lastMod, err := a.Download(downloadCtx, url, cached)
 	if err != nil && cached != nil {
-		if downloadCtx.Err() == context.DeadlineExceeded {
-			a.logger.Printf("Download timeout after %v, falling back to cache", a.cfg.DownloadTimeout)
+		if context.Cause(downloadCtx) == ErrOpTimeout {
+			logAt(a.logger, slog.LevelWarn, nil, "Operation timeout after %v, falling back to cache", a.cfg.OpTimeout)
+		} else if downloadCtx.Err() == context.DeadlineExceeded {
+			logAt(a.logger, slog.LevelWarn, nil, "Download timeout after %v, falling back to cache", a.cfg.DownloadTimeout)
 		} else {
-			a.logger.Printf("Network error, falling back to cache: %v", err)
+			logAt(a.logger, slog.LevelWarn, nil, "Download failed, falling back to cache: %v", err)
 		}
+		a.etag, a.fromCache, a.totals = cached.ETag, true, entryTotals(cached)
 		return cached.Stats, nil
 	} else if err != nil {
 		return nil, err
 	}
+	// without validators there is no way to tell, assume the data changed
+	a.changed = cached == nil || etag != cached.ETag || lastMod != cached.LastModified || (etag == "" && lastMod == "")
+	a.etag = etag
 
 	// save cache
+	totals := a.totals
 	entry := &CacheEntry{
 		Architecture: a.cfg.Architecture,
 		Stats:        stats,
-		Timestamp:    time.Now().UTC(),
+		Timestamp:    a.now().UTC(),
 		URL:          url,
 		ETag:         etag,
 		LastModified: lastMod,
+		Totals:       &totals,
+	}
+
+	if reason := a.partialReason(); reason != "" {
+		a.logger.Printf("Not caching %s results", reason)
+		return stats, nil
 	}
 
 	if err := cache.SaveCache(cacheFile, entry); err != nil {
-		a.logger.Printf("Failed to save cache: %v", err)
+		logAt(a.logger, slog.LevelWarn, nil, "Failed to save cache: %v", err)
+	} else if a.cfg.MaxCacheSize > 0 {
+		// the new cache is still locked, so it is never the one evicted
+		if err := cache.EnforceSizeLimit(a.cfg.CacheDir, a.cfg.MaxCacheSize); err != nil {
+			logAt(a.logger, slog.LevelWarn, nil, "Failed to enforce -max-cache-size: %v", err)
+		}
 	}
 
 	return stats, nil
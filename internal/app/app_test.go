@@ -4,11 +4,20 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -26,13 +35,7 @@ func TestExpandPath(t *testing.T) {
 }
 
 func TestParseFlagsNoArch(t *testing.T) {
-	fs := flag.NewFlagSet("test", flag.ContinueOnError)
-	old := flag.CommandLine
-	defer func() { flag.CommandLine = old }()
-	flag.CommandLine = fs
-
-	_ = fs.Parse([]string{})
-	_, err := parseFlags()
+	_, err := parseArgs(t)
 	if err == nil {
 		t.Fatal("should fail without arch")
 	}
@@ -51,7 +54,7 @@ func TestDownload(t *testing.T) {
 	}))
 	defer server.Close()
 
-	app := NewApp(&Config{Architecture: "amd64", CacheDir: t.TempDir()}, nil)
+	app := NewApp(&Config{Architecture: "amd64", CacheDir: t.TempDir()})
 	stats, etag, _, err := app.Download(context.Background(), server.URL, nil)
 
 	if err != nil {
@@ -77,7 +80,7 @@ func TestDownloadNotModified(t *testing.T) {
 	}))
 	defer server.Close()
 
-	app := NewApp(&Config{Architecture: "amd64", CacheDir: t.TempDir()}, nil)
+	app := NewApp(&Config{Architecture: "amd64", CacheDir: t.TempDir()})
 	stats, etag, _, err := app.Download(context.Background(), server.URL, cached)
 
 	if err != nil {
@@ -108,7 +111,7 @@ func TestCacheHit(t *testing.T) {
 		CacheDir:         tempDir,
 		CacheTTL:         time.Hour,
 		ShortCacheWindow: time.Minute, // Add this to use cache
-	}, nil)
+	})
 
 	stats, err := app.AnalyzeWithCache(context.Background())
 	if err != nil {
@@ -121,7 +124,7 @@ func TestCacheHit(t *testing.T) {
 
 func TestNewApp(t *testing.T) {
 	cfg := &Config{Architecture: "amd64", CacheDir: "/tmp"}
-	app := NewApp(cfg, nil)
+	app := NewApp(cfg)
 
 	if app.cfg != cfg {
 		t.Error("config not set")
@@ -130,3 +133,1066 @@ func TestNewApp(t *testing.T) {
 		t.Error("logger not created")
 	}
 }
+
+// recordingTransport serves a fixed gzipped contents body and records every request
+type recordingTransport struct {
+	body     []byte
+	requests []string
+}
+
+func (rt *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.requests = append(rt.requests, req.Method+" "+req.URL.String())
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Etag": []string{"injected"}},
+		Body:       io.NopCloser(bytes.NewReader(rt.body)),
+		Request:    req,
+	}, nil
+}
+
+// tracingTransport is a middleware RoundTripper recording every request with its Authorization header
+type tracingTransport struct {
+	base  http.RoundTripper
+	mu    sync.Mutex
+	trace []string
+}
+
+func (rt *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.mu.Lock()
+	rt.trace = append(rt.trace, req.Method+" "+req.URL.Path+" "+req.Header.Get("Authorization"))
+	rt.mu.Unlock()
+	return rt.base.RoundTrip(req)
+}
+
+func TestInjectedClientUsedForEveryArchitecture(t *testing.T) {
+	server := newContentsServer(t, map[string]string{
+		"/Contents-amd64.gz": "usr/bin/a pkg1\n",
+		"/Contents-arm64.gz": "usr/bin/b pkg2\n",
+	})
+	rt := &tracingTransport{base: http.DefaultTransport}
+	client := &http.Client{Transport: rt}
+	cfg := &Config{CacheDir: t.TempDir(), CacheTTL: time.Hour, ArchConcurrency: 1, AuthToken: "tok", NoProgress: true}
+	app := NewApp(cfg, WithLogger(log.New(io.Discard, "", 0)), WithHTTPClient(client))
+	app.baseURL = server.URL + "/Contents-{arch}.gz"
+
+	for _, r := range app.AnalyzeArchitectures(context.Background(), []string{"amd64", "arm64"}) {
+		if r.Err != nil || len(r.Stats) != 1 {
+			t.Fatalf("%s: got %+v, %v", r.Architecture, r.Stats, r.Err)
+		}
+	}
+	// the architectures may run in any order
+	slices.Sort(rt.trace)
+	want := []string{
+		"GET /Contents-amd64.gz Bearer tok", "GET /Contents-arm64.gz Bearer tok",
+		"HEAD /Contents-amd64.gz Bearer tok", "HEAD /Contents-arm64.gz Bearer tok",
+	}
+	if !slices.Equal(rt.trace, want) {
+		t.Errorf("got %q, want %q", rt.trace, want)
+	}
+	if client.Transport != rt {
+		t.Error("the caller's client must not be modified")
+	}
+}
+
+func TestNewAppWithOptions(t *testing.T) {
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	fmt.Fprintln(gz, "usr/bin/file1 pkg1")
+	gz.Close()
+
+	clock := newFakeClock(time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC))
+	rt := &recordingTransport{body: body.Bytes()}
+	var logs bytes.Buffer
+	cfg := &Config{Architecture: "amd64", CacheDir: t.TempDir(), CacheTTL: time.Hour, ShortCacheWindow: time.Minute, NoProgress: true}
+	app := NewApp(cfg,
+		WithLogger(log.New(&logs, "", 0)),
+		WithHTTPClient(&http.Client{Transport: rt}),
+		WithClock(clock),
+	)
+
+	if _, err := app.Analyze(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	entry, err := cache.ReadEntry(app.CacheFile())
+	if err != nil || !entry.Timestamp.Equal(clock.Now()) {
+		t.Fatalf("the cache should be stamped with the injected clock, got %+v, %v", entry, err)
+	}
+
+	// each step moves the clock instead of sleeping: inside the short window, inside the TTL, past it
+	for _, tt := range []struct {
+		advance   time.Duration
+		requests  int
+		fromCache bool
+	}{
+		{30 * time.Second, 0, true},
+		{10 * time.Minute, 1, true},
+		{2 * time.Hour, 2, false},
+	} {
+		clock.Advance(tt.advance)
+		rt.requests = nil
+		res, err := app.Analyze(context.Background())
+		if err != nil || len(rt.requests) != tt.requests || res.FromCache != tt.fromCache {
+			t.Errorf("after %v: got requests %v, from cache %v, %v", tt.advance, rt.requests, res.FromCache, err)
+		}
+	}
+	if !strings.Contains(logs.String(), "Using recent cached data") {
+		t.Errorf("the injected logger should get the App's logging:\n%s", logs.String())
+	}
+}
+
+func TestNewAppWithHTTPClient(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	fmt.Fprintln(gz, "usr/bin/file1 pkg1")
+	gz.Close()
+
+	rt := &recordingTransport{body: buf.Bytes()}
+	app := NewApp(&Config{Architecture: "amd64", CacheDir: t.TempDir()}, WithHTTPClient(&http.Client{Transport: rt}))
+
+	stats, etag, _, err := app.Download(context.Background(), app.URL(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 || etag != "injected" {
+		t.Errorf("got %+v, etag %q", stats, etag)
+	}
+	url := "http://ftp.uk.debian.org/debian/dists/stable/main/Contents-amd64.gz"
+	want := []string{"HEAD " + url, "GET " + url}
+	if fmt.Sprint(rt.requests) != fmt.Sprint(want) {
+		t.Errorf("got requests %v, want %v", rt.requests, want)
+	}
+
+	if NewApp(&Config{}, WithHTTPClient(nil)).client == nil {
+		t.Error("a nil client should keep the default")
+	}
+}
+
+func TestCacheFile(t *testing.T) {
+	dir := t.TempDir()
+	app := NewApp(&Config{Architecture: "arm64", CacheDir: dir})
+
+	want := filepath.Join(dir, "contents-arm64.json")
+	if got := app.CacheFile(); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	app = NewApp(&Config{Architecture: "arm64", CacheDir: dir, PathDepth: 2})
+	want = filepath.Join(dir, "contents-arm64.path2.json")
+	if got := app.CacheFile(); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	app = NewApp(&Config{Architecture: "arm64", CacheDir: dir, ProvidersHistogram: true})
+	want = filepath.Join(dir, "contents-arm64.providers.json")
+	if got := app.CacheFile(); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	app = NewApp(&Config{Architecture: "arm64", CacheDir: dir, GroupBy: GroupByExtension})
+	want = filepath.Join(dir, "contents-arm64.ext.json")
+	if got := app.CacheFile(); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	app = NewApp(&Config{Architecture: "arm64", CacheDir: dir, PathDepth: 1, Dedupe: true})
+	want = filepath.Join(dir, "contents-arm64.path1.dedupe.json")
+	if got := app.CacheFile(); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	app = NewApp(&Config{Architecture: "arm64", CacheDir: dir, PathPrefix: "usr/bin/", PathDepth: 3})
+	want = filepath.Join(dir, "contents-arm64.under-usr_bin.path3.json")
+	if got := app.CacheFile(); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	app = NewApp(&Config{Architecture: "arm64", CacheDir: dir, PathPrefix: "usr/lib/", PackagePrefix: "libdevel/"})
+	want = filepath.Join(dir, "contents-arm64.under-usr_lib.pkg-libdevel_.json")
+	if got := app.CacheFile(); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	app = NewApp(&Config{Architecture: "arm64", CacheDir: dir, Components: []string{"contrib"}})
+	want = filepath.Join(dir, "contents-arm64.contrib.json")
+	if got := app.CacheFile(); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	app = NewApp(&Config{Architecture: "arm64", CacheDir: dir, StripSection: true})
+	want = filepath.Join(dir, "contents-arm64.nosection.json")
+	if got := app.CacheFile(); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	app = NewApp(&Config{Architecture: "arm64", CacheDir: dir, Suite: "unstable"})
+	want = filepath.Join(dir, "contents-unstable-arm64.json")
+	if got := app.CacheFile(); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestURLSuite(t *testing.T) {
+	app := NewApp(&Config{Architecture: "amd64"})
+	if got, want := app.URL(), "http://ftp.uk.debian.org/debian/dists/stable/main/Contents-amd64.gz"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	app = NewApp(&Config{Architecture: "arm64", Suite: "testing"})
+	if got, want := app.URL(), "http://ftp.uk.debian.org/debian/dists/testing/main/Contents-arm64.gz"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestURLMirror(t *testing.T) {
+	want := "http://mirror.internal/debian/dists/stable/main/Contents-amd64.gz"
+	for _, mirror := range []string{"http://mirror.internal/debian", "http://mirror.internal/debian/"} {
+		app := NewApp(&Config{Architecture: "amd64", Mirror: mirror})
+		if got := app.URL(); got != want {
+			t.Errorf("%s: got %s, want %s", mirror, got, want)
+		}
+	}
+}
+
+// hostEnv is the environment the tests were started with
+var hostEnv = func() map[string]string {
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		name, value, _ := strings.Cut(kv, "=")
+		env[name] = value
+	}
+	return env
+}()
+
+// isolateEnv points HOME and XDG_CONFIG_HOME at a temp dir and clears the PKGSTATS_* variables
+// so parseFlags never reads the developer's config file or environment, variables the test already set itself are kept
+func isolateEnv(t *testing.T) {
+	t.Helper()
+	var home string
+	for _, name := range []string{"HOME", "XDG_CONFIG_HOME"} {
+		if value, ok := os.LookupEnv(name); ok && value != hostEnv[name] {
+			continue
+		}
+		if home == "" {
+			home = t.TempDir()
+		}
+		if name == "HOME" {
+			t.Setenv(name, home)
+		} else {
+			t.Setenv(name, filepath.Join(home, ".config"))
+		}
+	}
+	for name, value := range hostEnv {
+		if current, ok := os.LookupEnv(name); strings.HasPrefix(name, EnvPrefix) && ok && current == value {
+			// t.Setenv restores the variable when the test ends
+			t.Setenv(name, "")
+			os.Unsetenv(name)
+		}
+	}
+}
+
+// parseArgs runs parseFlags on args with a fresh flag set and an isolated environment
+func parseArgs(t *testing.T, args ...string) (*Config, error) {
+	t.Helper()
+	isolateEnv(t)
+	oldArgs, oldFlags := os.Args, flag.CommandLine
+	defer func() { os.Args, flag.CommandLine = oldArgs, oldFlags }()
+
+	flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+	os.Args = append([]string{"test"}, args...)
+	return parseFlags()
+}
+
+func TestParseFlagsValidation(t *testing.T) {
+	for _, tt := range []struct {
+		args    []string
+		wantErr bool
+	}{
+		{[]string{"amd64"}, false},
+		{[]string{"-suite", "unstable", "amd64"}, false},
+		{[]string{"-suite", "", "amd64"}, true},
+		{[]string{"-suite", "bogus", "amd64"}, true},
+		{[]string{"-mirror", "https://mirror.internal/debian/", "amd64"}, false},
+		{[]string{"-mirror", "mirror.internal", "amd64"}, true},
+		{[]string{"clear-cache"}, false},
+		{[]string{"-sort", "name", "amd64"}, false},
+		{[]string{"-sort", "size", "amd64"}, true},
+		{[]string{"-sort", "name", "-bottom", "5", "amd64"}, true},
+		{[]string{"-sort", "name", "-low-memory", "amd64"}, true},
+		{[]string{"clear-cache", "amd64"}, true},
+		{[]string{"-dry-run", "amd64", "arm64"}, false},
+		{[]string{"-dry-run", "-watch", "1h", "amd64"}, true},
+		{[]string{"-watch", "1h", "amd64", "arm64"}, true},
+		{[]string{"-watch", "1h", "-all-arches"}, true},
+		{[]string{"-watch", "1h", "amd64"}, false},
+		{[]string{"-max-retries", "100", "amd64"}, false},
+		{[]string{"-max-retries", "101", "amd64"}, true},
+		{[]string{"-dry-run", "-file", "Contents-amd64.gz"}, true},
+		{[]string{"-dry-run", "-porcelain", "amd64"}, false},
+		{[]string{"-group-by", "extension", "amd64"}, false},
+		{[]string{"-group-by", "extension", "-path-depth", "2", "amd64"}, true},
+		{[]string{"-group-by", "suffix", "amd64"}, true},
+		{[]string{"-dedupe", "amd64"}, false},
+		{[]string{"-dedupe", "-low-memory", "amd64"}, true},
+		{[]string{"-low-memory", "-bottom", "5", "amd64"}, true},
+		{[]string{"-low-memory", "-filter", "^lib", "amd64"}, true},
+		{[]string{"-low-memory", "-min-count", "2", "amd64"}, true},
+		{[]string{"-low-memory", "-clean", "tabs", "amd64"}, true},
+		{[]string{"-low-memory", "-combined", "amd64", "arm64"}, true},
+		{[]string{"-low-memory", "-diff-arch", "amd64", "arm64"}, true},
+		{[]string{"-low-memory", "-top", "0", "-combined", "amd64", "arm64"}, false},
+		{[]string{"-low-memory", "-top", "0", "-filter", "^lib", "-min-count", "2", "amd64"}, false},
+	} {
+		_, err := parseArgs(t, tt.args...)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%v: got err %v", tt.args, err)
+		}
+	}
+}
+
+func TestAnalyzeWithCacheAppliesClean(t *testing.T) {
+	tempDir := t.TempDir()
+	entry := &cache.CacheEntry{
+		Architecture: "amd64",
+		Stats: []cache.PackageStats{
+			{Name: "devel/foo", FileCount: 3},
+			{Name: "libs/foo", FileCount: 2},
+		},
+		Timestamp: time.Now().UTC(),
+	}
+	_ = cache.SaveCache(filepath.Join(tempDir, "contents-amd64.json"), entry)
+
+	pipeline, _ := ParseCleanSteps("section")
+	app := NewApp(&Config{
+		Architecture:     "amd64",
+		CacheDir:         tempDir,
+		CacheTTL:         time.Hour,
+		ShortCacheWindow: time.Minute,
+		Clean:            pipeline,
+	})
+
+	stats, err := app.AnalyzeWithCache(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 || stats[0].Name != "foo" || stats[0].FileCount != 5 {
+		t.Errorf("got %+v", stats)
+	}
+}
+
+func TestUseSourceFormat(t *testing.T) {
+	tests := []struct {
+		arch    string
+		setting string
+		want    bool
+	}{
+		{"source", SourceFormatAuto, true},
+		{"amd64", SourceFormatAuto, false},
+		{"source", "", true},
+		{"amd64", "true", true},
+		{"source", "false", false},
+	}
+
+	for _, tt := range tests {
+		cfg := &Config{Architecture: tt.arch, SourceFormat: tt.setting}
+		if got := cfg.UseSourceFormat(); got != tt.want {
+			t.Errorf("%s/%q: got %v, want %v", tt.arch, tt.setting, got, tt.want)
+		}
+	}
+}
+
+func TestPackagePrefixFiltersWhileParsing(t *testing.T) {
+	var downloads atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			downloads.Add(1)
+		}
+		gz := gzip.NewWriter(w)
+		_, _ = gz.Write([]byte("usr/lib/libc.so.6 libs/libc6\nusr/lib/libz.so libs/zlib1g\nusr/bin/ls utils/coreutils\n"))
+		gz.Close()
+	}))
+	defer server.Close()
+
+	tempDir := t.TempDir()
+	run := func(prefix string) []PackageStats {
+		app := NewApp(&Config{
+			Architecture:     "amd64",
+			CacheDir:         tempDir,
+			CacheTTL:         time.Hour,
+			ShortCacheWindow: time.Hour,
+			PackagePrefix:    prefix,
+		})
+		app.baseURL = server.URL + "/Contents-{arch}.gz"
+		stats, err := app.AnalyzeWithCache(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stats
+	}
+
+	if got := run("lib"); len(got) != 1 || got[0].Name != "libs/libc6" {
+		t.Errorf("lib: got %+v", got)
+	}
+	if got := run("core"); len(got) != 1 || got[0].Name != "utils/coreutils" {
+		t.Errorf("core: got %+v", got)
+	}
+	// each prefix has its own cache, holding only what the parse kept
+	if got := run("lib"); len(got) != 1 || got[0].Name != "libs/libc6" {
+		t.Errorf("lib again: got %+v", got)
+	}
+	if n := downloads.Load(); n != 2 {
+		t.Errorf("got %d downloads, want 2", n)
+	}
+
+	entry, err := cache.LoadCache(filepath.Join(tempDir, "contents-amd64.pkg-lib.json"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(entry.Stats) != "[{libs/libc6 1}]" {
+		t.Errorf("the prefixed cache should hold the filtered parse, got %+v", entry.Stats)
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, "contents-amd64.json")); err == nil {
+		t.Error("a prefixed run must not write the full cache")
+	}
+}
+
+func TestParseFlagsPorcelainSingleArch(t *testing.T) {
+	if _, err := parseArgs(t, "-porcelain", "amd64", "arm64"); err == nil {
+		t.Error("-porcelain with several architectures should fail")
+	}
+	cfg, err := parseArgs(t, "-porcelain", "amd64")
+	if err != nil || !cfg.Porcelain {
+		t.Errorf("got %+v, %v", cfg, err)
+	}
+}
+
+func TestParseFlagsLogFormat(t *testing.T) {
+	if _, err := parseArgs(t, "-log-format", "xml", "amd64"); err == nil {
+		t.Error("unknown -log-format should fail")
+	}
+	cfg, err := parseArgs(t, "-log-format", "json", "amd64")
+	if err != nil || cfg.LogFormat != LogFormatJSON {
+		t.Errorf("got %+v, %v", cfg, err)
+	}
+}
+
+func TestNewAppProxy(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	fmt.Fprintln(gz, "usr/bin/file1 pkg1")
+	gz.Close()
+
+	// a forward proxy sees the absolute target URL in the request line
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.Method+" "+r.URL.String())
+		_, _ = w.Write(buf.Bytes())
+	}))
+	defer proxy.Close()
+
+	app := NewApp(&Config{Architecture: "amd64", CacheDir: t.TempDir(), NoProgress: true, Proxy: proxy.URL}, WithLogger(log.New(io.Discard, "", 0)))
+	app.baseURL = "http://mirror.invalid/Contents-{arch}.gz"
+
+	stats, _, _, err := app.Download(context.Background(), app.URL(), nil)
+	if err != nil || len(stats) != 1 {
+		t.Fatalf("got %v, %v", stats, err)
+	}
+	if len(proxied) == 0 || proxied[len(proxied)-1] != "GET http://mirror.invalid/Contents-amd64.gz" {
+		t.Errorf("requests should go through the proxy, got %v", proxied)
+	}
+}
+
+func TestNewTransportProxy(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "http://mirror.invalid/", nil)
+
+	u, err := newTransport("http://proxy.example:3128").Proxy(req)
+	if err != nil || u == nil || u.Host != "proxy.example:3128" {
+		t.Errorf("explicit proxy: got %v, %v", u, err)
+	}
+	if newTransport("").Proxy == nil {
+		t.Error("default transport should honor the environment proxy")
+	}
+	if _, err := parseArgs(t, "-proxy", "not a url", "amd64"); err == nil {
+		t.Error("invalid -proxy should fail")
+	}
+}
+
+func TestParseFlagsRetry(t *testing.T) {
+	cfg, err := parseArgs(t, "amd64")
+	if err != nil || cfg.MaxRetries != MaxRetries || cfg.RetryBaseDelay != DefaultRetryBaseDelay || cfg.RetryJitter {
+		t.Errorf("defaults changed: %+v, %v", cfg, err)
+	}
+	if _, err := parseArgs(t, "-max-retries", "0", "amd64"); err == nil {
+		t.Error("-max-retries 0 should fail")
+	}
+	cfg, err = parseArgs(t, "-max-retries", "5", "-retry-base-delay", "250ms", "-retry-jitter", "amd64")
+	if p := cfg.retryPolicy(); err != nil || p.MaxRetries != 5 || p.BaseDelay != 250*time.Millisecond || !p.Jitter {
+		t.Errorf("got %+v, %v", cfg, err)
+	}
+}
+
+func TestParseFlagsVersionWithoutArch(t *testing.T) {
+	cfg, err := parseArgs(t, "-version")
+	if err != nil || cfg.Command != CommandVersion {
+		t.Errorf("got %+v, %v", cfg, err)
+	}
+}
+
+func TestParseFlagsListCacheWithoutArch(t *testing.T) {
+	cfg, err := parseArgs(t, "-list-cache", "-cache-dir", "/tmp/cache")
+	if err != nil || cfg.Command != CommandListCache || cfg.CacheDir != "/tmp/cache" {
+		t.Errorf("got %+v, %v", cfg, err)
+	}
+}
+
+func TestParseFlagsMaxRate(t *testing.T) {
+	cfg, err := parseArgs(t, "-max-rate", "2MB", "amd64")
+	if err != nil || cfg.MaxRate != 2<<20 {
+		t.Errorf("got %+v, %v", cfg, err)
+	}
+	if _, err := parseArgs(t, "-max-rate", "fast", "amd64"); err == nil {
+		t.Error("invalid -max-rate should fail")
+	}
+}
+
+func TestParseFlagsWorkers(t *testing.T) {
+	cfg, err := parseArgs(t, "amd64")
+	if err != nil || cfg.Workers != 1 {
+		t.Errorf("default should be single threaded, got %+v, %v", cfg, err)
+	}
+	if _, err := parseArgs(t, "-workers", "0", "amd64"); err == nil {
+		t.Error("-workers 0 should fail")
+	}
+}
+
+func TestAnalyzeLocalFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "Contents-amd64.gz")
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	fmt.Fprintln(gz, "usr/bin/a pkg1,pkg2")
+	fmt.Fprintln(gz, "usr/bin/b pkg1")
+	gz.Close()
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rt := &recordingTransport{}
+	cacheDir := t.TempDir()
+	app := NewApp(&Config{File: path, CacheDir: cacheDir, CacheTTL: time.Hour}, WithLogger(log.New(io.Discard, "", 0)), WithHTTPClient(&http.Client{Transport: rt}))
+	stats, err := app.AnalyzeWithCache(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 2 || stats[0] != (PackageStats{Name: "pkg1", FileCount: 2}) {
+		t.Errorf("got %+v", stats)
+	}
+	if len(rt.requests) != 0 {
+		t.Errorf("-file must not touch the network, got %v", rt.requests)
+	}
+	if entries, _ := os.ReadDir(cacheDir); len(entries) != 0 {
+		t.Errorf("-file must not write a cache, got %v", entries)
+	}
+}
+
+func TestParseFlagsFile(t *testing.T) {
+	cfg, err := parseArgs(t, "-file", "Contents-amd64.gz")
+	if err != nil || cfg.File != "Contents-amd64.gz" || cfg.Architecture != "" {
+		t.Errorf("architecture should be optional: %+v, %v", cfg, err)
+	}
+	if _, err := parseArgs(t, "-file", "Contents-amd64.gz", "amd64", "arm64"); err == nil {
+		t.Error("-file with several architectures should fail")
+	}
+}
+
+func TestAnalyzeComponentsMerged(t *testing.T) {
+	bodies := map[string]string{
+		"main":     "usr/bin/a pkg1\nusr/bin/b pkg1\nusr/bin/c pkg2\n",
+		"contrib":  "usr/bin/d pkg1\nusr/bin/e pkg3\n",
+		"non-free": "usr/bin/f pkg3\n",
+	}
+	var requested []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		component := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")[0]
+		if r.Method == http.MethodGet {
+			requested = append(requested, component)
+		}
+		gz := gzip.NewWriter(w)
+		_, _ = io.WriteString(gz, bodies[component])
+		gz.Close()
+	}))
+	defer server.Close()
+
+	cacheDir := t.TempDir()
+	app := NewApp(&Config{
+		Architecture: "amd64",
+		CacheDir:     cacheDir,
+		CacheTTL:     time.Hour,
+		NoProgress:   true,
+		Components:   []string{"main", "contrib", "non-free"},
+	}, WithLogger(log.New(io.Discard, "", 0)))
+	app.baseURL = server.URL + "/{component}/Contents-{arch}.gz"
+
+	stats, err := app.AnalyzeWithCache(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PackageStats{{Name: "pkg1", FileCount: 3}, {Name: "pkg3", FileCount: 2}, {Name: "pkg2", FileCount: 1}}
+	if fmt.Sprint(stats) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", stats, want)
+	}
+	if strings.Join(requested, ",") != "main,contrib,non-free" {
+		t.Errorf("got requests %v", requested)
+	}
+	for _, name := range []string{"contents-amd64.json", "contents-amd64.contrib.json", "contents-amd64.non-free.json"} {
+		if _, err := os.Stat(filepath.Join(cacheDir, name)); err != nil {
+			t.Errorf("each component should be cached separately: %v", err)
+		}
+	}
+}
+
+func TestParseFlagsComponents(t *testing.T) {
+	cfg, err := parseArgs(t, "amd64")
+	if err != nil || fmt.Sprint(cfg.Components) != "[main]" {
+		t.Errorf("got %+v, %v", cfg, err)
+	}
+	cfg, err = parseArgs(t, "-components", "main, contrib,main", "amd64")
+	if err != nil || fmt.Sprint(cfg.Components) != "[main contrib]" {
+		t.Errorf("got %+v, %v", cfg, err)
+	}
+	if _, err := parseArgs(t, "-components", "main,restricted", "amd64"); err == nil {
+		t.Error("unknown component should fail")
+	}
+}
+
+func TestCompressCacheReadsPlainCache(t *testing.T) {
+	dir := t.TempDir()
+	plain := NewApp(&Config{Architecture: "amd64", CacheDir: dir})
+	compressed := NewApp(&Config{Architecture: "amd64", CacheDir: dir, CacheTTL: time.Hour, ShortCacheWindow: time.Hour, CompressCache: true}, WithLogger(log.New(io.Discard, "", 0)))
+	if want := filepath.Join(dir, "contents-amd64.json.gz"); compressed.CacheFile() != want {
+		t.Fatalf("got %s, want %s", compressed.CacheFile(), want)
+	}
+
+	entry := &CacheEntry{Architecture: "amd64", Stats: []PackageStats{{Name: "pkg1", FileCount: 3}}, Timestamp: time.Now().UTC()}
+	if err := cache.SaveCache(plain.CacheFile(), entry); err != nil {
+		t.Fatal(err)
+	}
+	// no server: the existing uncompressed cache has to be used
+	compressed.baseURL = "http://127.0.0.1:1/Contents-{arch}.gz"
+	stats, err := compressed.AnalyzeWithCache(context.Background())
+	if err != nil || len(stats) != 1 || stats[0].FileCount != 3 {
+		t.Errorf("got %v, %v", stats, err)
+	}
+}
+
+func TestResolvedCacheTTL(t *testing.T) {
+	cfg, err := parseArgs(t, "-cache-ttl", "12h", "-cache-ttl", "unstable=1h", "-cache-ttl", "stable=168h", "-cache-ttl", "arm64=30m", "amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		arch, suite string
+		want        time.Duration
+	}{
+		{"amd64", "stable", 168 * time.Hour},
+		{"amd64", "", 168 * time.Hour},
+		{"amd64", "unstable", time.Hour},
+		{"amd64", "testing", 12 * time.Hour},
+		{"arm64", "stable", 30 * time.Minute},
+		{"arm64", "unstable", 30 * time.Minute},
+	} {
+		c := *cfg
+		c.Architecture, c.Suite = tt.arch, tt.suite
+		if got := c.ResolvedCacheTTL(); got != tt.want {
+			t.Errorf("%s/%s: got %v, want %v", tt.arch, tt.suite, got, tt.want)
+		}
+	}
+
+	cfg, err = parseArgs(t, "amd64")
+	if err != nil || cfg.ResolvedCacheTTL() != defaultCacheTTL {
+		t.Errorf("got %v, %v", cfg.ResolvedCacheTTL(), err)
+	}
+	for _, bad := range []string{"=1h", "unstable=soon", "-1h", "unstable"} {
+		if err := (&cacheTTLFlag{}).Set(bad); err == nil {
+			t.Errorf("-cache-ttl %s should fail", bad)
+		}
+	}
+}
+
+func TestCacheTTLOverrideExpiresCache(t *testing.T) {
+	server := newContentsServer(t, map[string]string{"/Contents-amd64.gz": "usr/bin/a fresh\n"})
+	dir := t.TempDir()
+	entry := &CacheEntry{Architecture: "amd64", Stats: []PackageStats{{Name: "cached", FileCount: 1}}, Timestamp: time.Now().Add(-2 * time.Hour).UTC()}
+
+	for _, tt := range []struct {
+		overrides map[string]time.Duration
+		want      string
+	}{
+		{nil, "cached"},
+		{map[string]time.Duration{"amd64": time.Hour}, "fresh"},
+	} {
+		// a valid cache falls in the short window and is used without asking the server
+		app := NewApp(&Config{
+			Architecture:      "amd64",
+			CacheDir:          dir,
+			CacheTTL:          24 * time.Hour,
+			CacheTTLOverrides: tt.overrides,
+			ShortCacheWindow:  3 * time.Hour,
+			NoProgress:        true,
+		}, WithLogger(log.New(io.Discard, "", 0)))
+		app.baseURL = server.URL + "/Contents-{arch}.gz"
+		if err := cache.SaveCache(app.CacheFile(), entry); err != nil {
+			t.Fatal(err)
+		}
+		stats, err := app.AnalyzeWithCache(context.Background())
+		if err != nil || stats[0].Name != tt.want {
+			t.Errorf("overrides %v: got %v, %v", tt.overrides, stats, err)
+		}
+	}
+}
+
+func TestMinCountWithTop(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "Contents-amd64")
+	var contents strings.Builder
+	// pkgN ships N files
+	for n := 1; n <= 5; n++ {
+		for i := 0; i < n; i++ {
+			fmt.Fprintf(&contents, "usr/share/pkg%d/file%d pkg%d\n", n, i, n)
+		}
+	}
+	if err := os.WriteFile(path, []byte(contents.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		// the long tail goes first, -top counts what is left
+		{[]string{"-min-count", "3", "-top", "5"}, "1,pkg5,5 2,pkg4,4 3,pkg3,3"},
+		{[]string{"-min-count", "2", "-top", "2"}, "1,pkg5,5 2,pkg4,4"},
+		// -bottom ranks the smallest of the remaining packages
+		{[]string{"-min-count", "3", "-bottom", "2"}, "1,pkg3,3 2,pkg4,4"},
+	} {
+		cfg, err := parseArgs(t, append(tt.args, "-file", path, "-format", "csv")...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats, err := NewApp(cfg, WithLogger(log.New(io.Discard, "", 0))).AnalyzeWithCache(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		if err := PrintResults(&out, stats, cfg); err != nil {
+			t.Fatal(err)
+		}
+		rows := strings.Fields(strings.TrimPrefix(out.String(), "rank,name,file_count\n"))
+		if strings.Join(rows, " ") != tt.want {
+			t.Errorf("%v: got %v, want %s", tt.args, rows, tt.want)
+		}
+	}
+
+	if _, err := parseArgs(t, "-min-count", "-1", "amd64"); err == nil {
+		t.Error("negative -min-count should fail")
+	}
+}
+
+func TestMaxCacheSizeKeepsNewCache(t *testing.T) {
+	server := newContentsServer(t, map[string]string{"/Contents-amd64.gz": "usr/bin/a pkg1\n"})
+	dir := t.TempDir()
+	old := filepath.Join(dir, "contents-arm64.json")
+	if err := os.WriteFile(old, []byte(strings.Repeat("x", 4096)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := parseArgs(t, "-max-cache-size", "1K", "-cache-dir", dir, "amd64")
+	if err != nil || cfg.MaxCacheSize != 1024 {
+		t.Fatalf("got %+v, %v", cfg, err)
+	}
+	cfg.NoProgress = true
+	app := NewApp(cfg, WithLogger(log.New(io.Discard, "", 0)))
+	app.baseURL = server.URL + "/Contents-{arch}.gz"
+	if _, err := app.AnalyzeWithCache(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Error("the older cache should be evicted")
+	}
+	if _, err := os.Stat(app.CacheFile()); err != nil {
+		t.Errorf("the cache just saved must be kept: %v", err)
+	}
+}
+
+func TestCacheDirPerSuite(t *testing.T) {
+	server := newContentsServer(t, map[string]string{"/Contents-amd64.gz": "usr/bin/a pkg1\nusr/bin/b pkg1\n"})
+	dir := t.TempDir()
+	cfg, err := parseArgs(t, "-cache-dir-per-suite", "-cache-dir", dir, "-suite", "testing", "amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.NoProgress = true
+	app := NewApp(cfg, WithLogger(log.New(io.Discard, "", 0)))
+	app.baseURL = server.URL + "/Contents-{arch}.gz"
+
+	want := filepath.Join(dir, "testing", DefaultComponent, "contents-amd64.json")
+	if got := app.CacheFile(); got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+	if _, err := app.AnalyzeWithCache(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(want); err != nil {
+		t.Fatalf("the nested cache should be saved: %v", err)
+	}
+
+	// the second run is served from the nested cache
+	server.Close()
+	res, err := app.Analyze(context.Background())
+	if err != nil || !res.FromCache || len(res.Stats) != 1 || res.Stats[0].FileCount != 2 {
+		t.Errorf("got %+v, %v", res, err)
+	}
+
+	var buf bytes.Buffer
+	RunListCache(&buf, cfg, log.New(io.Discard, "", 0))
+	if !strings.Contains(buf.String(), filepath.Join("testing", DefaultComponent, "contents-amd64.json")) {
+		t.Errorf("list-cache should show the nested cache:\n%s", buf.String())
+	}
+}
+
+func TestNoCacheLeavesNoFiles(t *testing.T) {
+	server := newContentsServer(t, map[string]string{"/Contents-amd64.gz": "usr/bin/a fresh\nusr/bin/b fresh\n"})
+
+	for _, lowMemory := range []bool{false, true} {
+		cacheDir := filepath.Join(t.TempDir(), "cache")
+		app := NewApp(&Config{Architecture: "amd64", CacheDir: cacheDir, CacheTTL: time.Hour, NoCache: true, LowMemory: lowMemory, TopCount: 10, NoProgress: true}, WithLogger(log.New(io.Discard, "", 0)))
+		app.baseURL = server.URL + "/Contents-{arch}.gz"
+
+		stats, err := app.AnalyzeWithCache(context.Background())
+		if err != nil || len(stats) != 1 || stats[0].FileCount != 2 {
+			t.Errorf("low memory %v: got %v, %v", lowMemory, stats, err)
+		}
+		if _, err := os.Stat(cacheDir); !os.IsNotExist(err) {
+			entries, _ := os.ReadDir(cacheDir)
+			t.Errorf("low memory %v: -no-cache must not touch the cache dir, found %v", lowMemory, entries)
+		}
+	}
+}
+
+func TestNoCacheIgnoresExistingCache(t *testing.T) {
+	dir := t.TempDir()
+	entry := &CacheEntry{Architecture: "amd64", Stats: []PackageStats{{Name: "cached", FileCount: 1}}, Timestamp: time.Now().UTC()}
+	if err := cache.SaveCache(filepath.Join(dir, "contents-amd64.json"), entry); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	app := NewApp(&Config{Architecture: "amd64", CacheDir: dir, CacheTTL: time.Hour, ShortCacheWindow: time.Hour, NoCache: true, RetryBaseDelay: time.Millisecond, NoProgress: true}, WithLogger(log.New(io.Discard, "", 0)))
+	app.baseURL = server.URL + "/Contents-{arch}.gz"
+	if stats, err := app.AnalyzeWithCache(context.Background()); !errors.Is(err, ErrServerError) {
+		t.Errorf("a failed download must not fall back to the cache, got %v, %v", stats, err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("got %v", entries)
+	}
+}
+
+func TestDryRunSkipsGET(t *testing.T) {
+	dir := t.TempDir()
+	rt := &recordingTransport{}
+	var logs bytes.Buffer
+	app := NewApp(&Config{Architecture: "amd64", CacheDir: dir, CacheTTL: time.Hour, DryRun: true}, WithLogger(log.New(&logs, "", 0)), WithHTTPClient(&http.Client{Transport: rt}))
+
+	stats, err := app.AnalyzeWithCache(context.Background())
+	if err != nil || len(stats) != 0 {
+		t.Fatalf("got %v, %v", stats, err)
+	}
+	url := "http://ftp.uk.debian.org/debian/dists/stable/main/Contents-amd64.gz"
+	if want := []string{"HEAD " + url}; fmt.Sprint(rt.requests) != fmt.Sprint(want) {
+		t.Errorf("got requests %v, want %v", rt.requests, want)
+	}
+	if !strings.Contains(logs.String(), "Dry run: would download "+url) {
+		t.Errorf("got logs %q", logs.String())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("a dry run must not write to the cache dir, got %v", entries)
+	}
+}
+
+func TestDryRunUsesUnchangedCache(t *testing.T) {
+	dir := t.TempDir()
+	entry := &CacheEntry{Architecture: "amd64", Stats: []PackageStats{{Name: "cached", FileCount: 1}}, Timestamp: time.Now().Add(-2 * time.Minute).UTC(), ETag: "injected"}
+	if err := cache.SaveCache(filepath.Join(dir, "contents-amd64.json"), entry); err != nil {
+		t.Fatal(err)
+	}
+	rt := &recordingTransport{}
+	var logs bytes.Buffer
+	app := NewApp(&Config{Architecture: "amd64", CacheDir: dir, CacheTTL: time.Hour, ShortCacheWindow: time.Minute, DryRun: true}, WithLogger(log.New(&logs, "", 0)), WithHTTPClient(&http.Client{Transport: rt}))
+
+	stats, err := app.AnalyzeWithCache(context.Background())
+	if err != nil || len(stats) != 1 || stats[0].Name != "cached" {
+		t.Fatalf("got %v, %v", stats, err)
+	}
+	if len(rt.requests) != 1 || !strings.HasPrefix(rt.requests[0], "HEAD ") {
+		t.Errorf("got requests %v", rt.requests)
+	}
+	if !strings.Contains(logs.String(), "would use cached data") {
+		t.Errorf("got logs %q", logs.String())
+	}
+}
+
+func TestDryRunPorcelain(t *testing.T) {
+	dir := t.TempDir()
+	app := NewApp(&Config{Architecture: "amd64", CacheDir: dir, CacheTTL: time.Hour, DryRun: true, Porcelain: true},
+		WithLogger(log.New(io.Discard, "", 0)), WithHTTPClient(&http.Client{Transport: &recordingTransport{}}))
+
+	var out bytes.Buffer
+	if _, err := app.Analyze(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	_ = app.PrintPorcelain(&out)
+
+	entry := &CacheEntry{Architecture: "amd64", Stats: []PackageStats{{Name: "cached", FileCount: 1}}, Timestamp: time.Now().UTC(), ETag: "injected"}
+	if err := cache.SaveCache(filepath.Join(dir, "contents-amd64.json"), entry); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.Analyze(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	_ = app.PrintPorcelain(&out)
+
+	if want := "CHANGED injected\nUNCHANGED injected\n"; out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+}
+
+func TestOpTimeoutBoundsStalledHEAD(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-done:
+		}
+	}))
+	defer server.Close()
+	defer close(done)
+
+	app := NewApp(&Config{Architecture: "amd64", CacheDir: t.TempDir(), CacheTTL: time.Hour, DownloadTimeout: time.Minute, OpTimeout: 100 * time.Millisecond, NoProgress: true}, WithLogger(log.New(io.Discard, "", 0)))
+	app.baseURL = server.URL + "/Contents-{arch}.gz"
+
+	start := time.Now()
+	_, err := app.AnalyzeWithCache(context.Background())
+	if !errors.Is(err, ErrOpTimeout) {
+		t.Errorf("got %v, want ErrOpTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the whole analysis should stop at -op-timeout, took %v", elapsed)
+	}
+}
+
+func TestOpTimeoutBoundsLockWait(t *testing.T) {
+	dir := t.TempDir()
+	app := NewApp(&Config{Architecture: "amd64", CacheDir: dir, CacheTTL: time.Hour, OpTimeout: 100 * time.Millisecond}, WithLogger(log.New(io.Discard, "", 0)))
+	lockFile := app.CacheFile() + ".lock"
+	held, err := cache.AcquireLock(lockFile, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.ReleaseLock(held, lockFile, nil)
+
+	start := time.Now()
+	if _, err := app.AnalyzeWithCache(context.Background()); !errors.Is(err, ErrOpTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want ErrOpTimeout wrapping the lock wait's deadline", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("waiting for the lock should stop at -op-timeout, took %v", elapsed)
+	}
+}
+
+func TestAnalyzeReportsSource(t *testing.T) {
+	server := newContentsServer(t, map[string]string{"/Contents-amd64.gz": "usr/bin/a fresh\n"})
+	dir := t.TempDir()
+	app := NewApp(&Config{Architecture: "amd64", CacheDir: dir, CacheTTL: time.Hour, ShortCacheWindow: time.Hour, NoProgress: true}, WithLogger(log.New(io.Discard, "", 0)))
+	app.baseURL = server.URL + "/Contents-{arch}.gz"
+
+	res, err := app.Analyze(context.Background())
+	if err != nil || res.FromCache || len(res.Stats) != 1 {
+		t.Fatalf("first run should download: got %+v, %v", res, err)
+	}
+	res, err = app.Analyze(context.Background())
+	if err != nil || !res.FromCache || len(res.Stats) != 1 {
+		t.Errorf("second run should be served from the cache: got %+v, %v", res, err)
+	}
+
+	// past the short window the HEAD finds the same (empty) validators
+	app.cfg.ShortCacheWindow = 0
+	if res, err = app.Analyze(context.Background()); err != nil || !res.FromCache {
+		t.Errorf("an unchanged HEAD should use the cache: got %+v, %v", res, err)
+	}
+
+	app.cfg.ForceRefresh = true
+	if res, err = app.Analyze(context.Background()); err != nil || res.FromCache {
+		t.Errorf("a new download is not from the cache: got %+v, %v", res, err)
+	}
+}
+
+func TestAnalyzeTotalsSurviveFilterAndCache(t *testing.T) {
+	server := newContentsServer(t, map[string]string{"/Contents-amd64.gz": "usr/bin/a pkg1\nusr/bin/b pkg1\nusr/bin/c pkg2\nusr/bin/d lib3\n"})
+	dir := t.TempDir()
+	app := NewApp(&Config{Architecture: "amd64", CacheDir: dir, CacheTTL: time.Hour, ShortCacheWindow: time.Hour, NoProgress: true,
+		Filter: regexp.MustCompile("^lib")}, WithLogger(log.New(io.Discard, "", 0)))
+	app.baseURL = server.URL + "/Contents-{arch}.gz"
+
+	want := Totals{Files: 4, Packages: 3}
+	for _, run := range []string{"download", "cache"} {
+		res, err := app.Analyze(context.Background())
+		if err != nil || len(res.Stats) != 1 || res.Totals != want {
+			t.Errorf("%s: got %+v, want totals %+v of the unfiltered parse", run, res, want)
+		}
+	}
+	entry, err := cache.ReadEntry(app.CacheFile())
+	if err != nil || entry.Totals == nil || *entry.Totals != want {
+		t.Errorf("the cache entry should store the totals: got %+v, %v", entry, err)
+	}
+}
+
+func TestSampledRunSkipsCache(t *testing.T) {
+	var contents strings.Builder
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&contents, "usr/share/doc/file%d pkg%d\n", i, i%10)
+	}
+	server := newContentsServer(t, map[string]string{"/Contents-amd64.gz": contents.String()})
+	dir := t.TempDir()
+	cfg := &Config{Architecture: "amd64", CacheDir: dir, CacheTTL: time.Hour, ShortCacheWindow: time.Hour, NoProgress: true}
+	app := NewApp(cfg, WithLogger(log.New(io.Discard, "", 0)))
+	app.baseURL = server.URL + "/Contents-{arch}.gz"
+
+	full, err := app.Analyze(context.Background())
+	if err != nil || full.Totals.Files != 1000 {
+		t.Fatalf("full run: got %+v, %v", full.Totals, err)
+	}
+	cfg.SampleRate, cfg.Seed = 0.1, 42
+	sampled, err := app.Analyze(context.Background())
+	if err != nil || sampled.FromCache || sampled.Totals.Files >= 500 || sampled.Totals.Files == 0 {
+		t.Errorf("a sampled run must not be served from the full cache: got %+v, from cache %v, %v", sampled.Totals, sampled.FromCache, err)
+	}
+	again, err := app.Analyze(context.Background())
+	if err != nil || again.Totals != sampled.Totals {
+		t.Errorf("the same seed should sample the same lines: got %+v, want %+v, %v", again.Totals, sampled.Totals, err)
+	}
+	cfg.SampleRate = 0
+	if res, err := app.Analyze(context.Background()); err != nil || !res.FromCache || res.Totals.Files != 1000 {
+		t.Errorf("the full cache should be left in place: got %+v, from cache %v, %v", res.Totals, res.FromCache, err)
+	}
+}
+
+func TestParseFlagsCacheExitStatus(t *testing.T) {
+	if cfg, err := parseArgs(t, "-cache-exit-status", "amd64"); err != nil || !cfg.CacheExitStatus {
+		t.Errorf("got %+v, %v", cfg, err)
+	}
+	if _, err := parseArgs(t, "-cache-exit-status", "amd64", "arm64"); err == nil {
+		t.Error("-cache-exit-status needs a single architecture")
+	}
+}
@@ -0,0 +1,86 @@
+package app
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Manifest describes a single analysis run.
+type Manifest struct {
+	Architecture      string `json:"architecture"`
+	URL               string `json:"url"`
+	CacheFile         string `json:"cache_file"`
+	GeneratedAt       string `json:"generated_at"`
+	PackageCount      int    `json:"package_count"`
+	TotalAssociations int    `json:"total_associations"`
+}
+
+/*
+WriteArchive bundles the results, run manifest and resolved config into a tar.gz
+
+Layout (prefix named by arch and timestamp):
+package-statistics-amd64-20250910T024523Z/results.json
+package-statistics-amd64-20250910T024523Z/manifest.json
+package-statistics-amd64-20250910T024523Z/config.json
+
+The archive is assembled in memory and every entry uses the run timestamp,
+so the same run always produces the same bytes.
+*/
+func (a *App) WriteArchive(file string, stats []PackageStats) error {
+	now := a.now().UTC().Truncate(time.Second)
+	summary := Summarize(stats)
+	manifest := Manifest{
+		Architecture:      a.cfg.Architecture,
+		URL:               a.URL(),
+		CacheFile:         a.CacheFile(),
+		GeneratedAt:       FormatTimestamp(now),
+		PackageCount:      summary.TotalPackages,
+		TotalAssociations: summary.TotalAssociations,
+	}
+
+	prefix := fmt.Sprintf("package-statistics-%s-%s/", a.cfg.Architecture, now.Format("20060102T150405Z"))
+	members := []struct {
+		name string
+		v    interface{}
+	}{
+		{"results.json", stats},
+		{"manifest.json", manifest},
+		{"config.json", a.cfg},
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.ModTime = now
+	tw := tar.NewWriter(gz)
+	for _, m := range members {
+		data, err := json.MarshalIndent(m.v, "", "  ")
+		if err != nil {
+			return fmt.Errorf("encode %s: %w", m.name, err)
+		}
+		hdr := &tar.Header{
+			Name:    prefix + m.name,
+			Mode:    0o644,
+			Size:    int64(len(data)),
+			ModTime: now,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	return os.WriteFile(file, buf.Bytes(), 0o644)
+}
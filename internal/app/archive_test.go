@@ -0,0 +1,72 @@
+package app
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/canonical-dev/package_statistics/internal/cache"
+)
+
+func TestWriteArchive(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "bundle.tar.gz")
+	app := NewApp(&Config{Architecture: "amd64", CacheDir: dir, TopCount: 10})
+	stats := []cache.PackageStats{{Name: "pkg1", FileCount: 10}, {Name: "pkg2", FileCount: 5}}
+
+	if err := app.WriteArchive(file, stats); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+
+	members := make(map[string][]byte)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(hdr.Name, "package-statistics-amd64-") {
+			t.Errorf("unexpected member prefix %s", hdr.Name)
+		}
+		data, _ := io.ReadAll(tr)
+		members[path.Base(hdr.Name)] = data
+	}
+
+	for _, name := range []string{"results.json", "manifest.json", "config.json"} {
+		if _, ok := members[name]; !ok {
+			t.Errorf("missing member %s", name)
+		}
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(members["manifest.json"], &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Architecture != "amd64" || manifest.PackageCount != 2 || manifest.TotalAssociations != 15 {
+		t.Errorf("got manifest %+v", manifest)
+	}
+
+	var results []cache.PackageStats
+	if err := json.Unmarshal(members["results.json"], &results); err != nil || len(results) != 2 {
+		t.Errorf("got results %v, %v", results, err)
+	}
+}
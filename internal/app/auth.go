@@ -0,0 +1,100 @@
+package app
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Credentials authenticate the requests to the mirror: a bearer token, or basic auth with a user and password.
+type Credentials struct {
+	User     string
+	Password string
+	Token    string
+}
+
+// credentialEnv maps each credential to the PKGSTATS_* variable read when its flag isn't set,
+// keeping secrets out of the process list
+var credentialEnv = map[string]string{
+	"auth-user":  EnvPrefix + "AUTH_USER",
+	"auth-pass":  EnvPrefix + "AUTH_PASS",
+	"auth-token": EnvPrefix + "AUTH_TOKEN",
+}
+
+// credentialOrEnv returns value when the flag name was set on the command line, its environment variable otherwise
+func credentialOrEnv(name, value string, explicit map[string]bool) string {
+	if explicit[name] {
+		return value
+	}
+	return os.Getenv(credentialEnv[name])
+}
+
+// validate rejects credentials that can't form a single Authorization header
+func (c Credentials) validate() error {
+	switch {
+	case c.Token != "" && (c.User != "" || c.Password != ""):
+		return fmt.Errorf("-auth-token can't be combined with -auth-user/-auth-pass")
+	case c.Password != "" && c.User == "":
+		return fmt.Errorf("-auth-pass requires -auth-user")
+	}
+	return nil
+}
+
+// header returns the Authorization header value, "" when there are no credentials
+func (c Credentials) header() string {
+	switch {
+	case c.Token != "":
+		return "Bearer " + c.Token
+	case c.User != "":
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(c.User+":"+c.Password))
+	}
+	return ""
+}
+
+/*
+authTransport adds the Authorization header to requests for the mirror and nothing else.
+
+The origin (scheme and host) is taken from mirror on every request, so a redirect to another
+host or from https to http goes out without the credentials, and so do detect-mirror's probes.
+A request that already carries an Authorization header is left alone.
+*/
+type authTransport struct {
+	base   http.RoundTripper
+	auth   string
+	mirror func() string
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Authorization") != "" || !sameOrigin(req.URL, t.mirror()) {
+		return t.base.RoundTrip(req)
+	}
+	// a RoundTripper must not modify the caller's request
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", t.auth)
+	return t.base.RoundTrip(req)
+}
+
+// sameOrigin reports whether u has the scheme and host of the mirror URL
+func sameOrigin(u *url.URL, mirror string) bool {
+	m, err := url.Parse(mirror)
+	return err == nil && strings.EqualFold(u.Scheme, m.Scheme) && strings.EqualFold(u.Host, m.Host)
+}
+
+// withCredentials makes the App authenticate its requests to the mirror, wrapping a copy of its client
+func (a *App) withCredentials(c Credentials) {
+	auth := c.header()
+	if auth == "" {
+		return
+	}
+	client := *a.client
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	client.Transport = &authTransport{base: base, auth: auth, mirror: a.URL}
+	a.client = &client
+}
@@ -0,0 +1,123 @@
+package app
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// authRecorder serves a small contents file and records the Authorization header of every request by method
+type authRecorder struct {
+	mu   sync.Mutex
+	seen map[string][]string
+}
+
+func newAuthServer(t *testing.T, rec *authRecorder) *httptest.Server {
+	t.Helper()
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	_, _ = gz.Write([]byte("usr/bin/a pkg1\n"))
+	gz.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec.mu.Lock()
+		rec.seen[r.Method] = append(rec.seen[r.Method], r.Header.Get("Authorization"))
+		rec.mu.Unlock()
+		w.Header().Set("ETag", "v1")
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(body.Bytes())
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestCredentialsSentOnHEADAndGET(t *testing.T) {
+	basic := "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:s3cret"))
+	for _, tt := range []struct {
+		cfg  Config
+		want string
+	}{
+		{Config{AuthUser: "alice", AuthPass: "s3cret"}, basic},
+		{Config{AuthToken: "tok123"}, "Bearer tok123"},
+		{Config{}, ""},
+	} {
+		rec := &authRecorder{seen: make(map[string][]string)}
+		server := newAuthServer(t, rec)
+		cfg := tt.cfg
+		cfg.Architecture, cfg.CacheDir, cfg.NoProgress = "amd64", t.TempDir(), true
+		app := NewApp(&cfg, WithLogger(log.New(io.Discard, "", 0)))
+		app.baseURL = server.URL + "/Contents-{arch}.gz"
+
+		if _, _, _, err := app.Download(context.Background(), app.URL(), nil); err != nil {
+			t.Fatal(err)
+		}
+		for _, method := range []string{http.MethodHead, http.MethodGet} {
+			if got := rec.seen[method]; len(got) != 1 || got[0] != tt.want {
+				t.Errorf("%s with %+v: got Authorization %q, want %q", method, tt.cfg.Credentials(), got, tt.want)
+			}
+		}
+	}
+}
+
+func TestCredentialsNotLeakedOnRedirect(t *testing.T) {
+	other := &authRecorder{seen: make(map[string][]string)}
+	elsewhere := newAuthServer(t, other)
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer tok123" {
+			t.Errorf("%s on the mirror without credentials", r.Method)
+		}
+		http.Redirect(w, r, elsewhere.URL+r.URL.Path, http.StatusFound)
+	}))
+	defer mirror.Close()
+
+	app := NewApp(&Config{Architecture: "amd64", CacheDir: t.TempDir(), AuthToken: "tok123", NoProgress: true}, WithLogger(log.New(io.Discard, "", 0)))
+	app.baseURL = mirror.URL + "/Contents-{arch}.gz"
+	if _, _, _, err := app.Download(context.Background(), app.URL(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(other.seen[http.MethodGet]) == 0 {
+		t.Fatal("the redirect was not followed")
+	}
+	for method, headers := range other.seen {
+		for _, h := range headers {
+			if h != "" {
+				t.Errorf("%s redirected to another host carried Authorization %q", method, h)
+			}
+		}
+	}
+}
+
+func TestParseFlagsCredentials(t *testing.T) {
+	t.Setenv(EnvPrefix+"AUTH_USER", "env-user")
+	t.Setenv(EnvPrefix+"AUTH_PASS", "env-pass")
+
+	cfg, err := parseArgs(t, "amd64")
+	if err != nil || cfg.AuthUser != "env-user" || cfg.AuthPass != "env-pass" {
+		t.Errorf("credentials should come from the environment: got %+v, %v", cfg.Credentials(), err)
+	}
+	cfg, err = parseArgs(t, "-auth-user", "flag-user", "amd64")
+	if err != nil || cfg.AuthUser != "flag-user" || cfg.AuthPass != "env-pass" {
+		t.Errorf("a flag should win over its variable: got %+v, %v", cfg.Credentials(), err)
+	}
+	if _, err := parseArgs(t, "-auth-token", "tok", "amd64"); err == nil {
+		t.Error("a token and basic auth are mutually exclusive")
+	}
+
+	// the -output-archive config must not carry the secrets
+	data, err := json.Marshal(&Config{AuthUser: "u", AuthPass: "hidden-pass", AuthToken: "hidden-token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "hidden-") {
+		t.Errorf("secrets in %s", data)
+	}
+}
@@ -0,0 +1,119 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"time"
+)
+
+// ParseTiming summarizes repeated parses of one contents file.
+type ParseTiming struct {
+	Runs        int           `json:"runs"`
+	Lines       int           `json:"lines"`
+	Min         time.Duration `json:"min_ns"`
+	Median      time.Duration `json:"median_ns"`
+	Max         time.Duration `json:"max_ns"`
+	LinesPerSec float64       `json:"lines_per_sec"`
+}
+
+/*
+RepeatParse parses the contents in data n times and reports the timings.
+
+only the parse path is measured (LineParser.Process and SortMap), the input is
+read and decompressed once up front so repeats never touch the disk or network
+*/
+func RepeatParse(ctx context.Context, data []byte, n int, parser LineParser) (ParseTiming, error) {
+	durations := make([]time.Duration, 0, n)
+	lines := 0
+	for i := 0; i < n; i++ {
+		if ctx.Err() != nil {
+			return ParseTiming{}, ctx.Err()
+		}
+		start := time.Now()
+		counts := make(map[string]int)
+		scanner := parser.scanner(bytes.NewReader(data))
+		lines = 0
+		for scanner.Scan() {
+			parser.Process(scanner.Text(), counts)
+			lines++
+		}
+		if err := scanner.Err(); err != nil {
+			return ParseTiming{}, err
+		}
+		_ = SortMap(counts)
+		durations = append(durations, time.Since(start))
+	}
+	if len(durations) == 0 {
+		return ParseTiming{}, fmt.Errorf("repeat count must be positive")
+	}
+
+	slices.Sort(durations)
+	t := ParseTiming{
+		Runs:   len(durations),
+		Lines:  lines,
+		Min:    durations[0],
+		Median: durations[len(durations)/2],
+		Max:    durations[len(durations)-1],
+	}
+	if t.Median > 0 {
+		t.LinesPerSec = float64(lines) / t.Median.Seconds()
+	}
+	return t, nil
+}
+
+// readContentsFile reads a local contents file, decompressing it when it has a gzip, xz or bzip2 magic
+func readContentsFile(file string) ([]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	for _, c := range compressionMagic {
+		if magic, _ := br.Peek(len(c.magic)); bytes.Equal(magic, c.magic) {
+			r, err := decompress(c.codec, br)
+			if err != nil {
+				return nil, err
+			}
+			defer r.Close()
+			return io.ReadAll(r)
+		}
+	}
+	return io.ReadAll(br)
+}
+
+// RunRepeat parses the local contents file in cfg.Args cfg.Repeat times and prints the timings
+func RunRepeat(ctx context.Context, w io.Writer, cfg *Config) error {
+	if len(cfg.Args) != 1 {
+		return fmt.Errorf("-repeat requires exactly one contents file")
+	}
+	data, err := readContentsFile(cfg.Args[0])
+	if err != nil {
+		return err
+	}
+	t, err := RepeatParse(ctx, data, cfg.Repeat, cfg.parser())
+	if err != nil {
+		return err
+	}
+	return PrintParseTiming(w, t, cfg.Format)
+}
+
+// PrintParseTiming displays the timings as text, or as JSON with -format json
+func PrintParseTiming(w io.Writer, t ParseTiming, format string) error {
+	if format == FormatJSON {
+		return writeJSON(w, t)
+	}
+	fmt.Fprintf(w, "%-20s %d\n", "Runs:", t.Runs)
+	fmt.Fprintf(w, "%-20s %d\n", "Lines:", t.Lines)
+	fmt.Fprintf(w, "%-20s %v\n", "Min:", t.Min)
+	fmt.Fprintf(w, "%-20s %v\n", "Median:", t.Median)
+	fmt.Fprintf(w, "%-20s %v\n", "Max:", t.Max)
+	fmt.Fprintf(w, "%-20s %.0f\n", "Lines/sec:", t.LinesPerSec)
+	return nil
+}
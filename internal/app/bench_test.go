@@ -0,0 +1,54 @@
+package app
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRepeatParse(t *testing.T) {
+	data := []byte(syntheticContents(50))
+
+	timing, err := RepeatParse(context.Background(), data, 5, LineParser{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timing.Runs != 5 {
+		t.Errorf("got %d runs, want 5", timing.Runs)
+	}
+	if want := strings.Count(string(data), "\n"); timing.Lines != want {
+		t.Errorf("got %d lines, want %d", timing.Lines, want)
+	}
+	if timing.Min <= 0 || timing.Min > timing.Median || timing.Median > timing.Max || timing.LinesPerSec <= 0 {
+		t.Errorf("inconsistent timings %+v", timing)
+	}
+
+	if _, err := RepeatParse(context.Background(), data, 0, LineParser{}); err == nil {
+		t.Error("expected error for zero repeats")
+	}
+}
+
+func TestRunRepeatGzipFile(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, _ = gz.Write([]byte(syntheticContents(10)))
+	gz.Close()
+	file := filepath.Join(t.TempDir(), "Contents-amd64.gz")
+	if err := os.WriteFile(file, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := RunRepeat(context.Background(), &out, &Config{Repeat: 3, Args: []string{file}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Runs:                3", "Lines:               55", "Median:", "Lines/sec:"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("missing %q in:\n%s", want, out.String())
+		}
+	}
+}
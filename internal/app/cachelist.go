@@ -0,0 +1,124 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/canonical-dev/package_statistics/internal/cache"
+)
+
+/*
+PrintCacheEntries writes one row per cache entry in cfg.CacheDir with its age at now
+and whether it is past the TTL of its architecture and suite (see ResolvedCacheTTL)
+output:
+
+	File                                Arch      Packages  Age        Status   URL
+	contents-amd64.json                 amd64     58210     2h0m0s     fresh    http://.../Contents-amd64.gz
+*/
+func PrintCacheEntries(w io.Writer, entries []CacheEntry, cfg *Config, now time.Time) {
+	fmt.Fprintf(w, "%-35s %-9s %-9s %-10s %-8s %s\n", "File", "Arch", "Packages", "Age", "Status", "URL")
+	for _, e := range entries {
+		age := now.Sub(e.Timestamp).Truncate(time.Second)
+		// relative to the cache dir so -cache-dir-per-suite caches show their <suite>/<component>
+		name, err := filepath.Rel(cfg.CacheDir, e.File)
+		if err != nil {
+			name = filepath.Base(e.File)
+		}
+		status := "fresh"
+		if age > cfg.cacheTTLFor(e.Architecture, entrySuite(e, name, cfg)) {
+			status = "expired"
+		}
+		fmt.Fprintf(w, "%-35s %-9s %-9d %-10s %-8s %s\n", name, e.Architecture, len(e.Stats), age, status, e.URL)
+	}
+}
+
+/*
+entrySuite returns the suite a cache entry was fetched for:
+the dists/<suite>/ segment of its URL, else the <suite>/<component>/ directories of its -cache-dir-per-suite path,
+else the configured suite
+*/
+func entrySuite(e CacheEntry, name string, cfg *Config) string {
+	if _, rest, ok := strings.Cut(e.URL, "/dists/"); ok {
+		if suite, _, ok := strings.Cut(rest, "/"); ok && suite != "" {
+			return suite
+		}
+	}
+	if parts := strings.Split(filepath.ToSlash(name), "/"); len(parts) == 3 {
+		return parts[0]
+	}
+	return cfg.ResolvedSuite()
+}
+
+// RunListCache prints the caches in cfg.CacheDir, corrupt ones are skipped with a warning through logger
+func RunListCache(w io.Writer, cfg *Config, logger Logger) {
+	entries, err := cache.ListEntries(cfg.CacheDir)
+	if err != nil {
+		logAt(logger, slog.LevelWarn, nil, "Skipped unreadable caches: %v", err)
+	}
+	if len(entries) == 0 {
+		fmt.Fprintf(w, "No caches in %s\n", cfg.CacheDir)
+		return
+	}
+	PrintCacheEntries(w, entries, cfg, time.Now())
+}
+
+// ErrNoCache is returned by RunInfo when the architecture has no cache yet.
+var ErrNoCache = errors.New("no cache")
+
+/*
+PrintCacheInfo writes the metadata of a cache entry at now, whether it is past ttl, without its stats
+output:
+
+	File:          /home/u/.cache/package-statistics/contents-amd64.json
+	Architecture:  amd64
+	URL:           http://.../Contents-amd64.gz
+	Fetched:       2024-01-02T13:00:00Z (2h0m0s ago, fresh)
+	ETag:          "68bbfd64-bf91e3"
+	Last-Modified: Sat, 06 Sep 2025 09:22:44 GMT
+	Packages:      58210
+*/
+func PrintCacheInfo(w io.Writer, e *CacheEntry, ttl time.Duration, now time.Time) {
+	age := now.Sub(e.Timestamp).Truncate(time.Second)
+	status := "fresh"
+	if age > ttl {
+		status = "expired"
+	}
+	orNone := func(s string) string {
+		if s == "" {
+			return "(none)"
+		}
+		return s
+	}
+	fmt.Fprintf(w, "%-14s %s\n", "File:", e.File)
+	fmt.Fprintf(w, "%-14s %s\n", "Architecture:", e.Architecture)
+	fmt.Fprintf(w, "%-14s %s\n", "URL:", e.URL)
+	fmt.Fprintf(w, "%-14s %s (%s ago, %s)\n", "Fetched:", FormatTimestamp(e.Timestamp), age, status)
+	fmt.Fprintf(w, "%-14s %s\n", "ETag:", orNone(e.ETag))
+	fmt.Fprintf(w, "%-14s %s\n", "Last-Modified:", orNone(e.LastModified))
+	fmt.Fprintf(w, "%-14s %d\n", "Packages:", len(e.Stats))
+}
+
+// RunInfo prints the metadata of the configured architecture's cache without any network call,
+// whatever its age, and returns an error wrapping ErrNoCache when there is none
+func RunInfo(w io.Writer, cfg *Config) error {
+	a := &App{cfg: cfg}
+	file := a.CacheFile()
+	entry, err := cache.ReadEntry(file)
+	if errors.Is(err, fs.ErrNotExist) && cfg.CompressCache {
+		// a cache written before -compress-cache
+		entry, err = cache.ReadEntry(strings.TrimSuffix(file, cache.CompressedExt))
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w for %s at %s", ErrNoCache, cfg.Architecture, file)
+	} else if err != nil {
+		return err
+	}
+	PrintCacheInfo(w, entry, cfg.ResolvedCacheTTL(), time.Now())
+	return nil
+}
@@ -0,0 +1,130 @@
+package app
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/canonical-dev/package_statistics/internal/cache"
+)
+
+func TestPrintCacheEntries(t *testing.T) {
+	now := time.Date(2024, 1, 2, 15, 0, 0, 0, time.UTC)
+	entries := []CacheEntry{
+		{File: "/c/contents-amd64.json", Architecture: "amd64", Stats: make([]PackageStats, 3), Timestamp: now.Add(-2 * time.Hour), URL: "http://m/Contents-amd64.gz"},
+		{File: "/c/contents-arm64.json", Architecture: "arm64", Stats: make([]PackageStats, 1), Timestamp: now.Add(-48 * time.Hour), URL: "http://m/Contents-arm64.gz"},
+	}
+
+	var buf bytes.Buffer
+	PrintCacheEntries(&buf, entries, &Config{CacheDir: "/c", CacheTTL: 24 * time.Hour}, now)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %q", buf.String())
+	}
+	if f := strings.Fields(lines[1]); strings.Join(f, " ") != "contents-amd64.json amd64 3 2h0m0s fresh http://m/Contents-amd64.gz" {
+		t.Errorf("got %q", lines[1])
+	}
+	if f := strings.Fields(lines[2]); f[4] != "expired" {
+		t.Errorf("got %q", lines[2])
+	}
+}
+
+func TestPrintCacheEntriesTTLOverrides(t *testing.T) {
+	now := time.Date(2024, 1, 2, 15, 0, 0, 0, time.UTC)
+	twoHours := now.Add(-2 * time.Hour)
+	entries := []CacheEntry{
+		{File: "/c/contents-amd64.json", Architecture: "amd64", Timestamp: twoHours, URL: "http://m/debian/dists/stable/main/Contents-amd64.gz"},
+		{File: "/c/contents-unstable-amd64.json", Architecture: "amd64", Timestamp: twoHours, URL: "http://m/debian/dists/unstable/main/Contents-amd64.gz"},
+		{File: "/c/unstable/main/contents-arm64.json", Architecture: "arm64", Timestamp: twoHours, URL: "http://m/Contents-arm64.gz"},
+		{File: "/c/contents-i386.json", Architecture: "i386", Timestamp: twoHours, URL: "http://m/debian/dists/stable/main/Contents-i386.gz"},
+	}
+	cfg, err := parseArgs(t, "-cache-dir", "/c", "-cache-ttl", "24h", "-cache-ttl", "unstable=1h", "-cache-ttl", "i386=30m", "amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	PrintCacheEntries(&buf, entries, cfg, now)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")[1:]
+	for i, want := range []string{"fresh", "expired", "expired", "expired"} {
+		if f := strings.Fields(lines[i]); f[4] != want {
+			t.Errorf("%s: got %q, want %s", entries[i].File, lines[i], want)
+		}
+	}
+}
+
+func TestRunListCacheSkipsCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	entry := &CacheEntry{Architecture: "amd64", Stats: []PackageStats{{Name: "pkg", FileCount: 1}}, Timestamp: time.Now()}
+	if err := cache.SaveCache(filepath.Join(dir, "contents-amd64.json"), entry); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "contents-i386.json"), []byte("not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out, logs bytes.Buffer
+	RunListCache(&out, &Config{CacheDir: dir, CacheTTL: time.Hour}, log.New(&logs, "", 0))
+	if !strings.Contains(out.String(), "contents-amd64.json") || strings.Contains(out.String(), "i386") {
+		t.Errorf("got %q", out.String())
+	}
+	if !strings.Contains(logs.String(), "contents-i386.json") {
+		t.Errorf("corrupt cache should be warned about, got %q", logs.String())
+	}
+
+	out.Reset()
+	RunListCache(&out, &Config{CacheDir: t.TempDir()}, log.New(io.Discard, "", 0))
+	if !strings.HasPrefix(out.String(), "No caches in ") {
+		t.Errorf("got %q", out.String())
+	}
+}
+
+func TestRunInfo(t *testing.T) {
+	dir := t.TempDir()
+	cfg, err := parseArgs(t, "-info", "-cache-dir", dir, "-cache-ttl", "1h", "amd64")
+	if err != nil || cfg.Command != CommandInfo {
+		t.Fatalf("got %+v, %v", cfg, err)
+	}
+
+	var out bytes.Buffer
+	if err := RunInfo(&out, cfg); !errors.Is(err, ErrNoCache) || out.Len() != 0 {
+		t.Errorf("got %v, %q", err, out.String())
+	}
+
+	// expired caches are shown too
+	entry := &CacheEntry{
+		Architecture: "amd64",
+		Stats:        make([]PackageStats, 3),
+		Timestamp:    time.Now().Add(-48 * time.Hour),
+		URL:          "http://m/Contents-amd64.gz",
+		ETag:         `"v1"`,
+	}
+	if err := cache.SaveCache(filepath.Join(dir, "contents-amd64.json"), entry); err != nil {
+		t.Fatal(err)
+	}
+	if err := RunInfo(&out, cfg); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"File:          " + filepath.Join(dir, "contents-amd64.json") + "\n",
+		"URL:           http://m/Contents-amd64.gz\n",
+		"ago, expired)\n",
+		`ETag:          "v1"` + "\n",
+		"Last-Modified: (none)\n",
+		"Packages:      3\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("missing %q in:\n%s", want, out.String())
+		}
+	}
+
+	if _, err := parseArgs(t, "-info", "amd64", "arm64"); err == nil {
+		t.Error("-info with several architectures should fail")
+	}
+}
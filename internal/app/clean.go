@@ -0,0 +1,85 @@
+package app
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/canonical-dev/package_statistics/internal/cache"
+)
+
+// Cleaner transforms a single package name.
+type Cleaner func(string) string
+
+// CleanPipeline is an ordered list of cleaning steps.
+type CleanPipeline []Cleaner
+
+// cleanSteps maps --clean step names to their implementation
+var cleanSteps = map[string]Cleaner{
+	// tabs: "devel/\tpiglit" -> "devel/ piglit" (Contents-source.gz uses tabs)
+	"tabs": func(name string) string { return strings.ReplaceAll(name, "\t", " ") },
+	// trim: "  piglit " -> "piglit"
+	"trim": strings.TrimSpace,
+	// section: "devel/piglit" -> "piglit"
+	"section": func(name string) string { return name[strings.LastIndex(name, "/")+1:] },
+	// lower: "Piglit" -> "piglit"
+	"lower": strings.ToLower,
+	// arch: "piglit:amd64" -> "piglit"
+	"arch": func(name string) string {
+		if idx := strings.LastIndex(name, ":"); idx != -1 {
+			return name[:idx]
+		}
+		return name
+	},
+}
+
+// ParseCleanSteps builds a pipeline from a comma separated list like "tabs,trim,section,lower"
+func ParseCleanSteps(spec string) (CleanPipeline, error) {
+	var p CleanPipeline
+	for _, step := range strings.Split(spec, ",") {
+		step = strings.TrimSpace(step)
+		if step == "" {
+			continue
+		}
+		fn, ok := cleanSteps[step]
+		if !ok {
+			return nil, fmt.Errorf("unknown clean step %q (valid: %s)", step, strings.Join(cleanStepNames(), ", "))
+		}
+		p = append(p, fn)
+	}
+	return p, nil
+}
+
+// Apply runs every step over name in order
+func (p CleanPipeline) Apply(name string) string {
+	for _, fn := range p {
+		name = fn(name)
+	}
+	return name
+}
+
+/*
+CleanStats applies the pipeline to every package name and re-aggregates
+input: [{devel/foo 3} {libs/foo 2} {bar 1}] with "section"
+output: [{foo 5} {bar 1}]
+*/
+func CleanStats(stats []cache.PackageStats, p CleanPipeline) []cache.PackageStats {
+	if len(p) == 0 {
+		return stats
+	}
+	counts := make(map[string]int, len(stats))
+	for _, s := range stats {
+		counts[p.Apply(s.Name)] += s.FileCount
+	}
+	return SortMap(counts)
+}
+
+// cleanStepNames returns the sorted names of the available clean steps
+func cleanStepNames() []string {
+	names := make([]string, 0, len(cleanSteps))
+	for name := range cleanSteps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
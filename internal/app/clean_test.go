@@ -0,0 +1,59 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/canonical-dev/package_statistics/internal/cache"
+)
+
+func TestCleanSteps(t *testing.T) {
+	tests := []struct {
+		spec string
+		in   string
+		want string
+	}{
+		{"tabs", "devel/\tpiglit", "devel/ piglit"},
+		{"trim", "  piglit ", "piglit"},
+		{"section", "devel/piglit", "piglit"},
+		{"section", "piglit", "piglit"},
+		{"section", "non-free/devel/piglit", "piglit"},
+		{"lower", "PigLit", "piglit"},
+		{"arch", "piglit:amd64", "piglit"},
+		{"arch", "piglit", "piglit"},
+		{"tabs,trim", "\tpiglit\t", "piglit"},
+		{"trim,section,lower", " Devel/PigLit ", "piglit"},
+		{"section,arch,lower", "libs/LibFoo:arm64", "libfoo"},
+		{"", "devel/piglit", "devel/piglit"},
+	}
+
+	for _, tt := range tests {
+		p, err := ParseCleanSteps(tt.spec)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.spec, err)
+		}
+		if got := p.Apply(tt.in); got != tt.want {
+			t.Errorf("%q on %q: got %q, want %q", tt.spec, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseCleanStepsUnknown(t *testing.T) {
+	if _, err := ParseCleanSteps("trim,bogus"); err == nil {
+		t.Fatal("should fail on unknown step")
+	}
+}
+
+func TestCleanStatsAggregates(t *testing.T) {
+	stats := []cache.PackageStats{
+		{Name: "devel/foo", FileCount: 3},
+		{Name: "libs/Foo", FileCount: 2},
+		{Name: "bar", FileCount: 4},
+	}
+	p, _ := ParseCleanSteps("section,lower")
+
+	got := CleanStats(stats, p)
+
+	if len(got) != 2 || got[0] != (cache.PackageStats{Name: "foo", FileCount: 5}) {
+		t.Errorf("got %+v", got)
+	}
+}
@@ -0,0 +1,14 @@
+package app
+
+import "time"
+
+// Clock tells the App the current time, see WithClock.
+type Clock interface {
+	Now() time.Time
+}
+
+// realClock reads the system clock, the default of NewApp
+type realClock struct{}
+
+// Now implements Clock
+func (realClock) Now() time.Time { return time.Now() }
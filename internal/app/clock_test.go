@@ -0,0 +1,104 @@
+package app
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that only moves when Advance is called
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// newClockedApp returns an App on clock whose requests go to a recordingTransport, with its cache already saved
+func newClockedApp(t *testing.T, clock Clock, cfg *Config) (*App, *recordingTransport) {
+	t.Helper()
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	fmt.Fprintln(gz, "usr/bin/file1 pkg1")
+	gz.Close()
+
+	rt := &recordingTransport{body: body.Bytes()}
+	cfg.Architecture, cfg.CacheDir, cfg.NoProgress = "amd64", t.TempDir(), true
+	app := NewApp(cfg, WithLogger(log.New(io.Discard, "", 0)), WithHTTPClient(&http.Client{Transport: rt}), WithClock(clock))
+	if _, err := app.Analyze(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	rt.requests = nil
+	return app, rt
+}
+
+func TestShortCacheWindowBoundary(t *testing.T) {
+	clock := newFakeClock(time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC))
+	app, rt := newClockedApp(t, clock, &Config{CacheTTL: time.Hour, ShortCacheWindow: 5 * time.Minute})
+
+	// just inside the window the cache is used without any request, at the window the HEAD is sent
+	for _, tt := range []struct {
+		advance  time.Duration
+		requests int
+	}{
+		{5*time.Minute - time.Nanosecond, 0},
+		{time.Nanosecond, 1},
+	} {
+		clock.Advance(tt.advance)
+		rt.requests = nil
+		res, err := app.Analyze(context.Background())
+		if err != nil || !res.FromCache || len(rt.requests) != tt.requests {
+			t.Errorf("at %v: got requests %v, from cache %v, %v", clock.Now(), rt.requests, res.FromCache, err)
+		}
+	}
+}
+
+func TestCacheTTLBoundary(t *testing.T) {
+	start := time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		age       time.Duration
+		requests  []string
+		fromCache bool
+	}{
+		// a cache exactly ttl old is still valid: the HEAD finds it unchanged
+		{time.Hour, []string{"HEAD"}, true},
+		{time.Hour + time.Nanosecond, []string{"HEAD", "GET"}, false},
+	} {
+		clock := newFakeClock(start)
+		app, rt := newClockedApp(t, clock, &Config{CacheTTL: time.Hour})
+		clock.Advance(tt.age)
+
+		res, err := app.Analyze(context.Background())
+		if err != nil || res.FromCache != tt.fromCache || len(rt.requests) != len(tt.requests) {
+			t.Fatalf("age %v: got requests %v, from cache %v, %v", tt.age, rt.requests, res.FromCache, err)
+		}
+		for i, method := range tt.requests {
+			if !strings.HasPrefix(rt.requests[i], method+" ") {
+				t.Errorf("age %v: got requests %v, want %v", tt.age, rt.requests, tt.requests)
+			}
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// DefaultConfigFile is read when -config is not set, a missing file is ignored.
+const DefaultConfigFile = "~/.config/package_statistics/config.toml"
+
+/*
+FileConfig holds the defaults read from a TOML config file, keys left out keep the built-in defaults.
+
+	cache_dir = "~/.cache/package_statistics"
+	cache_ttl = "12h"
+	mirror    = "https://deb.debian.org/debian"
+	suite     = "testing"
+	top       = 20
+
+	[profile.weekly]
+	format = "markdown"
+	top    = 25
+
+The same settings (without the profiles) can come from PKGSTATS_* environment variables, see LoadEnv.
+Precedence, highest first: command line flags, -profile, environment variables, the config file, the built-in defaults.
+*/
+type FileConfig struct {
+	CacheDir *string `toml:"cache_dir"`
+	CacheTTL *string `toml:"cache_ttl"`
+	Mirror   *string `toml:"mirror"`
+	Suite    *string `toml:"suite"`
+	Top      *int    `toml:"top"`
+	// Profiles adds -profile bundles, keyed by name, see FileProfile
+	Profiles map[string]FileProfile `toml:"profile"`
+}
+
+// FileProfile is a [profile.<name>] table of the config file, keys left out keep the built-in defaults.
+type FileProfile struct {
+	Format      *string `toml:"format"`
+	Top         *int    `toml:"top"`
+	Sort        *string `toml:"sort"`
+	SummaryOnly *bool   `toml:"summary_only"`
+	NoProgress  *bool   `toml:"no_progress"`
+}
+
+// profiles converts the [profile.<name>] tables to Profiles, the values are validated with the flags they set
+func (fc *FileConfig) profiles() (map[string]Profile, error) {
+	profiles := make(map[string]Profile, len(fc.Profiles))
+	for name, fp := range fc.Profiles {
+		if strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("config file: empty profile name")
+		}
+		p := Profile{Format: FormatText, TopCount: 10, Sort: SortCount}
+		if fp.Format != nil {
+			p.Format = strings.TrimSpace(*fp.Format)
+		}
+		if fp.Top != nil {
+			p.TopCount = *fp.Top
+		}
+		if fp.Sort != nil {
+			p.Sort = strings.TrimSpace(*fp.Sort)
+		}
+		if fp.SummaryOnly != nil {
+			p.SummaryOnly = *fp.SummaryOnly
+		}
+		if fp.NoProgress != nil {
+			p.NoProgress = *fp.NoProgress
+		}
+		profiles[name] = p
+	}
+	return profiles, nil
+}
+
+/*
+LoadConfigFile reads the TOML config file at path (~ is expanded).
+
+A missing file is only an error when required, i.e. the path came from -config.
+Unknown keys are rejected so a typo doesn't silently fall back to a default.
+*/
+func LoadConfigFile(path string, required bool) (*FileConfig, error) {
+	file, err := expandPath(path)
+	if err != nil {
+		return nil, err
+	}
+	var fc FileConfig
+	md, err := toml.DecodeFile(file, &fc)
+	if errors.Is(err, fs.ErrNotExist) && !required {
+		return &fc, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("config file %s: %w", file, err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, len(undecoded))
+		for i, k := range undecoded {
+			keys[i] = k.String()
+		}
+		slices.Sort(keys)
+		return nil, fmt.Errorf("config file %s: unknown keys %s", file, strings.Join(keys, ", "))
+	}
+	return &fc, nil
+}
+
+// EnvPrefix starts the name of every environment variable read by LoadEnv.
+const EnvPrefix = "PKGSTATS_"
+
+/*
+LoadEnv reads the FileConfig settings from the environment, unset or empty variables are left out:
+
+	PKGSTATS_CACHE_DIR, PKGSTATS_CACHE_TTL, PKGSTATS_MIRROR, PKGSTATS_SUITE, PKGSTATS_TOP
+*/
+func LoadEnv() (*FileConfig, error) {
+	var fc FileConfig
+	lookup := func(name string) *string {
+		if v := strings.TrimSpace(os.Getenv(EnvPrefix + name)); v != "" {
+			return &v
+		}
+		return nil
+	}
+	fc.CacheDir = lookup("CACHE_DIR")
+	fc.Mirror = lookup("MIRROR")
+	fc.Suite = lookup("SUITE")
+	if fc.CacheTTL = lookup("CACHE_TTL"); fc.CacheTTL != nil {
+		if ttl, err := time.ParseDuration(*fc.CacheTTL); err != nil || ttl < 0 {
+			return nil, fmt.Errorf("invalid %sCACHE_TTL %q (want a duration such as 12h)", EnvPrefix, *fc.CacheTTL)
+		}
+	}
+	if top := lookup("TOP"); top != nil {
+		n, err := strconv.Atoi(*top)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %sTOP %q", EnvPrefix, *top)
+		}
+		fc.Top = &n
+	}
+	return &fc, nil
+}
+
+// applyConfigFile copies the file (or environment) settings into cfg, skipping the settings given explicitly on the command line
+// explicit holds the names of the flags that were set
+func applyConfigFile(cfg *Config, fc *FileConfig, explicit map[string]bool) error {
+	if fc.CacheDir != nil && !explicit["cache-dir"] {
+		dir, err := expandPath(*fc.CacheDir)
+		if err != nil {
+			return fmt.Errorf("invalid cache_dir: %w", err)
+		}
+		cfg.CacheDir = dir
+	}
+	if fc.CacheTTL != nil && !explicit["cache-ttl"] {
+		ttl, err := time.ParseDuration(*fc.CacheTTL)
+		if err != nil || ttl < 0 {
+			return fmt.Errorf("invalid cache_ttl %q (want a duration such as 12h)", *fc.CacheTTL)
+		}
+		cfg.CacheTTL = ttl
+	}
+	if fc.Mirror != nil && !explicit["mirror"] {
+		cfg.Mirror = strings.TrimSpace(*fc.Mirror)
+	}
+	if fc.Suite != nil && !explicit["suite"] {
+		cfg.Suite = strings.TrimSpace(*fc.Suite)
+	}
+	if fc.Top != nil && !explicit["top"] {
+		cfg.TopCount = *fc.Top
+	}
+	return nil
+}
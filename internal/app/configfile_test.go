@@ -0,0 +1,143 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes a config file to a temp dir and returns its path
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestConfigFileDefaults(t *testing.T) {
+	file := writeConfig(t, `
+cache_dir = "/var/cache/pkgstats"
+cache_ttl = "12h"
+mirror = "https://mirror.internal/debian"
+suite = "testing"
+top = 25
+`)
+	cfg, err := parseArgs(t, "-config", file, "amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.CacheDir != "/var/cache/pkgstats" || cfg.CacheTTL != 12*time.Hour || cfg.Mirror != "https://mirror.internal/debian" ||
+		cfg.Suite != "testing" || cfg.TopCount != 25 {
+		t.Errorf("got %+v", cfg)
+	}
+}
+
+func TestConfigFileFlagsTakePrecedence(t *testing.T) {
+	file := writeConfig(t, "cache_ttl = \"12h\"\nsuite = \"testing\"\ntop = 25\n")
+
+	cfg, err := parseArgs(t, "-config", file, "-suite", "unstable", "-top", "5", "-cache-ttl", "1h", "amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Suite != "unstable" || cfg.TopCount != 5 || cfg.CacheTTL != time.Hour {
+		t.Errorf("flags should win, got %+v", cfg)
+	}
+
+	// an override alone doesn't replace the file's default TTL
+	cfg, err = parseArgs(t, "-config", file, "-cache-ttl", "arm64=1h", "amd64")
+	if err != nil || cfg.CacheTTL != 12*time.Hour || cfg.CacheTTLOverrides["arm64"] != time.Hour {
+		t.Errorf("got %+v, %v", cfg, err)
+	}
+
+	// a profile is given on the command line, so it wins over the file too
+	cfg, err = parseArgs(t, "-config", file, "-profile", "ci-json", "amd64")
+	if err != nil || cfg.TopCount != Profiles["ci-json"].TopCount || cfg.Suite != "testing" {
+		t.Errorf("got %+v, %v", cfg, err)
+	}
+}
+
+func TestConfigFileErrors(t *testing.T) {
+	for _, tt := range []struct {
+		content, want string
+	}{
+		{"suit = \"testing\"\n", "unknown keys suit"},
+		{"cache_ttl = \"soon\"\n", "invalid cache_ttl"},
+		{"top = \"many\"\n", "config file"},
+		{"suite = \"bogus\"\n", "invalid -suite"},
+	} {
+		_, err := parseArgs(t, "-config", writeConfig(t, tt.content), "amd64")
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: got %v, want %q", tt.content, err, tt.want)
+		}
+	}
+
+	if _, err := parseArgs(t, "-config", filepath.Join(t.TempDir(), "missing.toml"), "amd64"); err == nil {
+		t.Error("a missing -config file should fail")
+	}
+}
+
+func TestDefaultConfigFile(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	// missing is fine
+	cfg, err := parseArgs(t, "amd64")
+	if err != nil || cfg.TopCount != 10 {
+		t.Fatalf("got %+v, %v", cfg, err)
+	}
+
+	file := filepath.Join(home, strings.TrimPrefix(DefaultConfigFile, "~/"))
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte("top = 3\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = parseArgs(t, "amd64")
+	if err != nil || cfg.TopCount != 3 {
+		t.Errorf("got %+v, %v", cfg, err)
+	}
+}
+
+func TestEnvDefaults(t *testing.T) {
+	// t.Setenv restores the previous values when the test ends
+	t.Setenv("PKGSTATS_CACHE_DIR", "/srv/cache")
+	t.Setenv("PKGSTATS_CACHE_TTL", "2h")
+	t.Setenv("PKGSTATS_MIRROR", "https://mirror.internal/debian")
+	t.Setenv("PKGSTATS_SUITE", "testing")
+	t.Setenv("PKGSTATS_TOP", "7")
+
+	cfg, err := parseArgs(t, "amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.CacheDir != "/srv/cache" || cfg.CacheTTL != 2*time.Hour || cfg.Mirror != "https://mirror.internal/debian" ||
+		cfg.Suite != "testing" || cfg.TopCount != 7 {
+		t.Errorf("got %+v", cfg)
+	}
+
+	// flags win over the environment, which wins over the config file
+	file := writeConfig(t, "suite = \"unstable\"\ntop = 25\ncache_ttl = \"12h\"\n")
+	cfg, err = parseArgs(t, "-config", file, "-top", "3", "-cache-dir", "/tmp/flag", "amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.TopCount != 3 || cfg.CacheDir != "/tmp/flag" || cfg.Suite != "testing" || cfg.CacheTTL != 2*time.Hour {
+		t.Errorf("got %+v", cfg)
+	}
+}
+
+func TestEnvInvalid(t *testing.T) {
+	for name, value := range map[string]string{"PKGSTATS_TOP": "many", "PKGSTATS_CACHE_TTL": "soon", "PKGSTATS_SUITE": "bogus"} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			if _, err := parseArgs(t, "amd64"); err == nil {
+				t.Errorf("%s=%s should fail", name, value)
+			}
+		})
+	}
+}
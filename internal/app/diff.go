@@ -0,0 +1,248 @@
+package app
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/canonical-dev/package_statistics/internal/cache"
+)
+
+// Diff statuses
+const (
+	DiffAdded   = "added"
+	DiffRemoved = "removed"
+	DiffChanged = "changed"
+)
+
+// PackageDiff describes how a package's file count changed between two result sets.
+type PackageDiff struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Old    int    `json:"old"`
+	New    int    `json:"new"`
+	Delta  int    `json:"delta"`
+}
+
+// Diff sort orders for -diff-sort
+const (
+	DiffSortDelta   = "delta"
+	DiffSortPercent = "percent"
+)
+
+/*
+PercentDelta returns Delta relative to Old in percent
+ok is false for added packages (Old == 0), which are shown as "new"
+*/
+func (d PackageDiff) PercentDelta() (pct float64, ok bool) {
+	if d.Old == 0 {
+		return 0, false
+	}
+	return float64(d.Delta) / float64(d.Old) * 100, true
+}
+
+// formatPercentDelta renders the percent change as "+12.5%", or "new" for added packages
+func (d PackageDiff) formatPercentDelta() string {
+	pct, ok := d.PercentDelta()
+	if !ok {
+		return "new"
+	}
+	return fmt.Sprintf("%+.1f%%", pct)
+}
+
+/*
+SortDiffs orders diff rows by absolute delta (DiffSortDelta) or absolute percent change
+(DiffSortPercent, added packages first as their change is unbounded), then by name
+*/
+func SortDiffs(diffs []PackageDiff, by string) {
+	key := func(d PackageDiff) float64 {
+		if by != DiffSortPercent {
+			return float64(abs(d.Delta))
+		}
+		pct, ok := d.PercentDelta()
+		if !ok {
+			return math.Inf(1)
+		}
+		return math.Abs(pct)
+	}
+	sort.Slice(diffs, func(i, j int) bool {
+		if ki, kj := key(diffs[i]), key(diffs[j]); ki != kj {
+			return ki > kj
+		}
+		return diffs[i].Name < diffs[j].Name
+	})
+}
+
+/*
+DiffStats compares two result sets
+before: [{pkg1 10} {pkg2 5}]  after: [{pkg1 12} {pkg3 1}]
+output: [{pkg2 removed 5 0 -5} {pkg1 changed 10 12 2} {pkg3 added 0 1 1}]
+
+Rows whose absolute delta is below threshold are dropped.
+Sorted by absolute delta descending, then by name.
+*/
+func DiffStats(before, after []cache.PackageStats, threshold int) []PackageDiff {
+	beforeCounts := make(map[string]int, len(before))
+	for _, s := range before {
+		beforeCounts[s.Name] += s.FileCount
+	}
+	afterCounts := make(map[string]int, len(after))
+	for _, s := range after {
+		afterCounts[s.Name] += s.FileCount
+	}
+
+	var diffs []PackageDiff
+	for name, o := range beforeCounts {
+		n, ok := afterCounts[name]
+		switch {
+		case !ok:
+			diffs = append(diffs, PackageDiff{Name: name, Status: DiffRemoved, Old: o, Delta: -o})
+		case n != o:
+			diffs = append(diffs, PackageDiff{Name: name, Status: DiffChanged, Old: o, New: n, Delta: n - o})
+		}
+	}
+	for name, n := range afterCounts {
+		if _, ok := beforeCounts[name]; !ok {
+			diffs = append(diffs, PackageDiff{Name: name, Status: DiffAdded, New: n, Delta: n})
+		}
+	}
+
+	filtered := diffs[:0]
+	for _, d := range diffs {
+		if abs(d.Delta) >= threshold {
+			filtered = append(filtered, d)
+		}
+	}
+
+	SortDiffs(filtered, DiffSortDelta)
+	return filtered
+}
+
+// percentDiff is a diff row with its percent change for json output (null for added packages)
+type percentDiff struct {
+	PackageDiff
+	PercentDelta *float64 `json:"percent_delta"`
+}
+
+// PrintDiff writes diff rows to w in cfg.Format (text adds a per-status summary)
+// cfg.ShowPercentDelta adds the percent change as an extra column
+func PrintDiff(w io.Writer, diffs []PackageDiff, cfg *Config) error {
+	switch cfg.Format {
+	case FormatJSON:
+		if !cfg.ShowPercentDelta {
+			if diffs == nil {
+				diffs = []PackageDiff{}
+			}
+			return writeJSON(w, diffs)
+		}
+		rows := make([]percentDiff, 0, len(diffs))
+		for _, d := range diffs {
+			row := percentDiff{PackageDiff: d}
+			if pct, ok := d.PercentDelta(); ok {
+				row.PercentDelta = &pct
+			}
+			rows = append(rows, row)
+		}
+		return writeJSON(w, rows)
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		header := []string{"status", "name", "old", "new", "delta"}
+		if cfg.ShowPercentDelta {
+			header = append(header, "percent_delta")
+		}
+		_ = cw.Write(header)
+		for _, d := range diffs {
+			row := []string{d.Status, d.Name, strconv.Itoa(d.Old), strconv.Itoa(d.New), strconv.Itoa(d.Delta)}
+			if cfg.ShowPercentDelta {
+				row = append(row, d.formatPercentDelta())
+			}
+			_ = cw.Write(row)
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+
+	if len(diffs) == 0 {
+		fmt.Fprintln(w, "No differences")
+		return nil
+	}
+
+	if cfg.ShowPercentDelta {
+		fmt.Fprintf(w, "%-8s %-40s %10s %10s %10s %10s\n", "Status", "Package Name", "Old", "New", "Delta", "Delta%")
+		fmt.Fprintln(w, strings.Repeat("-", 93))
+	} else {
+		fmt.Fprintf(w, "%-8s %-40s %10s %10s %10s\n", "Status", "Package Name", "Old", "New", "Delta")
+		fmt.Fprintln(w, strings.Repeat("-", 82))
+	}
+
+	counts := make(map[string]int)
+	for _, d := range diffs {
+		counts[d.Status]++
+		fmt.Fprintf(w, "%-8s %-40s %10d %10d %+10d", d.Status, strings.TrimSpace(d.Name), d.Old, d.New, d.Delta)
+		if cfg.ShowPercentDelta {
+			fmt.Fprintf(w, " %10s", d.formatPercentDelta())
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "\n%d added, %d removed, %d changed\n", counts[DiffAdded], counts[DiffRemoved], counts[DiffChanged])
+	return nil
+}
+
+// LoadResults reads package stats from an exported results file
+// accepts either a JSON array of {"name", "file_count"} rows or a cache entry with "stats"
+func LoadResults(file string) ([]cache.PackageStats, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	data = bytes.TrimSpace(data)
+	if bytes.HasPrefix(data, []byte("[")) {
+		var stats []cache.PackageStats
+		if err := json.Unmarshal(data, &stats); err != nil {
+			return nil, fmt.Errorf("invalid results file %s: %w", file, err)
+		}
+		return stats, nil
+	}
+
+	var entry cache.CacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("invalid results file %s: %w", file, err)
+	}
+	return entry.Stats, nil
+}
+
+// RunDiffFiles loads the two result files in cfg.Args and writes their differences to w
+func RunDiffFiles(w io.Writer, cfg *Config) error {
+	if len(cfg.Args) != 2 {
+		return fmt.Errorf("%s requires exactly two result files", CommandDiffFiles)
+	}
+	before, err := LoadResults(cfg.Args[0])
+	if err != nil {
+		return err
+	}
+	after, err := LoadResults(cfg.Args[1])
+	if err != nil {
+		return err
+	}
+	diffs := DiffStats(before, after, cfg.DeltaThreshold)
+	if cfg.DiffSort == DiffSortPercent {
+		SortDiffs(diffs, DiffSortPercent)
+	}
+	return PrintDiff(w, diffs, cfg)
+}
+
+// abs returns the absolute value of n
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,169 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/canonical-dev/package_statistics/internal/cache"
+)
+
+func TestDiffStats(t *testing.T) {
+	before := []cache.PackageStats{{Name: "pkg1", FileCount: 10}, {Name: "pkg2", FileCount: 5}, {Name: "same", FileCount: 3}}
+	after := []cache.PackageStats{{Name: "pkg1", FileCount: 12}, {Name: "pkg3", FileCount: 1}, {Name: "same", FileCount: 3}}
+
+	diffs := DiffStats(before, after, 0)
+
+	want := []PackageDiff{
+		{Name: "pkg2", Status: DiffRemoved, Old: 5, Delta: -5},
+		{Name: "pkg1", Status: DiffChanged, Old: 10, New: 12, Delta: 2},
+		{Name: "pkg3", Status: DiffAdded, New: 1, Delta: 1},
+	}
+	if len(diffs) != len(want) {
+		t.Fatalf("got %+v", diffs)
+	}
+	for i := range want {
+		if diffs[i] != want[i] {
+			t.Errorf("row %d: got %+v, want %+v", i, diffs[i], want[i])
+		}
+	}
+}
+
+func TestDiffStatsThreshold(t *testing.T) {
+	before := []cache.PackageStats{{Name: "pkg1", FileCount: 10}, {Name: "pkg2", FileCount: 5}}
+	after := []cache.PackageStats{{Name: "pkg1", FileCount: 11}, {Name: "pkg2", FileCount: 50}}
+
+	diffs := DiffStats(before, after, 5)
+
+	if len(diffs) != 1 || diffs[0].Name != "pkg2" {
+		t.Errorf("got %+v", diffs)
+	}
+}
+
+func TestRunDiffFilesIdentical(t *testing.T) {
+	dir := t.TempDir()
+	entry := &cache.CacheEntry{
+		Architecture: "amd64",
+		Stats:        []cache.PackageStats{{Name: "pkg1", FileCount: 10}},
+		Timestamp:    time.Now().UTC(),
+	}
+	a := filepath.Join(dir, "a.json")
+	b := filepath.Join(dir, "b.json")
+	_ = cache.SaveCache(a, entry)
+	_ = cache.SaveCache(b, entry)
+
+	var buf bytes.Buffer
+	err := RunDiffFiles(&buf, &Config{Args: []string{a, b}})
+	output := buf.String()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(output) != "No differences" {
+		t.Errorf("got %q", output)
+	}
+}
+
+func TestRunDiffFilesWithDifferences(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.json")
+	b := filepath.Join(dir, "b.json")
+	_ = os.WriteFile(a, []byte(`[{"name":"pkg1","file_count":10},{"name":"gone","file_count":4},{"name":"same","file_count":1}]`), 0644)
+	_ = os.WriteFile(b, []byte(`[{"rank":1,"name":"pkg1","file_count":20},{"rank":2,"name":"new","file_count":7},{"rank":3,"name":"same","file_count":1}]`), 0644)
+
+	var buf bytes.Buffer
+	err := RunDiffFiles(&buf, &Config{Args: []string{a, b}})
+	output := buf.String()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"pkg1", "gone", "new", "1 added, 1 removed, 1 changed"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("missing %q in:\n%s", want, output)
+		}
+	}
+	if strings.Contains(output, "same") {
+		t.Errorf("unchanged package listed:\n%s", output)
+	}
+}
+
+func TestLoadResultsInvalid(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "bad.json")
+	_ = os.WriteFile(file, []byte("not json"), 0644)
+
+	if _, err := LoadResults(file); err == nil {
+		t.Fatal("should fail")
+	}
+}
+
+func TestPrintDiffJSON(t *testing.T) {
+	var buf bytes.Buffer
+	diffs := []PackageDiff{{Name: "pkg1", Status: DiffAdded, New: 2, Delta: 2}}
+	if err := PrintDiff(&buf, diffs, &Config{Format: FormatJSON}); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []PackageDiff
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil || len(got) != 1 || got[0] != diffs[0] {
+		t.Errorf("got %+v, %v", got, err)
+	}
+}
+
+func TestPercentDelta(t *testing.T) {
+	tests := []struct {
+		diff PackageDiff
+		want string
+	}{
+		{PackageDiff{Status: DiffChanged, Old: 10, New: 60, Delta: 50}, "+500.0%"},
+		{PackageDiff{Status: DiffChanged, Old: 50000, New: 50050, Delta: 50}, "+0.1%"},
+		{PackageDiff{Status: DiffRemoved, Old: 4, Delta: -4}, "-100.0%"},
+		{PackageDiff{Status: DiffAdded, New: 7, Delta: 7}, "new"},
+	}
+	for _, tt := range tests {
+		if got := tt.diff.formatPercentDelta(); got != tt.want {
+			t.Errorf("%+v: got %s, want %s", tt.diff, got, tt.want)
+		}
+	}
+	if _, ok := (PackageDiff{New: 1, Delta: 1}).PercentDelta(); ok {
+		t.Error("zero old count should not produce a percentage")
+	}
+}
+
+func TestRunDiffFilesPercent(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.json")
+	b := filepath.Join(dir, "b.json")
+	_ = os.WriteFile(a, []byte(`[{"name":"big","file_count":50000},{"name":"small","file_count":10}]`), 0644)
+	_ = os.WriteFile(b, []byte(`[{"name":"big","file_count":50100},{"name":"small","file_count":60},{"name":"fresh","file_count":2}]`), 0644)
+
+	var buf bytes.Buffer
+	cfg := &Config{Args: []string{a, b}, Format: FormatCSV, ShowPercentDelta: true, DiffSort: DiffSortPercent}
+	if err := RunDiffFiles(&buf, cfg); err != nil {
+		t.Fatal(err)
+	}
+	want := "status,name,old,new,delta,percent_delta\n" +
+		"added,fresh,0,2,2,new\n" +
+		"changed,small,10,60,50,+500.0%\n" +
+		"changed,big,50000,50100,100,+0.2%\n"
+	if buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+
+	buf.Reset()
+	cfg.Format = FormatJSON
+	if err := RunDiffFiles(&buf, cfg); err != nil {
+		t.Fatal(err)
+	}
+	var rows []map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows[0]["percent_delta"] != nil || rows[1]["percent_delta"] != 500.0 {
+		t.Errorf("got %v", rows)
+	}
+}
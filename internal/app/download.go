@@ -2,23 +2,71 @@ package app
 
 import (
 	"bufio"
+	"bytes"
+	"compress/bzip2"
 	"compress/gzip"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/canonical-dev/package_statistics/internal/cache"
 	"github.com/canonical-dev/package_statistics/internal/progress"
+	"github.com/ulikunitz/xz"
 )
 
+// Download failures that callers can tell apart with errors.Is, wrapped in an *HTTPError
+var (
+	// ErrNotFound means the mirror has no contents file for the architecture, suite or component
+	ErrNotFound = errors.New("contents not found")
+	// ErrServerError means the mirror answered with a 5xx status, usually worth retrying later
+	ErrServerError = errors.New("server error")
+)
+
+// ErrNoPackages means the contents were empty or had no package lines, returned unless -allow-empty is set
+var ErrNoPackages = errors.New("no packages parsed")
+
+// HTTPError is an unexpected status from the contents URL, errors.As gives access to the status code.
+type HTTPError struct {
+	StatusCode int
+	URL        string
+}
+
+// Error keeps the messages of the plain errors it replaced
+func (e *HTTPError) Error() string {
+	if e.StatusCode == http.StatusNotFound {
+		return fmt.Sprintf("404: Requested Package Contents Not Found: %s", e.URL)
+	}
+	return fmt.Sprintf("HTTP %d at %s", e.StatusCode, e.URL)
+}
+
+// Unwrap returns ErrNotFound for 404 and 410, ErrServerError for 5xx, nil otherwise
+func (e *HTTPError) Unwrap() error {
+	switch {
+	case e.StatusCode == http.StatusNotFound || e.StatusCode == http.StatusGone:
+		return ErrNotFound
+	case e.StatusCode >= 500:
+		return ErrServerError
+	}
+	return nil
+}
+
 // Download fetches and parses package statistics from a URL with caching support.
 func (a *App) Download(ctx context.Context, url string, cached *cache.CacheEntry) ([]cache.PackageStats, string, string, error) {
 	var etag, lastMod string
 
-	// Step 1: HEAD
-	headResp, err := HeadRequest(ctx, a.client, url, cached)
-	if err == nil {
+	// Step 1: HEAD, skipped when resuming: the GET's If-Range returns the rest (206) or the changed file (200) in one round trip
+	if a.canResume() {
+		a.logger.Printf("Found a partial download, skipping HEAD")
+	} else if headResp, err := HeadRequest(ctx, a.client, url, cached, a.cfg.RequestTimeout); err == nil {
 		defer headResp.Body.Close()
 		etag = headResp.Header.Get("ETag")
 		lastMod = headResp.Header.Get("Last-Modified")
@@ -26,94 +74,725 @@ func (a *App) Download(ctx context.Context, url string, cached *cache.CacheEntry
 		if cached != nil && (headResp.StatusCode == http.StatusNotModified ||
 			(etag == cached.ETag && lastMod == cached.LastModified)) {
 			a.logger.Printf("Using cached data")
+			a.fromCache, a.totals = true, entryTotals(cached)
 			return cached.Stats, cached.ETag, cached.LastModified, nil
 		}
 	} else {
-		a.logger.Printf("HEAD request failed: %v; falling back to GET", err)
+		logAt(a.logger, slog.LevelWarn, nil, "HEAD request failed: %v; falling back to GET", err)
 	}
 
 	// Step 2: GET with retries
 	a.logger.Printf("Starting download from %s", url)
-	resp, err := GetRequestWithRetry(ctx, a.client, url, cached)
+	pr := &progress.ProgressReader{Silent: a.cfg.NoProgress || a.cfg.Quiet, TTY: progress.IsTerminal(os.Stdout)}
+	pr.Logger = func(format string, v ...interface{}) {
+		logAt(a.logger, slog.LevelInfo, []any{"bytes", pr.Curr}, format, v...)
+	}
+	if a.cfg.ProgressFile != "" {
+		f, err := os.Create(a.cfg.ProgressFile)
+		if err != nil {
+			return nil, "", "", fmt.Errorf("create progress file: %w", err)
+		}
+		// closed by the progress reader at EOF, this covers failed downloads
+		defer f.Close()
+		pr.Telemetry = f
+	}
+	partial, resume, err := a.partialFile(etag)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if a.cfg.NoCache {
+		// the temp file exists from here on, whichever way the download ends
+		defer removePartial(partial)
+	}
+	if resume != nil {
+		a.logger.Printf("Resuming download at byte %d", resume.Offset)
+	}
+	policy := a.cfg.retryPolicy()
+	policy.OnRetry = func(attempt int, wait time.Duration, err error) {
+		logAt(a.logger, slog.LevelWarn, nil, "GET attempt %d/%d failed, retrying in %v: %v", attempt, policy.attempts(), wait.Truncate(time.Millisecond), err)
+	}
+	resp, err := GetRequestWithRetry(ctx, a.client, url, cached, a.cfg.RequestTimeout, policy, resume)
+	if err == nil && resume != nil && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// the partial file no longer lines up with the remote one, start over
+		resp.Body.Close()
+		removePartial(partial)
+		resume = nil
+		resp, err = GetRequestWithRetry(ctx, a.client, url, cached, a.cfg.RequestTimeout, policy, nil)
+	}
 	if err != nil {
 		if cached != nil {
-			a.logger.Printf("GET request failed, using cache: %v", err)
+			logAt(a.logger, slog.LevelWarn, nil, "GET request failed, using cache: %v", err)
+			a.fromCache, a.totals = true, entryTotals(cached)
 			return cached.Stats, cached.ETag, cached.LastModified, nil
 		}
 		return nil, "", "", err
 	}
-	defer resp.Body.Close()
+	// resp is replaced when a cut off body is resumed below
+	defer func() { resp.Body.Close() }()
 
 	// Log download info
 	if resp.ContentLength > 0 {
-		a.logger.Printf("Downloading %d bytes (%.1f MB)", resp.ContentLength, float64(resp.ContentLength)/(1024*1024))
+		logAt(a.logger, slog.LevelInfo, []any{"bytes", resp.ContentLength}, "Downloading %d bytes (%.1f MB)", resp.ContentLength, float64(resp.ContentLength)/(1024*1024))
 	} else {
 		a.logger.Printf("Downloading (size unknown)")
 	}
 
 	switch resp.StatusCode {
 	case http.StatusOK:
+	case http.StatusPartialContent:
+		if resume == nil || !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", resume.Offset)) {
+			removePartial(partial)
+			return nil, "", "", fmt.Errorf("unexpected partial response (Content-Range %q) at %s", resp.Header.Get("Content-Range"), url)
+		}
 	case http.StatusNotModified:
+		// the cache is current, a partial of some newer file is no use
+		removePartial(partial)
 		if cached != nil {
+			a.fromCache, a.totals = true, entryTotals(cached)
 			return cached.Stats, cached.ETag, cached.LastModified, nil
 		}
 		return nil, "", "", fmt.Errorf("304 received but no cache")
-	case http.StatusNotFound:
-		return nil, "", "", fmt.Errorf("404: Requested Package Contents Not Found: %s", url)
 	default:
-		return nil, "", "", fmt.Errorf("HTTP %d at %s", resp.StatusCode, url)
+		return nil, "", "", &HTTPError{StatusCode: resp.StatusCode, URL: url}
 	}
 
 	etag = resp.Header.Get("ETag")
 	lastMod = resp.Header.Get("Last-Modified")
+	if resp.StatusCode == http.StatusPartialContent && etag == "" {
+		// If-Range already made sure the remote file is the one the partial started from
+		etag = resume.ETag
+	}
+	if resp.StatusCode == http.StatusOK {
+		resume = nil
+	}
 
-	// Parse body with enhanced progress reporting
-	pr := &progress.ProgressReader{
-		Reader: resp.Body,
-		Total:  resp.ContentLength,
-		Logger: a.logger.Printf,
+	// Save the body with progress reporting, then parse it from disk
+	// a body cut off mid-transfer is resumed from the partial file while the retry policy has attempts left
+	start := time.Now()
+	var body *os.File
+	var downloaded int64
+	for attempt := 1; ; attempt++ {
+		pr.Reader = throttle(ctx, resp.Body, a.cfg.MaxRate)
+		pr.Total = resp.ContentLength
+		body, err = a.saveBody(ctx, pr, partial, etag, resume, !resp.Uncompressed && !a.cfg.NoCache)
+		downloaded += pr.Curr
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil || attempt >= policy.attempts() {
+			return nil, "", "", err
+		}
+		if resume = loadResume(partial, etag); resume == nil {
+			return nil, "", "", err
+		}
+		logAt(a.logger, slog.LevelWarn, []any{"bytes", resume.Offset}, "Resuming download at byte %d after: %v", resume.Offset, err)
+		resp.Body.Close()
+		next, err := a.resumeGet(ctx, url, partial, policy, resume)
+		if err != nil {
+			return nil, "", "", err
+		}
+		resp = next
+		if resp.StatusCode == http.StatusOK {
+			// the remote file changed, If-Range sent all of it back
+			resume = nil
+			etag, lastMod = resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+		}
+		// the new response is counted from zero, its Total is what is left
+		pr.Reset()
 	}
-	gz, err := gzip.NewReader(pr)
-	if err != nil {
+	a.metrics.observeDownload(a.cfg.Architecture, time.Since(start), downloaded)
+	defer removePartial(partial)
+	defer body.Close()
+
+	codec, explicit := resolveCompression(a.cfg.Compression, url)
+	gz, err := openContents(bufio.NewReader(body), resp, codec, explicit)
+	if errors.Is(err, errEmptyBody) {
+		if err := a.emptyResult(url, err); err != nil {
+			return nil, "", "", err
+		}
+		a.totals = Totals{}
+		return []cache.PackageStats{}, etag, lastMod, nil
+	} else if err != nil {
 		return nil, "", "", err
 	}
 	defer gz.Close()
 
-	// counts is a map of package name to file count
-	// sample: {"pkg1": 1, "pkg2": 1, "pkg3": 1}
-	counts := make(map[string]int)
-	// scanner is a bufio.Scanner that reads the gzip-compressed contents
+	parser := a.cfg.parser()
+	if a.cfg.Sampling() {
+		a.logger.Printf("Sampling %.1f%% of lines (seed=%d)", a.cfg.SampleRate*100, a.cfg.Seed)
+	}
+	start = time.Now()
+	stats, err := a.parseContents(ctx, gz, parser)
+	if err != nil {
+		return nil, "", "", err
+	}
+	a.metrics.observeParse(a.cfg.Architecture, time.Since(start))
+	// a 200 with no packages is a broken mirror object, never replace the cache with it
+	// (a package or path prefix can legitimately match nothing)
+	if len(stats) == 0 && !parser.prefixed() {
+		if err := a.emptyResult(url, nil); err != nil {
+			return nil, "", "", err
+		}
+	}
+	return stats, etag, lastMod, nil
+}
+
+// emptyResult returns the ErrNoPackages error for contents from source that held no packages (cause may be nil),
+// with -allow-empty it only logs a warning and returns nil
+func (a *App) emptyResult(source string, cause error) error {
+	reason := ""
+	if cause != nil {
+		reason = ", " + cause.Error()
+	}
+	if a.cfg.AllowEmpty {
+		logAt(a.logger, slog.LevelWarn, nil, "Warning: no packages parsed from %s%s, continuing with empty results (-allow-empty)", source, reason)
+		return nil
+	}
+	return fmt.Errorf("%w from %s%s (use -allow-empty to accept)", ErrNoPackages, source, reason)
+}
+
+// resumeGet asks for the bytes after resume.Offset of a download cut off mid-body
+// the answer is a 206 continuing at the offset or a 200 with the whole changed file, anything else discards the partial
+func (a *App) resumeGet(ctx context.Context, url, partial string, policy RetryPolicy, resume *Resume) (*http.Response, error) {
+	resp, err := GetRequestWithRetry(ctx, a.client, url, nil, a.cfg.RequestTimeout, policy, resume)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusOK:
+	case resp.StatusCode == http.StatusPartialContent && strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", resume.Offset)):
+	default:
+		resp.Body.Close()
+		removePartial(partial)
+		return nil, fmt.Errorf("resume %s at byte %d: unexpected %s (Content-Range %q)", url, resume.Offset, resp.Status, resp.Header.Get("Content-Range"))
+	}
+	return resp, nil
+}
+
+/*
+saveBody streams the response body to partial, appending when resume is set, and
+returns the complete file opened for reading.
+
+When the copy fails the partial file is kept together with an .etag sidecar so the
+next run can ask for the remaining bytes, unless the body can't be resumed
+(no strong ETag, or decoded by the Transport so the file offsets don't match the remote ones).
+*/
+func (a *App) saveBody(ctx context.Context, body io.Reader, partial, etag string, resume *Resume, resumable bool) (*os.File, error) {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if resume != nil {
+		flags = os.O_WRONLY | os.O_APPEND
+	}
+	f, err := os.OpenFile(partial, flags, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("create partial download: %w", err)
+	}
+	// If-Range only works with a strong validator, a weak ETag always gets the whole file back
+	resumable = resumable && etag != "" && !strings.HasPrefix(etag, "W/")
+	if resumable {
+		_ = os.WriteFile(partial+".etag", []byte(etag), 0644)
+	} else {
+		_ = os.Remove(partial + ".etag")
+	}
+
+	n, err := io.Copy(f, body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			logAt(a.logger, slog.LevelWarn, nil, "Download cancelled by user: %v", ctx.Err())
+		}
+		if resumable {
+			logAt(a.logger, slog.LevelWarn, []any{"bytes", n}, "Download interrupted after %d bytes, keeping %s to resume", n, partial)
+		} else {
+			removePartial(partial)
+		}
+		return nil, err
+	}
+	return os.Open(partial)
+}
+
+// partialFile returns where the body is saved next to the cache, and where to resume it from (nil = from the start)
+// with -no-cache the body goes to a fresh temp file instead so nothing is left in the cache dir
+func (a *App) partialFile(headETag string) (string, *Resume, error) {
+	if a.cfg.NoCache {
+		f, err := os.CreateTemp("", "package_statistics-*.partial")
+		if err != nil {
+			return "", nil, fmt.Errorf("create partial download: %w", err)
+		}
+		f.Close()
+		return f.Name(), nil, nil
+	}
+	partial := a.CacheFile() + ".partial"
+	return partial, loadResume(partial, headETag), nil
+}
+
+// canResume reports whether a partial download is waiting in the cache dir to be resumed
+func (a *App) canResume() bool {
+	return !a.cfg.NoCache && loadResume(a.CacheFile()+".partial", "") != nil
+}
+
+// Resume asks GetRequestWithRetry for the rest of a partially downloaded file.
+type Resume struct {
+	// Offset is the number of bytes already on disk
+	Offset int64
+	// ETag is sent as If-Range so a changed remote file comes back whole
+	ETag string
+}
+
+// loadResume returns where to resume partial, or nil when there is nothing to resume
+// a HEAD etag that differs from the one the partial was started with discards the partial
+func loadResume(partial, headETag string) *Resume {
+	info, err := os.Stat(partial)
+	if err != nil {
+		return nil
+	}
+	etag, err := os.ReadFile(partial + ".etag")
+	if err != nil || len(etag) == 0 || info.Size() == 0 || (headETag != "" && headETag != string(etag)) {
+		removePartial(partial)
+		return nil
+	}
+	return &Resume{Offset: info.Size(), ETag: string(etag)}
+}
+
+// removePartial deletes a partial download and its etag sidecar
+func removePartial(partial string) {
+	_ = os.Remove(partial)
+	_ = os.Remove(partial + ".etag")
+}
+
+// loadFile parses the local contents file from -file, bypassing HTTP and the cache
+func (a *App) loadFile(ctx context.Context) ([]PackageStats, error) {
+	f, err := os.Open(a.cfg.File)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	a.changed, a.etag = true, ""
+
+	// a local file has no response headers, only its magic and name tell the codec
+	codec, explicit := resolveCompression(a.cfg.Compression, a.cfg.File)
+	r, err := openContents(bufio.NewReader(f), &http.Response{}, codec, explicit)
+	if errors.Is(err, errEmptyBody) {
+		if err := a.emptyResult(a.cfg.File, err); err != nil {
+			return nil, err
+		}
+		a.totals = Totals{}
+		return []PackageStats{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("read %s: %w", a.cfg.File, err)
+	}
+	defer r.Close()
+
+	parser := a.cfg.parser()
+	stats, err := a.parseContents(ctx, r, parser)
+	if err != nil {
+		return nil, err
+	}
+	if len(stats) == 0 && !parser.prefixed() {
+		if err := a.emptyResult(a.cfg.File, nil); err != nil {
+			return nil, err
+		}
+	}
+	return stats, nil
+}
+
+// scratchDir is where low-memory spill files go: the cache dir, or the system temp dir with -no-cache
+func (a *App) scratchDir() string {
+	if a.cfg.NoCache {
+		return os.TempDir()
+	}
+	return a.cfg.CacheDir
+}
+
+// parseContents counts the packages on every line of the decompressed contents stream
+// and records the totals of the scan in a.totals
+func (a *App) parseContents(ctx context.Context, r io.Reader, parser LineParser) ([]cache.PackageStats, error) {
+	var res ParseResult
+	var err error
+	if a.cfg.LowMemory {
+		res, err = parseLowMemory(ctx, r, parser, a.scratchDir(), a.cfg.TopCount)
+	} else {
+		res, err = parser.ParseWithTotals(ctx, r)
+	}
+	if err != nil && ctx.Err() != nil {
+		logAt(a.logger, slog.LevelWarn, nil, "Download cancelled by user: %v", ctx.Err())
+	}
+	a.totals = res.Totals
+	return res.Stats, err
+}
+
+/*
+ParseContents reads decompressed contents lines from r and returns the package stats sorted by file count.
+
+It is the parsing core of Download without the HTTP and cache machinery, so any reader can be fed:
+
+	f, _ := os.Open("Contents-amd64")
+	stats, err := app.ParseContents(ctx, f)
+*/
+func ParseContents(ctx context.Context, r io.Reader) ([]cache.PackageStats, error) {
+	return LineParser{}.Parse(ctx, r)
+}
+
+// ParseContentsWithTotals is ParseContents that also returns the totals counted during the scan
+func ParseContentsWithTotals(ctx context.Context, r io.Reader) (ParseResult, error) {
+	return LineParser{}.ParseWithTotals(ctx, r)
+}
+
+// Parse is ParseContents with the parser's options
+func (p LineParser) Parse(ctx context.Context, r io.Reader) ([]cache.PackageStats, error) {
+	res, err := p.ParseWithTotals(ctx, r)
+	return res.Stats, err
+}
+
+// ParseWithTotals is ParseContentsWithTotals with the parser's options
+func (p LineParser) ParseWithTotals(ctx context.Context, r io.Reader) (ParseResult, error) {
+	// scanner is a bufio.Scanner that reads the decompressed contents
 	// sample: "usr/bin/file1 pkg1,pkg2,pkg3"
-	scanner := bufio.NewScanner(gz)
-	// buf is a buffer for the scanner - 10MB
-	// 10MB -> if the file is larger than 10MB, we will need to read it in chunks
-	buf := make([]byte, 1024*1024)
-	scanner.Buffer(buf, 10*1024*1024)
+	scanner := p.scanner(r)
+
+	var counts map[string]int
+	var totals Totals
+	var err error
+	if p.Workers > 1 && !p.Dedupe {
+		counts, totals, err = p.countConcurrent(ctx, scanner)
+	} else {
+		counts, totals, err = p.count(ctx, scanner)
+	}
+	if err != nil {
+		return ParseResult{}, err
+	}
+	totals.Packages = len(counts)
+	// Sort the counts map
+	return ParseResult{Stats: SortMap(counts), Totals: totals}, nil
+}
 
+// count processes every line of scanner into a map of package name to file count
+// sample: {"pkg1": 1, "pkg2": 1, "pkg3": 1}
+func (p LineParser) count(ctx context.Context, scanner *contentsScanner) (map[string]int, Totals, error) {
+	counts := make(map[string]int)
+	var totals Totals
+	var seen pathSet
+	if p.Dedupe {
+		seen = make(pathSet)
+	}
 	lineCount := 0
 	// Scan the file line by line
 	for scanner.Scan() {
 		// Check for cancellation every 1000 lines for responsiveness
-		if lineCount%1000 == 0 {
-			if ctx.Err() != nil {
-				a.logger.Printf("Download cancelled by user: %v", ctx.Err())
-				return nil, "", "", ctx.Err()
-			}
+		if lineCount%1000 == 0 && ctx.Err() != nil {
+			return nil, Totals{}, ctx.Err()
 		}
 		// Process the line into the counts map
 		// scanner.Text() is the line - "usr/bin/file1 pkg_names"
-		ProcessLine(scanner.Text(), counts)
+		p.forEachEntry(scanner.Text(), func(path, key string) {
+			if seen != nil && !seen.add(path, key) {
+				return
+			}
+			counts[key]++
+			totals.Files++
+		})
 		lineCount++
 	}
-	if scanner.Err() != nil {
-		return nil, "", "", scanner.Err()
+	return counts, totals, scanner.Err()
+}
+
+// parseBatchLines is how many lines the concurrent parser hands to a worker at once
+const parseBatchLines = 4096
+
+/*
+countConcurrent is count with p.Workers goroutines.
+
+The scanner stays on the calling goroutine and hands out batches of lines,
+each worker counts into its own map and the maps are summed once all lines are in.
+Sums don't depend on which worker saw which line, so the result equals count's.
+Cancellation is checked whenever a batch is handed out.
+*/
+func (p LineParser) countConcurrent(ctx context.Context, scanner *contentsScanner) (map[string]int, Totals, error) {
+	batches := make(chan []string, p.Workers)
+	locals := make([]map[string]int, p.Workers)
+	files := make([]int, p.Workers)
+	var wg sync.WaitGroup
+	for w := range p.Workers {
+		locals[w] = make(map[string]int)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				for _, line := range batch {
+					p.forEachKey(line, func(key string) {
+						locals[w][key]++
+						files[w]++
+					})
+				}
+			}
+		}()
 	}
-	// Sort the counts map
-	return SortMap(counts), etag, lastMod, nil
+
+	var err error
+	batch := make([]string, 0, parseBatchLines)
+	for scanner.Scan() {
+		batch = append(batch, scanner.Text())
+		if len(batch) < parseBatchLines {
+			continue
+		}
+		select {
+		case batches <- batch:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if err != nil {
+			break
+		}
+		batch = make([]string, 0, parseBatchLines)
+	}
+	if err == nil {
+		err = scanner.Err()
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err == nil && len(batch) > 0 {
+		batches <- batch
+	}
+	close(batches)
+	wg.Wait()
+	if err != nil {
+		return nil, Totals{}, err
+	}
+
+	counts := locals[0]
+	var totals Totals
+	for w, local := range locals {
+		totals.Files += files[w]
+		if w == 0 {
+			continue
+		}
+		for key, n := range local {
+			counts[key] += n
+		}
+	}
+	return counts, totals, nil
+}
+
+// gzipMagic is the two byte header every gzip stream starts with
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// compressionMagic maps each codec to the header its streams start with
+var compressionMagic = []struct {
+	codec string
+	magic []byte
+}{
+	{CompressionGzip, gzipMagic},
+	{CompressionXZ, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{CompressionBzip2, []byte("BZh")},
+}
+
+// compressionExt is the file suffix mirrors publish each codec under
+var compressionExt = map[string]string{
+	CompressionAuto:  ".gz",
+	CompressionGzip:  ".gz",
+	CompressionXZ:    ".xz",
+	CompressionBzip2: ".bz2",
+	CompressionNone:  "",
+}
+
+/*
+resolveCompression picks the codec for url and reports whether the user chose it
+
+an explicit -compression wins, then the URL suffix (.gz, .xz, .bz2)
+anything else stays auto and is sniffed from the body
+a codec taken from the suffix is only a hint: openContents still sniffs the body
+*/
+func resolveCompression(codec, url string) (string, bool) {
+	if codec != "" && codec != CompressionAuto {
+		return codec, true
+	}
+	for c, ext := range compressionExt {
+		if c != CompressionAuto && ext != "" && strings.HasSuffix(url, ext) {
+			return c, false
+		}
+	}
+	return CompressionAuto, false
+}
+
+// decompress wraps r with the reader for codec
+func decompress(codec string, r io.Reader) (io.ReadCloser, error) {
+	switch codec {
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionXZ:
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(xr), nil
+	case CompressionBzip2:
+		return io.NopCloser(bzip2.NewReader(r)), nil
+	case CompressionNone:
+		return io.NopCloser(r), nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", codec)
+}
+
+/*
+openContents returns a reader over the decompressed contents stream.
+
+br is peeked, never read, so no byte is lost before parsing.
+
+	none -> the body as is
+	magic of the codec (any codec unless explicit) present -> matching decompressor
+	no magic but the body is plain text -> the body as is
+	(internal mirrors serve uncompressed files under .gz names, misconfigured proxies send
+	Contents-*.gz with Content-Encoding: gzip which the Transport already removed)
+	no magic with an explicit codec (-compression) -> that decompressor reports the error
+
+a codec from the URL suffix isn't explicit: every mirror URL ends in .gz,
+so it must not turn an HTML error page into a bare "gzip: invalid header"
+
+zero-length body (e.g. a broken CDN object) -> errEmptyBody
+anything else (e.g. an HTML error page served with 200) -> descriptive error
+*/
+func openContents(br *bufio.Reader, resp *http.Response, codec string, explicit bool) (io.ReadCloser, error) {
+	if _, err := br.Peek(1); err == io.EOF {
+		return nil, errEmptyBody
+	}
+	if codec == CompressionNone {
+		return io.NopCloser(br), nil
+	}
+	for _, c := range compressionMagic {
+		if magic, _ := br.Peek(len(c.magic)); (!explicit || codec == c.codec) && bytes.Equal(magic, c.magic) {
+			return decompress(c.codec, br)
+		}
+	}
+
+	snippet, _ := br.Peek(snippetSize)
+	sniffed := http.DetectContentType(snippet)
+	if strings.HasPrefix(sniffed, "text/plain") {
+		return io.NopCloser(br), nil
+	}
+	if explicit {
+		return decompress(codec, br)
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = sniffed
+	}
+	return nil, fmt.Errorf("expected compressed contents but got %s: %q", contentType, snippet)
+}
+
+// errEmptyBody is returned for a 200 response without any content
+var errEmptyBody = errors.New("empty response body")
+
+// snippetSize is how much of an unexpected body is quoted in errors
+const snippetSize = 128
+
+// newContentsScanner returns a line scanner sized for contents files
+func newContentsScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	// buf is a buffer for the scanner - 10MB
+	// 10MB -> if the file is larger than 10MB, we will need to read it in chunks
+	buf := make([]byte, 1024*1024)
+	scanner.Buffer(buf, 10*1024*1024)
+	return scanner
+}
+
+const (
+	// DefaultLegend is the first column title of the legend line that ends the Contents header
+	DefaultLegend = "FILE"
+	// maxHeaderLines is how far into a contents file the legend line is looked for
+	maxHeaderLines = 64
+)
+
+/*
+contentsScanner yields the data lines of a contents file without its header block.
+
+Older Contents files start with a free text preamble ending in a legend line:
+
+	This file maps each file available in the Debian
+	GNU/Linux system to the package from which it originates.
+	...
+	FILE                                                    LOCATION
+	usr/bin/file1 pkg1,pkg2
+
+The first maxHeaderLines lines are buffered: if the legend is among them, it and everything
+before it is dropped. Without a legend only leading blank and # comment lines are dropped.
+*/
+type contentsScanner struct {
+	*bufio.Scanner
+	legend  []string
+	pending []string
+	line    string
+	started bool
+}
+
+// scanner returns a contentsScanner over r using the parser's legend
+func (p LineParser) scanner(r io.Reader) *contentsScanner {
+	legend := p.Legend
+	if legend == "" {
+		legend = DefaultLegend
+	}
+	return &contentsScanner{Scanner: newContentsScanner(r), legend: strings.Fields(legend)}
+}
+
+// Scan advances to the next data line
+func (s *contentsScanner) Scan() bool {
+	if !s.started {
+		s.started = true
+		s.skipHeader()
+	}
+	if len(s.pending) > 0 {
+		s.line, s.pending = s.pending[0], s.pending[1:]
+		return true
+	}
+	if !s.Scanner.Scan() {
+		return false
+	}
+	s.line = s.Scanner.Text()
+	return true
+}
+
+// Text returns the current data line
+func (s *contentsScanner) Text() string {
+	return s.line
+}
+
+// skipHeader buffers the leading lines and drops the header among them
+func (s *contentsScanner) skipHeader() {
+	for len(s.pending) < maxHeaderLines && s.Scanner.Scan() {
+		line := s.Scanner.Text()
+		if s.isLegend(line) {
+			s.pending = nil
+			return
+		}
+		s.pending = append(s.pending, line)
+	}
+	for len(s.pending) > 0 {
+		if line := strings.TrimSpace(s.pending[0]); line != "" && !strings.HasPrefix(line, "#") {
+			break
+		}
+		s.pending = s.pending[1:]
+	}
+}
+
+// isLegend reports whether line starts with the legend's columns: "FILE   LOCATION" matches "FILE"
+func (s *contentsScanner) isLegend(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) < len(s.legend) {
+		return false
+	}
+	for i, f := range s.legend {
+		if fields[i] != f {
+			return false
+		}
+	}
+	return true
 }
 
 // HeadRequest performs HEAD request with ETag/Last-Modified headers
-func HeadRequest(ctx context.Context, client *http.Client, url string, cached *CacheEntry) (*http.Response, error) {
+// timeout (0 = none) bounds the wait for the response
+func HeadRequest(ctx context.Context, client *http.Client, url string, cached *CacheEntry, timeout time.Duration) (*http.Response, error) {
 	req, _ := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
 	if cached != nil {
 		if cached.ETag != "" {
@@ -123,19 +802,61 @@ func HeadRequest(ctx context.Context, client *http.Client, url string, cached *C
 			req.Header.Set("If-Modified-Since", cached.LastModified)
 		}
 	}
-	return client.Do(req)
+	return doWithTimeout(client, req, timeout)
+}
+
+// RetryPolicy controls how GetRequestWithRetry retries failed attempts.
+type RetryPolicy struct {
+	// MaxRetries is the total number of attempts (MaxRetries if <= 0)
+	MaxRetries int
+	// BaseDelay is the wait after the first failure, doubled after each further one up to MaxRetryDelay
+	// (DefaultRetryBaseDelay if <= 0)
+	BaseDelay time.Duration
+	// Jitter randomizes every wait between half and all of it so many instances don't retry in lockstep
+	Jitter bool
+	// OnRetry (optional) is called after failed attempt (1-based) with the error and the wait before the next one
+	OnRetry func(attempt int, wait time.Duration, err error)
+}
+
+// attempts returns the number of GET attempts
+func (p RetryPolicy) attempts() int {
+	if p.MaxRetries <= 0 {
+		return MaxRetries
+	}
+	return p.MaxRetries
+}
+
+// delay returns the wait after failed attempt i (0-based), never more than MaxRetryDelay
+func (p RetryPolicy) delay(i int) time.Duration {
+	d := p.BaseDelay
+	if d <= 0 {
+		d = DefaultRetryBaseDelay
+	}
+	// doubled one step at a time, base << i overflows after a few dozen attempts
+	for ; i > 0 && d < MaxRetryDelay; i-- {
+		d *= 2
+	}
+	d = min(d, MaxRetryDelay)
+	if p.Jitter && d > 1 {
+		d = d/2 + rand.N(d/2)
+	}
+	return d
 }
 
 // GetRequestWithRetry performs GET request with retries
-func GetRequestWithRetry(ctx context.Context, client *http.Client, url string, cached *CacheEntry) (*http.Response, error) {
+// network errors and retryable statuses (429, 500, 502, 503, 504) are retried per policy,
+// waiting for Retry-After when the server sends it, the last such response is returned as is
+// timeout (0 = none) bounds each attempt's wait for response headers, a stuck attempt is abandoned and retried
+// resume (optional) requests only the bytes after resume.Offset, the server answers 206 or a full 200
+func GetRequestWithRetry(ctx context.Context, client *http.Client, url string, cached *CacheEntry, timeout time.Duration, policy RetryPolicy, resume *Resume) (*http.Response, error) {
 	var resp *http.Response
 	var err error
-	for i := 0; i < MaxRetries; i++ {
+	attempts := policy.attempts()
+	for i := 0; i < attempts; i++ {
 		// Check if context was cancelled
 		if ctx.Err() != nil {
 			return nil, ctx.Err()
 		}
-
 		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 		if cached != nil {
 			if cached.ETag != "" {
@@ -145,20 +866,106 @@ func GetRequestWithRetry(ctx context.Context, client *http.Client, url string, c
 				req.Header.Set("If-Modified-Since", cached.LastModified)
 			}
 		}
-		resp, err = client.Do(req)
-		if err == nil {
+		if resume != nil {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", resume.Offset))
+			req.Header.Set("If-Range", resume.ETag)
+		}
+		resp, err = doWithTimeout(client, req, timeout)
+		if err == nil && (!retryableStatus(resp.StatusCode) || i == attempts-1) {
 			return resp, nil
 		}
+		wait := policy.delay(i)
+		if err == nil {
+			if d, ok := retryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+				wait = d
+			}
+			resp.Body.Close()
+			err = &HTTPError{StatusCode: resp.StatusCode, URL: url}
+		}
 
 		// Don't sleep on last retry or if context cancelled
-		if i < MaxRetries-1 {
+		if i < attempts-1 {
+			if policy.OnRetry != nil {
+				policy.OnRetry(i+1, wait, err)
+			}
 			select {
 			case <-ctx.Done():
 				return nil, ctx.Err()
-			case <-time.After(time.Second * (1 << i)):
+			case <-time.After(wait):
 				// Continue to next retry
 			}
 		}
 	}
 	return nil, err
 }
+
+// retryableStatus reports whether a response with code is worth retrying
+// rate limits and overloaded or flaky upstreams are, client errors such as 400 and 404 are not
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// maxRetryAfter caps the wait a server can ask for, a bogus header must not stall the download
+const maxRetryAfter = 2 * time.Minute
+
+// retryAfter parses a Retry-After header (seconds or an HTTP date) relative to now
+func retryAfter(header string, now time.Time) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	var d time.Duration
+	if secs, err := strconv.Atoi(header); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if at, err := http.ParseTime(header); err == nil {
+		d = at.Sub(now)
+	} else {
+		return 0, false
+	}
+	return min(max(d, 0), maxRetryAfter), true
+}
+
+// doWithTimeout sends req, abandoning it if no response arrives within timeout
+// the deadline is lifted once headers arrive so streaming the body is bounded only by the parent context
+func doWithTimeout(client *http.Client, req *http.Request, timeout time.Duration) (*http.Response, error) {
+	if timeout <= 0 {
+		return client.Do(req)
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(timeout, cancel)
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		if req.Context().Err() == nil && ctx.Err() != nil {
+			return nil, fmt.Errorf("request timed out after %v: %w", timeout, err)
+		}
+		return nil, err
+	}
+	if !timer.Stop() {
+		// timer fired while the response was being returned
+		_ = resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("request timed out after %v", timeout)
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelOnClose releases the per-request context once the body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+// Close closes the body and cancels its request context
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
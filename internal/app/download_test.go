@@ -4,13 +4,21 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/canonical-dev/package_statistics/internal/cache"
+	"github.com/ulikunitz/xz"
 )
 
 func TestDownloadSuccess(t *testing.T) {
@@ -26,7 +34,7 @@ func TestDownloadSuccess(t *testing.T) {
 	}))
 	defer server.Close()
 
-	app := NewApp(&Config{Architecture: "amd64", CacheDir: t.TempDir()}, nil)
+	app := NewApp(&Config{Architecture: "amd64", CacheDir: t.TempDir()})
 	stats, etag, _, err := app.Download(context.Background(), server.URL, nil)
 
 	if err != nil {
@@ -58,7 +66,7 @@ func TestDownloadCacheMatch(t *testing.T) {
 	}))
 	defer server.Close()
 
-	app := NewApp(&Config{Architecture: "amd64", CacheDir: t.TempDir()}, nil)
+	app := NewApp(&Config{Architecture: "amd64", CacheDir: t.TempDir()})
 	stats, _, _, err := app.Download(context.Background(), server.URL, cached)
 
 	if err != nil {
@@ -74,9 +82,13 @@ func TestDownloadErrors(t *testing.T) {
 		name   string
 		status int
 		want   string
+		is     error
 	}{
-		{"not found", 404, "404"},
-		{"server error", 500, "HTTP 500"},
+		{"not found", 404, "404", ErrNotFound},
+		{"gone", 410, "HTTP 410", ErrNotFound},
+		{"server error", 500, "HTTP 500", ErrServerError},
+		{"bad gateway", 502, "HTTP 502", ErrServerError},
+		{"forbidden", 403, "HTTP 403", nil},
 	}
 
 	for _, tt := range tests {
@@ -85,12 +97,48 @@ func TestDownloadErrors(t *testing.T) {
 		}))
 		defer server.Close()
 
-		app := NewApp(&Config{Architecture: "amd64", CacheDir: t.TempDir()}, nil)
+		app := NewApp(&Config{Architecture: "amd64", CacheDir: t.TempDir(), RetryBaseDelay: time.Millisecond})
 		_, _, _, err := app.Download(context.Background(), server.URL, nil)
 
 		if err == nil || !strings.Contains(err.Error(), tt.want) {
 			t.Errorf("%s: got %v, want %s", tt.name, err, tt.want)
 		}
+		var httpErr *HTTPError
+		if !errors.As(err, &httpErr) || httpErr.StatusCode != tt.status {
+			t.Errorf("%s: got %#v, want an *HTTPError with status %d", tt.name, err, tt.status)
+		}
+		for _, sentinel := range []error{ErrNotFound, ErrServerError} {
+			if errors.Is(err, sentinel) != (sentinel == tt.is) {
+				t.Errorf("%s: errors.Is(%v, %v) = %v", tt.name, err, sentinel, !(sentinel == tt.is))
+			}
+		}
+	}
+}
+
+func TestAnalyzeWithCachePropagatesHTTPErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.Contains(r.URL.Path, "bogus"):
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	for arch, want := range map[string]error{"bogus": ErrNotFound, "amd64": ErrServerError} {
+		app := NewApp(&Config{Architecture: arch, CacheDir: t.TempDir(), RetryBaseDelay: time.Millisecond, NoProgress: true}, WithLogger(log.New(io.Discard, "", 0)))
+		app.baseURL = server.URL + "/Contents-{arch}.gz"
+		if _, err := app.AnalyzeWithCache(context.Background()); !errors.Is(err, want) {
+			t.Errorf("%s: got %v, want %v", arch, err, want)
+		}
+	}
+
+	// several components wrap the error with the component name
+	app := NewApp(&Config{Architecture: "bogus", CacheDir: t.TempDir(), Components: []string{"main", "contrib"}, NoProgress: true}, WithLogger(log.New(io.Discard, "", 0)))
+	app.baseURL = server.URL + "/{component}/Contents-{arch}.gz"
+	if _, err := app.AnalyzeWithCache(context.Background()); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v, want %v", err, ErrNotFound)
 	}
 }
 
@@ -99,7 +147,7 @@ func TestDownloadNetworkFallback(t *testing.T) {
 		Stats: []cache.PackageStats{{Name: "fallback-pkg", FileCount: 75}},
 	}
 
-	app := NewApp(&Config{Architecture: "amd64", CacheDir: t.TempDir()}, nil)
+	app := NewApp(&Config{Architecture: "amd64", CacheDir: t.TempDir()})
 	stats, _, _, err := app.Download(context.Background(), "http://invalid-host.local", cached)
 
 	if err != nil {
@@ -109,3 +157,801 @@ func TestDownloadNetworkFallback(t *testing.T) {
 		t.Errorf("got %s", stats[0].Name)
 	}
 }
+
+func TestDownloadResumesCutOffBody(t *testing.T) {
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	for i := 0; i < 50; i++ {
+		fmt.Fprintf(gz, "usr/share/doc/file%d pkg%d\n", i, i%5)
+	}
+	gz.Close()
+	data := body.Bytes()
+
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", "v1")
+		if r.Method == http.MethodHead {
+			return
+		}
+		ranges = append(ranges, r.Header.Get("Range"))
+		var start int
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &start); err == nil && r.Header.Get("If-Range") == "v1" {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(data)-1, len(data)))
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write(data[start:])
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		_, _ = w.Write(data[:len(data)/2])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	defer server.Close()
+
+	telemetry := filepath.Join(t.TempDir(), "progress.csv")
+	app := NewApp(&Config{Architecture: "amd64", CacheDir: t.TempDir(), RetryBaseDelay: time.Millisecond, NoProgress: true, ProgressFile: telemetry},
+		WithLogger(log.New(io.Discard, "", 0)))
+	stats, _, _, err := app.Download(context.Background(), server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 5 || stats[0].FileCount != 10 {
+		t.Errorf("got %v", stats)
+	}
+	if want := []string{"", fmt.Sprintf("bytes=%d-", len(data)/2)}; fmt.Sprint(ranges) != fmt.Sprint(want) {
+		t.Errorf("got Range headers %q, want %q", ranges, want)
+	}
+	// the resumed response is counted from zero, so progress ends at the bytes it held rather than past the total
+	csv, err := os.ReadFile(telemetry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := strings.Split(strings.TrimSpace(string(csv)), "\n")
+	if last := strings.Split(rows[len(rows)-1], ","); len(last) != 3 || last[1] != fmt.Sprint(len(data)-len(data)/2) {
+		t.Errorf("want the last progress row at %d bytes, got %q", len(data)-len(data)/2, rows)
+	}
+
+	// a resume the server can't serve fails the download instead of appending the wrong bytes
+	server404 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", "v1")
+		if r.Header.Get("Range") != "" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		_, _ = w.Write(data[:len(data)/2])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	defer server404.Close()
+	app = NewApp(&Config{Architecture: "amd64", CacheDir: t.TempDir(), RetryBaseDelay: time.Millisecond, NoProgress: true}, WithLogger(log.New(io.Discard, "", 0)))
+	if _, _, _, err := app.Download(context.Background(), server404.URL, nil); err == nil || !strings.Contains(err.Error(), "resume") {
+		t.Errorf("got %v, want the failed resume", err)
+	}
+	if _, err := os.Stat(app.CacheFile() + ".partial"); !os.IsNotExist(err) {
+		t.Error("a partial the server can't resume should be removed")
+	}
+
+	// without attempts left the partial is kept for the next run
+	app = NewApp(&Config{Architecture: "amd64", CacheDir: t.TempDir(), MaxRetries: 1, NoProgress: true}, WithLogger(log.New(io.Discard, "", 0)))
+	if _, _, _, err := app.Download(context.Background(), server.URL, nil); err == nil {
+		t.Error("a single attempt should fail")
+	}
+	if info, err := os.Stat(app.CacheFile() + ".partial"); err != nil || info.Size() != int64(len(data)/2) {
+		t.Errorf("partial should keep the received bytes: %v, %v", info, err)
+	}
+}
+
+func TestDownloadRequestTimeoutRetries(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	fmt.Fprintln(gz, "usr/bin/file1 pkg1")
+	gz.Close()
+
+	var gets int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			return
+		}
+		if atomic.AddInt32(&gets, 1) == 1 {
+			// hang until the client gives up on this attempt
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		_, _ = w.Write(buf.Bytes())
+	}))
+	defer server.Close()
+
+	app := NewApp(&Config{Architecture: "amd64", CacheDir: t.TempDir(), RequestTimeout: 100 * time.Millisecond})
+	start := time.Now()
+	stats, _, _, err := app.Download(context.Background(), server.URL, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 || stats[0].Name != "pkg1" {
+		t.Errorf("got %+v", stats)
+	}
+	if n := atomic.LoadInt32(&gets); n != 2 {
+		t.Errorf("got %d GET attempts", n)
+	}
+	if elapsed := time.Since(start); elapsed > 4*time.Second {
+		t.Errorf("hung attempt was not cut off, took %v", elapsed)
+	}
+}
+
+func TestDownloadHTMLInsteadOfGzip(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte("<html><body>Mirror maintenance</body></html>"))
+	}))
+	defer server.Close()
+
+	app := NewApp(&Config{Architecture: "amd64", CacheDir: t.TempDir()})
+	_, _, _, err := app.Download(context.Background(), server.URL, nil)
+
+	if err == nil {
+		t.Fatal("should fail on html body")
+	}
+	if !strings.Contains(err.Error(), "expected compressed contents but got text/html") || !strings.Contains(err.Error(), "Mirror maintenance") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestDownloadHTMLUnderGzURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte("<html><body>Mirror maintenance</body></html>"))
+	}))
+	defer server.Close()
+
+	// the .gz suffix is only a hint, the body is still sniffed
+	app := NewApp(&Config{Architecture: "amd64", CacheDir: t.TempDir(), NoProgress: true}, WithLogger(log.New(io.Discard, "", 0)))
+	_, _, _, err := app.Download(context.Background(), server.URL+"/dists/stable/main/Contents-amd64.gz", nil)
+	if err == nil || !strings.Contains(err.Error(), "expected compressed contents but got text/html") {
+		t.Errorf("got %v", err)
+	}
+
+	// -compression gzip trusts the codec
+	app = NewApp(&Config{Architecture: "amd64", CacheDir: t.TempDir(), NoProgress: true, Compression: CompressionGzip}, WithLogger(log.New(io.Discard, "", 0)))
+	_, _, _, err = app.Download(context.Background(), server.URL+"/dists/stable/main/Contents-amd64.gz", nil)
+	if err == nil || strings.Contains(err.Error(), "expected compressed contents") {
+		t.Errorf("an explicit codec should report the decompressor error, got %v", err)
+	}
+}
+
+func TestDownloadUncompressedUnderGzName(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/gzip")
+		_, _ = w.Write([]byte("usr/bin/file1 pkg1,pkg2\nusr/lib/file2 pkg1\n"))
+	}))
+	defer server.Close()
+
+	app := NewApp(&Config{Architecture: "amd64", CacheDir: t.TempDir()})
+	stats, _, _, err := app.Download(context.Background(), server.URL+"/Contents-amd64.gz", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 2 || stats[0].Name != "pkg1" || stats[0].FileCount != 2 {
+		t.Errorf("got %+v", stats)
+	}
+}
+
+func TestDownloadContentEncodingGzip(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	fmt.Fprintln(gz, "usr/bin/file1 pkg1,pkg2")
+	fmt.Fprintln(gz, "usr/lib/file2 pkg1")
+	gz.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// proxy marks the already gzipped file as gzip encoded, the Transport strips that layer
+		w.Header().Set("Content-Encoding", "gzip")
+		_, _ = w.Write(buf.Bytes())
+	}))
+	defer server.Close()
+
+	app := NewApp(&Config{Architecture: "amd64", CacheDir: t.TempDir()})
+	stats, _, _, err := app.Download(context.Background(), server.URL, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 2 || stats[0].Name != "pkg1" || stats[0].FileCount != 2 {
+		t.Errorf("got %+v", stats)
+	}
+}
+
+func TestDownloadEmptyBody(t *testing.T) {
+	var emptyGzip, headerOnly bytes.Buffer
+	gzip.NewWriter(&emptyGzip).Close()
+	gz := gzip.NewWriter(&headerOnly)
+	_, _ = gz.Write([]byte("This file maps each file available in the Debian GNU/Linux system to\nFILE LOCATION\n"))
+	gz.Close()
+
+	for name, body := range map[string][]byte{"zero-length": nil, "empty gzip": emptyGzip.Bytes(), "header only": headerOnly.Bytes()} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write(body)
+		}))
+
+		app := NewApp(&Config{Architecture: "amd64", CacheDir: t.TempDir()}, WithLogger(log.New(io.Discard, "", 0)))
+		if _, _, _, err := app.Download(context.Background(), server.URL, nil); !errors.Is(err, ErrNoPackages) {
+			t.Errorf("%s: got %v, want ErrNoPackages", name, err)
+		}
+
+		var logs bytes.Buffer
+		app = NewApp(&Config{Architecture: "amd64", CacheDir: t.TempDir(), AllowEmpty: true}, WithLogger(log.New(&logs, "", 0)))
+		stats, _, _, err := app.Download(context.Background(), server.URL, nil)
+		if err != nil || len(stats) != 0 {
+			t.Errorf("%s with -allow-empty: got %v, %v", name, stats, err)
+		}
+		if !strings.Contains(logs.String(), "Warning: no packages parsed from "+server.URL) {
+			t.Errorf("%s with -allow-empty: expected a warning, got %q", name, logs.String())
+		}
+		server.Close()
+	}
+}
+
+func TestDownloadPrefixMatchingNothing(t *testing.T) {
+	server := newContentsServer(t, map[string]string{"/Contents-amd64.gz": "usr/bin/ls utils/coreutils\n"})
+	file := filepath.Join(t.TempDir(), "Contents-amd64")
+	if err := os.WriteFile(file, []byte("usr/bin/ls utils/coreutils\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cfg := range []Config{{PathPrefix: "opt/"}, {PackagePrefix: "libs/"}, {PathPrefix: "opt/", File: file}} {
+		cfg.Architecture, cfg.CacheDir, cfg.NoProgress = "amd64", t.TempDir(), true
+		app := NewApp(&cfg, WithLogger(log.New(io.Discard, "", 0)))
+		app.baseURL = server.URL + "/Contents-{arch}.gz"
+		stats, err := app.AnalyzeWithCache(context.Background())
+		if err != nil || len(stats) != 0 {
+			t.Errorf("%+v: got %v, %v, want an empty result", cfg, stats, err)
+		}
+	}
+}
+
+func TestAnalyzeEmptyBodyKeepsCache(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", "broken")
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	cacheFile := dir + "/contents-amd64.json"
+	_ = cache.SaveCache(cacheFile, &cache.CacheEntry{
+		Stats:     []cache.PackageStats{{Name: "cached-pkg", FileCount: 1}},
+		Timestamp: time.Now().UTC(),
+		ETag:      "old",
+	})
+
+	app := NewApp(&Config{Architecture: "amd64", CacheDir: dir, CacheTTL: time.Hour})
+	app.baseURL = server.URL + "/Contents-{arch}.gz"
+	stats, err := app.AnalyzeWithCache(context.Background())
+	if err != nil || len(stats) != 1 || stats[0].Name != "cached-pkg" {
+		t.Fatalf("got %v, %v", stats, err)
+	}
+
+	entry, _ := cache.LoadCache(cacheFile, time.Hour)
+	if entry == nil || entry.ETag != "old" {
+		t.Errorf("empty download should not replace the cache, got %+v", entry)
+	}
+}
+
+// bzip2Contents is "usr/bin/file1 pkg1,pkg2\nusr/lib/file2 pkg1\n" compressed with bzip2 -9
+// (the standard library only ships a bzip2 decoder)
+var bzip2Contents = []byte{
+	0x42, 0x5a, 0x68, 0x39, 0x31, 0x41, 0x59, 0x26, 0x53, 0x59, 0x8e, 0x48,
+	0x07, 0x43, 0x00, 0x00, 0x14, 0xd9, 0x80, 0x00, 0x10, 0x40, 0x04, 0xb0,
+	0x00, 0x13, 0xad, 0x5a, 0x00, 0x20, 0x00, 0x21, 0x2a, 0x7a, 0x93, 0x13,
+	0x4c, 0x3d, 0x29, 0x85, 0x34, 0xc8, 0xc4, 0xc4, 0xc4, 0xa5, 0x44, 0x43,
+	0xbc, 0xf3, 0x84, 0x2d, 0x65, 0x88, 0x72, 0x9b, 0x2f, 0x12, 0xb1, 0x64,
+	0xc8, 0xfc, 0xe1, 0xc3, 0xa2, 0xee, 0x48, 0xa7, 0x0a, 0x12, 0x11, 0xc9,
+	0x00, 0xe8, 0x60,
+}
+
+func TestDownloadCompression(t *testing.T) {
+	plain := "usr/bin/file1 pkg1,pkg2\nusr/lib/file2 pkg1\n"
+
+	var gzBuf bytes.Buffer
+	gz := gzip.NewWriter(&gzBuf)
+	_, _ = gz.Write([]byte(plain))
+	gz.Close()
+
+	var xzBuf bytes.Buffer
+	xw, err := xz.NewWriter(&xzBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = xw.Write([]byte(plain))
+	xw.Close()
+
+	bodies := map[string][]byte{
+		CompressionGzip:  gzBuf.Bytes(),
+		CompressionXZ:    xzBuf.Bytes(),
+		CompressionBzip2: bzip2Contents,
+		CompressionNone:  []byte(plain),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(bodies[strings.Trim(r.URL.Path, "/")])
+	}))
+	defer server.Close()
+
+	for codec := range bodies {
+		for _, flagValue := range []string{codec, CompressionAuto} {
+			if codec == CompressionNone && flagValue == CompressionAuto {
+				continue // plain bodies are only accepted when asked for
+			}
+			app := NewApp(&Config{Architecture: "amd64", CacheDir: t.TempDir(), Compression: flagValue})
+			stats, _, _, err := app.Download(context.Background(), server.URL+"/"+codec, nil)
+			if err != nil {
+				t.Errorf("%s (-compression %s): %v", codec, flagValue, err)
+				continue
+			}
+			if len(stats) != 2 || stats[0].Name != "pkg1" || stats[0].FileCount != 2 {
+				t.Errorf("%s (-compression %s): got %+v", codec, flagValue, stats)
+			}
+		}
+	}
+}
+
+func TestResolveCompression(t *testing.T) {
+	tests := []struct {
+		codec, url, want string
+		explicit         bool
+	}{
+		{CompressionAuto, "http://m/Contents-amd64.gz", CompressionGzip, false},
+		{CompressionAuto, "http://m/Contents-amd64.xz", CompressionXZ, false},
+		{CompressionAuto, "http://m/Contents-amd64.bz2", CompressionBzip2, false},
+		{CompressionAuto, "http://m/Contents-amd64", CompressionAuto, false},
+		{CompressionNone, "http://m/Contents-amd64.gz", CompressionNone, true},
+	}
+	for _, tt := range tests {
+		if got, explicit := resolveCompression(tt.codec, tt.url); got != tt.want || explicit != tt.explicit {
+			t.Errorf("%s %s: got %s (explicit %v), want %s (explicit %v)", tt.codec, tt.url, got, explicit, tt.want, tt.explicit)
+		}
+	}
+
+	app := NewApp(&Config{Architecture: "amd64", Compression: CompressionXZ})
+	if got := app.URL(); !strings.HasSuffix(got, "/Contents-amd64.xz") {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestParseContents(t *testing.T) {
+	stats, err := ParseContents(context.Background(), strings.NewReader("FILE LOCATION\nusr/bin/a pkg1,pkg2\nusr/bin/b pkg1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 2 || stats[0] != (cache.PackageStats{Name: "pkg1", FileCount: 2}) {
+		t.Errorf("got %+v", stats)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ParseContents(ctx, strings.NewReader("usr/bin/a pkg1\n")); err != context.Canceled {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
+
+func TestParseWorkersMatchesSingle(t *testing.T) {
+	// enough lines for several batches plus a partial one, with a header and multi-package lines
+	data := "FILE LOCATION\n" + syntheticContents(120) + strings.Repeat("usr/bin/shared pkg1,pkg2\n", 5000)
+
+	single, err := LineParser{}.ParseWithTotals(context.Background(), strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, workers := range []int{2, 4, 16} {
+		multi, err := LineParser{Workers: workers}.ParseWithTotals(context.Background(), strings.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(multi) != fmt.Sprint(single) {
+			t.Errorf("%d workers: results differ from a single worker", workers)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := (LineParser{Workers: 4}).Parse(ctx, strings.NewReader(data)); err != context.Canceled {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
+
+func BenchmarkParseWorkers(b *testing.B) {
+	data := syntheticContents(1000)
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			p := LineParser{Workers: workers}
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				if _, err := p.Parse(context.Background(), strings.NewReader(data)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// debianPreamble is the header block of the Contents files published before bullseye
+const debianPreamble = `This file maps each file available in the Debian
+GNU/Linux system to the package from which it originates.  It
+includes packages from the DIST distribution for the ARCH
+architecture.
+
+You can use this list to determine which package contains
+a specific file, or whether or not a specific file is
+available.  The list is updated weekly, each Sunday.
+
+FILE                                                    LOCATION
+`
+
+func TestParseContentsHeader(t *testing.T) {
+	data := "usr/bin/a pkg1,pkg2\nusr/bin/b pkg1\n"
+	tests := []struct {
+		name   string
+		input  string
+		legend string
+	}{
+		{"no header", data, ""},
+		{"debian preamble", debianPreamble + data, ""},
+		{"comments", "# generated by mirror\n#\n\n" + data, ""},
+		{"custom legend", "Mirror export\nPATH PACKAGES\n" + data, "PATH PACKAGES"},
+	}
+
+	for _, tt := range tests {
+		stats, err := LineParser{Legend: tt.legend}.Parse(context.Background(), strings.NewReader(tt.input))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if fmt.Sprint(stats) != "[{pkg1 2} {pkg2 1}]" {
+			t.Errorf("%s: got %v", tt.name, stats)
+		}
+	}
+}
+
+func TestParseRealisticHeaderCountsOnlyData(t *testing.T) {
+	// the preamble holds words that would otherwise be split into packages, "FILE_ID.DIZ" is data
+	input := debianPreamble + "FILE_ID.DIZ games/bsdgames\nusr/bin/a pkg1,pkg2\nusr/bin/b pkg1\n"
+
+	for _, workers := range []int{1, 4} {
+		stats, err := LineParser{Workers: workers}.Parse(context.Background(), strings.NewReader(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(stats) != "[{pkg1 2} {games/bsdgames 1} {pkg2 1}]" {
+			t.Errorf("workers=%d: got %v", workers, stats)
+		}
+	}
+
+	got, err := parseLowMemory(context.Background(), strings.NewReader(input), LineParser{}, t.TempDir(), 0)
+	if err != nil || fmt.Sprint(got.Stats) != "[{pkg1 2} {games/bsdgames 1} {pkg2 1}]" {
+		t.Errorf("low memory: got %v, %v", got.Stats, err)
+	}
+}
+
+func TestContentsScannerWithoutLegendKeepsData(t *testing.T) {
+	var sb strings.Builder
+	for i := 0; i < maxHeaderLines+10; i++ {
+		fmt.Fprintf(&sb, "usr/share/doc/file%d pkg%d\n", i, i)
+	}
+
+	scanner := LineParser{}.scanner(strings.NewReader(sb.String()))
+	lines := 0
+	for scanner.Scan() {
+		lines++
+	}
+	if lines != maxHeaderLines+10 {
+		t.Errorf("got %d lines, want %d", lines, maxHeaderLines+10)
+	}
+}
+
+func TestDownloadQuiet(t *testing.T) {
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	fmt.Fprintln(gz, "usr/bin/file1 pkg1")
+	gz.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(body.Bytes())
+	}))
+	defer server.Close()
+
+	// the progress bar draws on os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	app := NewApp(&Config{Architecture: "amd64", CacheDir: t.TempDir(), Quiet: true})
+	stats, _, _, err := app.Download(context.Background(), server.URL, nil)
+	w.Close()
+	written, _ := io.ReadAll(r)
+
+	if err != nil || len(stats) != 1 {
+		t.Fatalf("download should still work: %v, %v", stats, err)
+	}
+	if len(written) != 0 {
+		t.Errorf("quiet download wrote %q to stdout", written)
+	}
+	if l, ok := app.logger.(*log.Logger); !ok || l.Writer() != io.Discard {
+		t.Error("quiet should discard the logger output")
+	}
+}
+
+func TestDownloadResumesPartial(t *testing.T) {
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	for i := 0; i < 50; i++ {
+		fmt.Fprintf(gz, "usr/share/doc/file%d pkg%d\n", i, i%5)
+	}
+	gz.Close()
+	data := body.Bytes()
+
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", "v1")
+		if r.Method == http.MethodHead {
+			return
+		}
+		ranges = append(ranges, r.Header.Get("Range"))
+		var start int
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &start); err == nil && r.Header.Get("If-Range") == "v1" {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(data)-1, len(data)))
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write(data[start:])
+			return
+		}
+		// first attempt: drop the connection halfway through
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		_, _ = w.Write(data[:len(data)/2])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	defer server.Close()
+
+	// a single attempt leaves the partial for the next run instead of resuming it right away
+	app := NewApp(&Config{Architecture: "amd64", CacheDir: t.TempDir(), MaxRetries: 1, NoProgress: true}, WithLogger(log.New(io.Discard, "", 0)))
+	partial := app.CacheFile() + ".partial"
+
+	if _, _, _, err := app.Download(context.Background(), server.URL, nil); err == nil {
+		t.Fatal("interrupted download should fail")
+	}
+	if info, err := os.Stat(partial); err != nil || info.Size() != int64(len(data)/2) {
+		t.Fatalf("partial should keep the received bytes: %v, %v", info, err)
+	}
+
+	stats, etag, _, err := app.Download(context.Background(), server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 5 || stats[0].FileCount != 10 || etag != "v1" {
+		t.Errorf("got %v, etag %q", stats, etag)
+	}
+	if want := fmt.Sprintf("bytes=%d-", len(data)/2); ranges[len(ranges)-1] != want {
+		t.Errorf("got Range %q, want %q", ranges[len(ranges)-1], want)
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Error("partial should be removed once parsed")
+	}
+}
+
+func TestDownloadResumeFallsBackToFull(t *testing.T) {
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	fmt.Fprintln(gz, "usr/bin/file1 pkg1")
+	gz.Close()
+
+	var gotRange string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		// the file changed since the partial was started, If-Range doesn't match
+		gotRange = r.Header.Get("Range")
+		w.Header().Set("ETag", "v2")
+		_, _ = w.Write(body.Bytes())
+	}))
+	defer server.Close()
+
+	app := NewApp(&Config{Architecture: "amd64", CacheDir: t.TempDir(), NoProgress: true}, WithLogger(log.New(io.Discard, "", 0)))
+	partial := app.CacheFile() + ".partial"
+	if err := os.WriteFile(partial, []byte("stale bytes"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(partial+".etag", []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, etag, _, err := app.Download(context.Background(), server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotRange != "bytes=11-" {
+		t.Errorf("expected a resume attempt, got Range %q", gotRange)
+	}
+	if len(stats) != 1 || stats[0].Name != "pkg1" || etag != "v2" {
+		t.Errorf("a 200 should replace the partial, got %v, etag %q", stats, etag)
+	}
+}
+
+func TestDownloadResumeSkipsHEAD(t *testing.T) {
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(gz, "usr/share/doc/file%d pkg%d\n", i, i%2)
+	}
+	gz.Close()
+	data := body.Bytes()
+	half := len(data) / 2
+
+	for _, tt := range []struct {
+		name       string
+		remoteETag string
+		wantStatus int
+	}{
+		{"unchanged", "v1", http.StatusPartialContent},
+		{"changed", "v2", http.StatusOK},
+	} {
+		var requests []string
+		var status int
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests = append(requests, r.Method)
+			w.Header().Set("ETag", tt.remoteETag)
+			if r.Header.Get("If-Range") == tt.remoteETag {
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", half, len(data)-1, len(data)))
+				status = http.StatusPartialContent
+				w.WriteHeader(status)
+				_, _ = w.Write(data[half:])
+				return
+			}
+			status = http.StatusOK
+			_, _ = w.Write(data)
+		}))
+
+		app := NewApp(&Config{Architecture: "amd64", CacheDir: t.TempDir(), NoProgress: true}, WithLogger(log.New(io.Discard, "", 0)))
+		partial := app.CacheFile() + ".partial"
+		// the changed remote file must not be glued onto these bytes
+		prefix := data[:half]
+		if tt.remoteETag != "v1" {
+			prefix = bytes.Repeat([]byte{0}, half)
+		}
+		if err := os.WriteFile(partial, prefix, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(partial+".etag", []byte("v1"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		stats, etag, _, err := app.Download(context.Background(), server.URL, nil)
+		server.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if fmt.Sprint(requests) != "[GET]" || status != tt.wantStatus {
+			t.Errorf("%s: want a single GET answered with %d, got %v answered with %d", tt.name, tt.wantStatus, requests, status)
+		}
+		if len(stats) != 2 || stats[0].FileCount != 10 || etag != tt.remoteETag {
+			t.Errorf("%s: got %v, etag %q", tt.name, stats, etag)
+		}
+		if _, err := os.Stat(partial); !os.IsNotExist(err) {
+			t.Errorf("%s: partial should be removed once parsed", tt.name)
+		}
+	}
+}
+
+func TestGetRequestWithRetryServerErrors(t *testing.T) {
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	for _, n := range []int{1, 3, 5} {
+		attempts.Store(0)
+		policy := RetryPolicy{MaxRetries: n, BaseDelay: time.Millisecond, Jitter: true}
+		resp, err := GetRequestWithRetry(context.Background(), server.Client(), server.URL, nil, 0, policy, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusInternalServerError || int(attempts.Load()) != n {
+			t.Errorf("max %d: got status %d after %d attempts", n, resp.StatusCode, attempts.Load())
+		}
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	if d := (RetryPolicy{}).delay(2); d != 4*time.Second {
+		t.Errorf("default delay should stay 1<<i seconds, got %v", d)
+	}
+	policy := RetryPolicy{BaseDelay: 100 * time.Millisecond, Jitter: true}
+	for i := 0; i < 20; i++ {
+		if d := policy.delay(1); d < 100*time.Millisecond || d >= 200*time.Millisecond {
+			t.Fatalf("jittered delay %v outside [100ms, 200ms)", d)
+		}
+	}
+	for _, i := range []int{5, 33, 64, 1000} {
+		if d := (RetryPolicy{}).delay(i); d != MaxRetryDelay {
+			t.Errorf("attempt %d: got %v, want the %v cap", i, d, MaxRetryDelay)
+		}
+		if d := (RetryPolicy{Jitter: true}).delay(i); d < MaxRetryDelay/2 || d > MaxRetryDelay {
+			t.Errorf("attempt %d: jittered delay %v outside the capped range", i, d)
+		}
+	}
+}
+
+func TestGetRequestWithRetryRetryableStatus(t *testing.T) {
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) <= 2 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	// Retry-After: 0 overrides the hour long backoff
+	policy := RetryPolicy{BaseDelay: time.Hour}
+	resp, err := GetRequestWithRetry(context.Background(), server.Client(), server.URL, nil, 0, policy, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || attempts.Load() != 3 {
+		t.Errorf("got status %d after %d attempts", resp.StatusCode, attempts.Load())
+	}
+}
+
+func TestGetRequestWithRetryBailsOnClientError(t *testing.T) {
+	for _, status := range []int{http.StatusBadRequest, http.StatusNotFound} {
+		var attempts atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts.Add(1)
+			w.WriteHeader(status)
+		}))
+
+		resp, err := GetRequestWithRetry(context.Background(), server.Client(), server.URL, nil, 0, RetryPolicy{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		server.Close()
+		if resp.StatusCode != status || attempts.Load() != 1 {
+			t.Errorf("%d: got status %d after %d attempts", status, resp.StatusCode, attempts.Load())
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	tests := []struct {
+		header string
+		want   time.Duration
+		ok     bool
+	}{
+		{"", 0, false},
+		{"3", 3 * time.Second, true},
+		{now.Add(10 * time.Second).Format(http.TimeFormat), 10 * time.Second, true},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0, true},
+		{"86400", maxRetryAfter, true},
+		{"soon", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := retryAfter(tt.header, now)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%q: got %v, %v", tt.header, got, ok)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// Log formats
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// jsonLogger writes every Printf as one JSON object tagged with the architecture.
+type jsonLogger struct {
+	l    *slog.Logger
+	arch string
+}
+
+/*
+NewJSONLogger returns a Logger writing one JSON object per event to w
+output: {"time":"2024-01-02T15:04:05Z","level":"INFO","msg":"Download completed","arch":"amd64","bytes":1048576}
+failures and retries are logged at WARN or ERROR, download progress carries the byte count (see logAt)
+*/
+func NewJSONLogger(w io.Writer, arch string) Logger {
+	return &jsonLogger{l: slog.New(slog.NewJSONHandler(w, nil)), arch: arch}
+}
+
+// Printf formats the message like log.Printf and logs it at info level
+func (j *jsonLogger) Printf(format string, v ...interface{}) {
+	j.log(slog.LevelInfo, nil, fmt.Sprintf(format, v...))
+}
+
+// log writes msg at level with the arch tag and the key/value pairs in attrs
+func (j *jsonLogger) log(level slog.Level, attrs []any, msg string) {
+	j.l.Log(context.Background(), level, msg, append([]any{"arch", j.arch}, attrs...)...)
+}
+
+// logAt logs like logger.Printf, the JSON logger also records level and the key/value pairs in attrs
+// text loggers only get the message, which should already carry what attrs hold
+func logAt(logger Logger, level slog.Level, attrs []any, format string, v ...interface{}) {
+	if j, ok := logger.(*jsonLogger); ok {
+		j.log(level, attrs, fmt.Sprintf(format, v...))
+		return
+	}
+	logger.Printf(format, v...)
+}
+
+// withArch returns a copy of logger tagged with arch, text loggers are returned as is
+func withArch(logger Logger, arch string) Logger {
+	if j, ok := logger.(*jsonLogger); ok {
+		return &jsonLogger{l: j.l, arch: arch}
+	}
+	return logger
+}
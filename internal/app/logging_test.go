@@ -0,0 +1,93 @@
+package app
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestJSONLogger(t *testing.T) {
+	var out bytes.Buffer
+	logger := NewJSONLogger(&out, "amd64")
+	logger.Printf("Downloaded %d bytes", 42)
+	withArch(logger, "arm64").Printf("second")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("want one object per event, got %q", out.String())
+	}
+	var first, second map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &first); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &second); err != nil {
+		t.Fatal(err)
+	}
+	if first["level"] != "INFO" || first["msg"] != "Downloaded 42 bytes" || first["arch"] != "amd64" {
+		t.Errorf("got %v", first)
+	}
+	if second["arch"] != "arm64" {
+		t.Errorf("withArch should retag the logger, got %v", second)
+	}
+}
+
+func TestNewAppLogFormat(t *testing.T) {
+	app := NewApp(&Config{Architecture: "amd64", LogFormat: LogFormatJSON})
+	if _, ok := app.logger.(*jsonLogger); !ok {
+		t.Errorf("got %T, want the JSON logger", app.logger)
+	}
+}
+
+func TestJSONLoggerDownloadEvents(t *testing.T) {
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	fmt.Fprintln(gz, "usr/bin/file1 pkg1,pkg2")
+	gz.Close()
+	var gets atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && gets.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write(body.Bytes())
+	}))
+	defer server.Close()
+
+	var out bytes.Buffer
+	app := NewApp(&Config{Architecture: "amd64", CacheDir: t.TempDir(), NoProgress: true, RetryBaseDelay: time.Millisecond},
+		WithLogger(NewJSONLogger(&out, "amd64")))
+	if _, _, _, err := app.Download(context.Background(), server.URL, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var retry, done map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var event map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		if event["arch"] != "amd64" {
+			t.Errorf("untagged event %v", event)
+		}
+		switch msg, _ := event["msg"].(string); {
+		case strings.HasPrefix(msg, "GET attempt 1/3 failed"):
+			retry = event
+		case msg == "Download completed":
+			done = event
+		}
+	}
+	if retry == nil || retry["level"] != "WARN" {
+		t.Errorf("want the failed attempt at WARN, got %v", retry)
+	}
+	if done == nil || done["level"] != "INFO" || done["bytes"] != float64(body.Len()) {
+		t.Errorf("want the completed download at INFO with %d bytes, got %v", body.Len(), done)
+	}
+}
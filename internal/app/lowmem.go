@@ -0,0 +1,136 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/canonical-dev/package_statistics/internal/cache"
+)
+
+// lowMemoryShards is the number of on-disk partitions used by low-memory parsing
+const lowMemoryShards = 64
+
+/*
+parseLowMemory counts packages without holding the whole counts map in RAM.
+
+Step 1: Spill every package occurrence to a shard file picked by hash(name)
+Step 2: Count one shard at a time - a package only ever lives in one shard
+Step 3: Merge each shard's counts into a running top-N (all packages if top <= 0)
+
+Peak memory is bounded by the largest shard plus the top-N slice.
+The totals still count every package, not only the ones kept.
+*/
+func parseLowMemory(ctx context.Context, r io.Reader, parser LineParser, dir string, top int) (ParseResult, error) {
+	spillDir, err := os.MkdirTemp(dir, "spill-*")
+	if err != nil {
+		return ParseResult{}, fmt.Errorf("create spill dir: %w", err)
+	}
+	defer os.RemoveAll(spillDir)
+
+	files, err := spillShards(ctx, r, parser, spillDir)
+	if err != nil {
+		return ParseResult{}, err
+	}
+
+	var result []cache.PackageStats
+	totals := Totals{Files: files}
+	for i := 0; i < lowMemoryShards; i++ {
+		if ctx.Err() != nil {
+			return ParseResult{}, ctx.Err()
+		}
+		counts, err := countShard(shardPath(spillDir, i))
+		if err != nil {
+			return ParseResult{}, err
+		}
+		// a package only ever lives in one shard
+		totals.Packages += len(counts)
+		result = append(result, RankMap(counts, top)...)
+		SortStats(result, false)
+		if top > 0 && len(result) > top {
+			result = result[:top]
+		}
+	}
+	return ParseResult{Stats: result, Totals: totals}, nil
+}
+
+// spillShards writes each package name on its own line into the shard owning it
+// and returns how many it wrote, the file entries of the parse
+func spillShards(ctx context.Context, r io.Reader, parser LineParser, dir string) (int, error) {
+	files := make([]*os.File, lowMemoryShards)
+	writers := make([]*bufio.Writer, lowMemoryShards)
+	defer func() {
+		for _, f := range files {
+			if f != nil {
+				_ = f.Close()
+			}
+		}
+	}()
+	for i := range files {
+		f, err := os.Create(shardPath(dir, i))
+		if err != nil {
+			return 0, err
+		}
+		files[i] = f
+		writers[i] = bufio.NewWriter(f)
+	}
+
+	var werr error
+	spilled := 0
+	scanner := parser.scanner(r)
+	lineCount := 0
+	for scanner.Scan() {
+		// Check for cancellation every 1000 lines for responsiveness
+		if lineCount%1000 == 0 && ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		parser.forEachKey(scanner.Text(), func(pkg string) {
+			h := fnv.New32a()
+			_, _ = h.Write([]byte(pkg))
+			w := writers[h.Sum32()%lowMemoryShards]
+			if _, err := w.WriteString(pkg + "\n"); err != nil && werr == nil {
+				werr = err
+			}
+			spilled++
+		})
+		if werr != nil {
+			return 0, werr
+		}
+		lineCount++
+	}
+	if scanner.Err() != nil {
+		return 0, scanner.Err()
+	}
+
+	for _, w := range writers {
+		if err := w.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	return spilled, nil
+}
+
+// countShard loads a single shard into a counts map
+func countShard(file string) (map[string]int, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	counts := make(map[string]int)
+	scanner := newContentsScanner(f)
+	for scanner.Scan() {
+		counts[scanner.Text()]++
+	}
+	return counts, scanner.Err()
+}
+
+// shardPath returns the file path of shard i
+func shardPath(dir string, i int) string {
+	return filepath.Join(dir, fmt.Sprintf("shard-%02d", i))
+}
@@ -0,0 +1,116 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// syntheticContents builds a contents file where pkgN owns N+1 files
+func syntheticContents(packages int) string {
+	var sb strings.Builder
+	for i := 0; i < packages; i++ {
+		for j := 0; j <= i; j++ {
+			fmt.Fprintf(&sb, "usr/share/pkg%d/file%d section/pkg%d\n", i, j, i)
+		}
+	}
+	return sb.String()
+}
+
+func TestParseLowMemoryMatchesInMemory(t *testing.T) {
+	data := syntheticContents(200)
+
+	counts := make(map[string]int)
+	for _, line := range strings.Split(data, "\n") {
+		ProcessLine(line, counts, "")
+	}
+	want := SortMap(counts)
+
+	res, err := parseLowMemory(context.Background(), strings.NewReader(data), LineParser{}, t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := res.Stats
+	if len(got) != len(want) {
+		t.Fatalf("got %d packages, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("row %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestParseLowMemoryTopN(t *testing.T) {
+	data := syntheticContents(50)
+
+	res, err := parseLowMemory(context.Background(), strings.NewReader(data), LineParser{}, t.TempDir(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := res.Stats
+	if len(got) != 3 {
+		t.Fatalf("got %d packages", len(got))
+	}
+	if got[0].Name != "section/pkg49" || got[0].FileCount != 50 || got[2].Name != "section/pkg47" {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestParseLowMemoryCleansUp(t *testing.T) {
+	dir := t.TempDir()
+	_, err := parseLowMemory(context.Background(), bytes.NewReader([]byte("usr/bin/a pkg1\n")), LineParser{}, dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Errorf("spill dir not removed: %v", entries)
+	}
+}
+
+func TestParseLowMemoryTiesByName(t *testing.T) {
+	// five packages with two files each, the cut at -top 3 must not depend on shard or map order
+	var sb strings.Builder
+	for _, name := range []string{"echo", "bravo", "delta", "alpha", "charlie"} {
+		fmt.Fprintf(&sb, "usr/share/%[1]s/a %[1]s\nusr/share/%[1]s/b %[1]s\n", name)
+	}
+
+	res, err := parseLowMemory(context.Background(), strings.NewReader(sb.String()), LineParser{}, t.TempDir(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := res.Stats
+	if len(got) != 3 || got[0].Name != "alpha" || got[1].Name != "bravo" || got[2].Name != "charlie" {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestLowMemoryFooterCountsEveryPackage(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "Contents-amd64")
+	if err := os.WriteFile(file, []byte(syntheticContents(5)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{File: file, CacheDir: t.TempDir(), LowMemory: true, TopCount: 2, Format: FormatText}
+	app := NewApp(cfg, WithLogger(log.New(io.Discard, "", 0)))
+
+	res, err := app.Analyze(context.Background())
+	if err != nil || len(res.Stats) != 2 {
+		t.Fatalf("got %+v, %v", res, err)
+	}
+	var buf bytes.Buffer
+	if err := PrintResultsWithTotals(&buf, res.Stats, res.Totals, cfg); err != nil {
+		t.Fatal(err)
+	}
+	// 1+2+3+4+5 files over 5 packages, not the 9 files of the 2 kept
+	if !strings.HasSuffix(buf.String(), "\nParsed 15 file entries across 5 packages\n") {
+		t.Errorf("footer should count the whole parse:\n%s", buf.String())
+	}
+}
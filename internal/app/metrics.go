@@ -0,0 +1,158 @@
+package app
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// MetricsPath is where the metrics server exposes its registry.
+const MetricsPath = "/metrics"
+
+// metricsShutdownTimeout bounds how long Shutdown waits for in-flight scrapes
+const metricsShutdownTimeout = 5 * time.Second
+
+/*
+Metrics holds the Prometheus collectors updated by AnalyzeWithCache and Download,
+every series is labeled with the architecture.
+
+A nil *Metrics records nothing, so an App without -metrics-addr doesn't need to check.
+*/
+type Metrics struct {
+	registry         *prometheus.Registry
+	downloadDuration *prometheus.HistogramVec
+	downloadedBytes  *prometheus.CounterVec
+	parseDuration    *prometheus.HistogramVec
+	packages         *prometheus.GaugeVec
+	cacheHits        *prometheus.CounterVec
+	cacheMisses      *prometheus.CounterVec
+}
+
+// NewMetrics creates the collectors on a dedicated registry
+func NewMetrics() *Metrics {
+	labels := []string{"arch"}
+	// contents files take seconds to minutes to fetch and parse
+	buckets := prometheus.ExponentialBuckets(0.5, 2, 10)
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		downloadDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "package_statistics_download_duration_seconds",
+			Help:    "Time spent downloading contents files.",
+			Buckets: buckets,
+		}, labels),
+		downloadedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "package_statistics_downloaded_bytes_total",
+			Help: "Bytes of contents files downloaded.",
+		}, labels),
+		parseDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "package_statistics_parse_duration_seconds",
+			Help:    "Time spent parsing downloaded contents files.",
+			Buckets: buckets,
+		}, labels),
+		packages: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "package_statistics_packages",
+			Help: "Packages returned by the last analysis.",
+		}, labels),
+		cacheHits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "package_statistics_cache_hits_total",
+			Help: "Analyses served from the cached data.",
+		}, labels),
+		cacheMisses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "package_statistics_cache_misses_total",
+			Help: "Analyses that downloaded new data.",
+		}, labels),
+	}
+	m.registry.MustRegister(m.downloadDuration, m.downloadedBytes, m.parseDuration, m.packages, m.cacheHits, m.cacheMisses)
+	return m
+}
+
+// WithMetrics makes the App record its downloads, parses and cache use in m.
+func WithMetrics(m *Metrics) Option {
+	return func(a *App) {
+		a.metrics = m
+	}
+}
+
+// Handler serves the metrics in the Prometheus text format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+/*
+Serve starts an HTTP server exposing the metrics on addr at MetricsPath.
+
+The listener is opened before returning so a bad or busy address fails here,
+requests are then served in the background until Shutdown.
+*/
+func (m *Metrics) Serve(addr string) (*MetricsServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(MetricsPath, m.Handler())
+	s := &MetricsServer{srv: &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}, addr: ln.Addr()}
+	// Serve only returns once Shutdown closes the listener
+	go func() { _ = s.srv.Serve(ln) }()
+	return s, nil
+}
+
+// MetricsServer is the HTTP server started by Metrics.Serve.
+type MetricsServer struct {
+	srv  *http.Server
+	addr net.Addr
+}
+
+// Addr returns the address the server listens on, useful with a ":0" addr
+func (s *MetricsServer) Addr() string {
+	return s.addr.String()
+}
+
+// Shutdown stops accepting scrapes and waits up to metricsShutdownTimeout for the running ones
+func (s *MetricsServer) Shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), metricsShutdownTimeout)
+	defer cancel()
+	return s.srv.Shutdown(ctx)
+}
+
+// observeDownload records a finished transfer
+func (m *Metrics) observeDownload(arch string, d time.Duration, bytes int64) {
+	if m == nil {
+		return
+	}
+	m.downloadDuration.WithLabelValues(arch).Observe(d.Seconds())
+	m.downloadedBytes.WithLabelValues(arch).Add(float64(bytes))
+}
+
+// observeParse records how long parsing a downloaded file took
+func (m *Metrics) observeParse(arch string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.parseDuration.WithLabelValues(arch).Observe(d.Seconds())
+}
+
+// observePackages records the package count returned by an analysis
+func (m *Metrics) observePackages(arch string, packages int) {
+	if m == nil {
+		return
+	}
+	m.packages.WithLabelValues(arch).Set(float64(packages))
+}
+
+// observeCache counts an analysis as a cache hit when its results were served from the cache, a miss when they were downloaded
+// an unchanged download is still a miss, a failed one falling back to the cache a hit
+func (m *Metrics) observeCache(arch string, fromCache bool) {
+	if m == nil {
+		return
+	}
+	if fromCache {
+		m.cacheHits.WithLabelValues(arch).Inc()
+	} else {
+		m.cacheMisses.WithLabelValues(arch).Inc()
+	}
+}
@@ -0,0 +1,136 @@
+package app
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMetricsRecordedByAnalysis(t *testing.T) {
+	server := newContentsServer(t, map[string]string{
+		"/Contents-amd64.gz": "usr/bin/a pkg1\nusr/bin/b pkg1\nusr/bin/c pkg2\n",
+	})
+
+	metrics := NewMetrics()
+	srv, err := metrics.Serve("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown()
+
+	cfg := &Config{Architecture: "amd64", CacheDir: t.TempDir(), CacheTTL: time.Hour, ShortCacheWindow: time.Hour, NoProgress: true}
+	app := NewApp(cfg, WithMetrics(metrics))
+	app.baseURL = server.URL + "/Contents-{arch}.gz"
+
+	// the first run downloads, the second is served by the short cache window
+	for i := 0; i < 2; i++ {
+		if _, err := app.AnalyzeWithCache(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, err := http.Get("http://" + srv.Addr() + MetricsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	for _, want := range []string{
+		`package_statistics_cache_misses_total{arch="amd64"} 1`,
+		`package_statistics_cache_hits_total{arch="amd64"} 1`,
+		`package_statistics_packages{arch="amd64"} 2`,
+		`package_statistics_download_duration_seconds_count{arch="amd64"} 1`,
+		`package_statistics_parse_duration_seconds_count{arch="amd64"} 1`,
+		`package_statistics_downloaded_bytes_total{arch="amd64"} `,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("missing %q in:\n%s", want, body)
+		}
+	}
+
+	if err := srv.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := http.Get("http://" + srv.Addr() + MetricsPath); err == nil {
+		t.Error("server should be stopped after Shutdown")
+	}
+}
+
+func TestMetricsServeBadAddr(t *testing.T) {
+	if _, err := NewMetrics().Serve("bad-address"); err == nil {
+		t.Error("an invalid address should fail before serving")
+	}
+}
+
+func TestMetricsCacheHitsFollowFromCache(t *testing.T) {
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	_, _ = gz.Write([]byte("usr/bin/a pkg1\n"))
+	gz.Close()
+	var fail atomic.Bool
+	// no HEAD and an If-None-Match the server ignores, so an unchanged file is downloaded again
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodHead:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		case fail.Load():
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.Header().Set("ETag", `"v1"`)
+			_, _ = w.Write(body.Bytes())
+		}
+	}))
+	defer server.Close()
+
+	metrics := NewMetrics()
+	srv, err := metrics.Serve("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown()
+	cfg := &Config{Architecture: "amd64", CacheDir: t.TempDir(), CacheTTL: time.Hour, NoProgress: true}
+	app := NewApp(cfg, WithMetrics(metrics), WithLogger(log.New(io.Discard, "", 0)))
+	app.baseURL = server.URL + "/Contents-{arch}.gz"
+
+	// downloaded, downloaded again unchanged, then served from the cache after a failed download
+	for i, want := range []bool{false, false, true} {
+		fail.Store(i == 2)
+		res, err := app.Analyze(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.FromCache != want {
+			t.Fatalf("run %d: got FromCache %v", i, res.FromCache)
+		}
+	}
+	resp, err := http.Get("http://" + srv.Addr() + MetricsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	scraped, _ := io.ReadAll(resp.Body)
+	for _, want := range []string{
+		`package_statistics_cache_misses_total{arch="amd64"} 2`,
+		`package_statistics_cache_hits_total{arch="amd64"} 1`,
+	} {
+		if !strings.Contains(string(scraped), want) {
+			t.Errorf("missing %q in:\n%s", want, scraped)
+		}
+	}
+}
+
+func TestNilMetricsRecordNothing(t *testing.T) {
+	var m *Metrics
+	m.observeDownload("amd64", time.Second, 1)
+	m.observeParse("amd64", time.Second)
+	m.observePackages("amd64", 1)
+	m.observeCache("amd64", true)
+}
@@ -0,0 +1,126 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// KnownMirrors lists the Debian mirrors probed by detect-mirror when none are given.
+var KnownMirrors = []string{
+	DefaultMirror,
+	"http://deb.debian.org/debian",
+	"http://ftp.us.debian.org/debian",
+	"http://ftp.de.debian.org/debian",
+	"http://ftp.fr.debian.org/debian",
+	"http://ftp.nl.debian.org/debian",
+	"http://ftp.jp.debian.org/debian",
+	"http://ftp.au.debian.org/debian",
+}
+
+const (
+	// defaultProbeConcurrency bounds how many mirrors are probed at once
+	defaultProbeConcurrency = 4
+	// defaultProbeTimeout bounds each probe when -request-timeout is not set
+	defaultProbeTimeout = 5 * time.Second
+	// probeArchitecture is the Contents file probed when no architecture is configured
+	probeArchitecture = "amd64"
+)
+
+// MirrorLatency holds the outcome of probing a single mirror.
+type MirrorLatency struct {
+	Mirror  string
+	Latency time.Duration
+	Err     error
+}
+
+/*
+ProbeMirrors HEADs the Contents file on every mirror and returns them fastest first.
+
+Each probe gets its own timeout (-request-timeout, 5s if unset) and at most
+defaultProbeConcurrency run at once. Mirrors that fail or don't have the file are listed last.
+*/
+func (a *App) ProbeMirrors(ctx context.Context, mirrors []string) []MirrorLatency {
+	cfg := *a.cfg
+	if cfg.Architecture == "" {
+		cfg.Architecture = probeArchitecture
+	}
+	timeout := cfg.RequestTimeout
+	if timeout <= 0 {
+		timeout = defaultProbeTimeout
+	}
+
+	results := make([]MirrorLatency, len(mirrors))
+	sem := make(chan struct{}, defaultProbeConcurrency)
+	var wg sync.WaitGroup
+	for i, mirror := range mirrors {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i].Mirror = mirror
+
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				results[i].Err = ctx.Err()
+				return
+			}
+			defer func() { <-sem }()
+
+			probe := &App{cfg: &cfg, baseURL: mirrorURL(mirror)}
+			start := time.Now()
+			resp, err := HeadRequest(ctx, a.client, probe.URL(), nil, timeout)
+			results[i].Latency = time.Since(start)
+			if err != nil {
+				results[i].Err = err
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				results[i].Err = fmt.Errorf("HTTP %d", resp.StatusCode)
+			}
+		}()
+	}
+	wg.Wait()
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if (results[i].Err == nil) != (results[j].Err == nil) {
+			return results[i].Err == nil
+		}
+		return results[i].Latency < results[j].Latency
+	})
+	return results
+}
+
+// PrintMirrorLatencies displays the probed mirrors fastest first and suggests the best one
+func PrintMirrorLatencies(w io.Writer, results []MirrorLatency) {
+	fmt.Fprintf(w, "%-5s %-45s %s\n", "Rank", "Mirror", "Latency")
+	for i, r := range results {
+		if r.Err != nil {
+			fmt.Fprintf(w, "%-5d %-45s error: %v\n", i+1, r.Mirror, r.Err)
+			continue
+		}
+		fmt.Fprintf(w, "%-5d %-45s %v\n", i+1, r.Mirror, r.Latency.Round(time.Millisecond))
+	}
+	if len(results) > 0 && results[0].Err == nil {
+		fmt.Fprintf(w, "\nFastest: %s (use -mirror %s)\n", results[0].Mirror, results[0].Mirror)
+	}
+}
+
+// RunDetectMirror probes cfg.Args (KnownMirrors if empty) and prints them fastest first
+func (a *App) RunDetectMirror(ctx context.Context, w io.Writer) error {
+	mirrors := a.cfg.Args
+	if len(mirrors) == 0 {
+		mirrors = KnownMirrors
+	}
+	results := a.ProbeMirrors(ctx, mirrors)
+	PrintMirrorLatencies(w, results)
+	if results[0].Err != nil {
+		return fmt.Errorf("no mirror reachable")
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// delayedMirror serves the amd64 stable Contents file after delay
+func delayedMirror(t *testing.T, delay time.Duration) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		if r.URL.Path != "/debian/dists/stable/main/Contents-amd64.gz" {
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server.URL + "/debian"
+}
+
+func TestProbeMirrorsSortsFastestFirst(t *testing.T) {
+	slow := delayedMirror(t, 80*time.Millisecond)
+	fast := delayedMirror(t, 0)
+	medium := delayedMirror(t, 40*time.Millisecond)
+	missing := delayedMirror(t, 0) + "/wrong/"
+
+	app := NewApp(&Config{})
+	results := app.ProbeMirrors(context.Background(), []string{slow, missing, fast, medium})
+
+	var order []string
+	for _, r := range results {
+		order = append(order, r.Mirror)
+	}
+	want := []string{fast, medium, slow, missing}
+	if strings.Join(order, " ") != strings.Join(want, " ") {
+		t.Errorf("got %v, want %v", order, want)
+	}
+	if results[3].Err == nil {
+		t.Error("missing Contents file should be an error")
+	}
+	if results[1].Latency < 40*time.Millisecond {
+		t.Errorf("got latency %v for the delayed mirror", results[1].Latency)
+	}
+}
+
+func TestProbeMirrorsTimeout(t *testing.T) {
+	stuck := delayedMirror(t, 500*time.Millisecond)
+
+	app := NewApp(&Config{RequestTimeout: 50 * time.Millisecond})
+	results := app.ProbeMirrors(context.Background(), []string{stuck})
+	if results[0].Err == nil || results[0].Latency > 400*time.Millisecond {
+		t.Errorf("probe should time out, got %+v", results[0])
+	}
+}
+
+func TestRunDetectMirror(t *testing.T) {
+	fast := delayedMirror(t, 0)
+
+	var buf bytes.Buffer
+	app := NewApp(&Config{Args: []string{fast}})
+	if err := app.RunDetectMirror(context.Background(), &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "Fastest: "+fast) {
+		t.Errorf("got:\n%s", buf.String())
+	}
+}
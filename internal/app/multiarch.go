@@ -0,0 +1,271 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/canonical-dev/package_statistics/internal/cache"
+)
+
+// KnownArchitectures lists the binary architectures published for Debian stable.
+var KnownArchitectures = []string{
+	"amd64", "arm64", "armel", "armhf", "i386", "mips64el", "ppc64el", "riscv64", "s390x",
+}
+
+// OtherArchitectures are valid architecture arguments besides KnownArchitectures:
+// the architecture-independent and source indexes, and the ports served by debian-ports mirrors.
+var OtherArchitectures = []string{
+	"all", "source",
+	"alpha", "hppa", "hurd-amd64", "hurd-i386", "loong64", "m68k", "powerpc", "ppc64", "sh4", "sparc64", "x32",
+}
+
+// ValidArchitecture reports whether arch is a known architecture, see -allow-unknown-arch for the rest
+func ValidArchitecture(arch string) bool {
+	return slices.Contains(KnownArchitectures, arch) || slices.Contains(OtherArchitectures, arch)
+}
+
+// defaultArchConcurrency bounds how many architectures are fetched at once
+const defaultArchConcurrency = 4
+
+// ArchResult holds the outcome of analyzing a single architecture.
+type ArchResult struct {
+	Architecture string
+	Stats        []PackageStats
+	// Raw holds the counts before any prefix, filter, cleaning or -min-count, what -combined merges
+	Raw []PackageStats
+	// Totals is what the parse counted, see Result.Totals
+	Totals Totals
+	Err    error
+}
+
+/*
+AnalyzeArchitectures runs Analyze for every architecture, at most cfg.ArchConcurrency at once.
+
+Each architecture keeps its own cache file and lock, so a failure in one doesn't abort the others.
+Every fetch gets its own context derived from ctx, cancelling ctx (Ctrl+C) stops them all.
+Per-download progress bars are replaced by one log line per finished architecture.
+Results are returned in the same order as arches.
+*/
+func (a *App) AnalyzeArchitectures(ctx context.Context, arches []string) []ArchResult {
+	results := make([]ArchResult, len(arches))
+	concurrency := a.cfg.ArchConcurrency
+	if concurrency < 1 {
+		concurrency = defaultArchConcurrency
+	}
+	sem := make(chan struct{}, concurrency)
+	var done int32
+	var wg sync.WaitGroup
+
+	for i, arch := range arches {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i].Architecture = arch
+
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				results[i].Err = ctx.Err()
+				return
+			}
+			defer func() { <-sem }()
+
+			archCtx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			res, raw, err := a.forArch(arch).analyze(archCtx)
+			results[i].Stats, results[i].Raw, results[i].Totals, results[i].Err = res.Stats, raw, res.Totals, err
+
+			n := atomic.AddInt32(&done, 1)
+			if results[i].Err != nil {
+				// main reports the error itself, also under -quiet
+				logAt(a.logger, slog.LevelError, nil, "[%d/%d] %s failed", n, len(arches), arch)
+			} else {
+				a.logger.Printf("[%d/%d] %s done (%d packages)", n, len(arches), arch, len(results[i].Stats))
+			}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// forArch returns a copy of the app configured for a single architecture
+func (a *App) forArch(arch string) *App {
+	cfg := *a.cfg
+	cfg.Architecture = arch
+	cfg.NoProgress = true
+	return &App{client: a.client, cfg: &cfg, logger: withArch(a.logger, arch), baseURL: a.baseURL, metrics: a.metrics, clock: a.clock}
+}
+
+/*
+MergeStats sums file counts of packages across several result sets
+input: [{pkg1 2} {pkg2 1}], [{pkg1 3}]
+output: [{pkg1 5} {pkg2 1}]
+*/
+func MergeStats(sets ...[]cache.PackageStats) []cache.PackageStats {
+	counts := make(map[string]int)
+	for _, stats := range sets {
+		for _, s := range stats {
+			counts[s.Name] += s.FileCount
+		}
+	}
+	return SortMap(counts)
+}
+
+/*
+DiffArchitectures analyzes before and after together and compares their stats with DiffStats,
+so a positive delta means the package ships more files on after.
+Packages only present on after are "added", those only on before "removed".
+Rows below cfg.DeltaThreshold are dropped and cfg.DiffSort orders the rest.
+*/
+func (a *App) DiffArchitectures(ctx context.Context, before, after string) ([]PackageDiff, error) {
+	results := a.AnalyzeArchitectures(ctx, []string{before, after})
+	for _, r := range results {
+		if r.Err != nil {
+			return nil, fmt.Errorf("%s: %w", r.Architecture, r.Err)
+		}
+	}
+	diffs := DiffStats(results[0].Stats, results[1].Stats, a.cfg.DeltaThreshold)
+	if a.cfg.DiffSort == DiffSortPercent {
+		SortDiffs(diffs, DiffSortPercent)
+	}
+	return diffs, nil
+}
+
+// PrintArchDiff writes the diff between two architectures, text output names which side is which
+func PrintArchDiff(w io.Writer, before, after string, diffs []PackageDiff, cfg *Config) error {
+	if cfg.Format == FormatText {
+		fmt.Fprintf(w, "== %s -> %s (added = only on %s, removed = only on %s) ==\n", before, after, after, before)
+	}
+	return PrintDiff(w, diffs, cfg)
+}
+
+// combinedSection names the merged stats of -combined in a multi-architecture report
+const combinedSection = "combined"
+
+// archSection is one block of a multi-architecture report
+type archSection struct {
+	name   string
+	stats  []cache.PackageStats
+	totals Totals
+}
+
+/*
+PrintArchReport writes the architectures that succeeded and, with cfg.Combined, the sum of their Raw counts.
+Failed architectures are left out, the caller reports their errors on stderr.
+Text and markdown get one section per architecture, json and map one object keyed by architecture
+
+	{"amd64": [...], "arm64": [...], "combined": [...]}
+
+and csv and tsv a leading arch column on every row.
+*/
+func PrintArchReport(w io.Writer, results []ArchResult, cfg *Config) error {
+	var sections []archSection
+	var raw [][]cache.PackageStats
+	files := 0
+	for _, r := range results {
+		if r.Err != nil {
+			continue
+		}
+		sections = append(sections, archSection{r.Architecture, r.Stats, r.Totals})
+		raw = append(raw, r.Raw)
+		files += r.Totals.Files
+	}
+	if cfg.Combined {
+		// the filters and -min-count run once on the summed counts, a package spread thin over every architecture can pass
+		merged := MergeStats(raw...)
+		sections = append(sections, archSection{combinedSection, cfg.refine(merged), Totals{Files: files, Packages: len(merged)}})
+	}
+
+	switch {
+	case cfg.Format == FormatJSON || cfg.Format == FormatMap:
+		return printArchJSON(w, sections, cfg)
+	case cfg.Format == FormatCSV && !cfg.SummaryOnly:
+		return printArchCSV(w, sections, cfg)
+	case cfg.Format == FormatTSV && !cfg.SummaryOnly && !cfg.ProvidersHistogram:
+		return printArchTSV(w, sections, cfg)
+	}
+	for i, s := range sections {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		if s.name == combinedSection {
+			fmt.Fprintf(w, "== combined (%d architectures) ==\n", len(raw))
+		} else {
+			fmt.Fprintf(w, "== %s ==\n", s.name)
+		}
+		if err := PrintResultsWithTotals(w, s.stats, s.totals, cfg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// printArchJSON nests the document PrintResults writes for each section in one object keyed by section name
+func printArchJSON(w io.Writer, sections []archSection, cfg *Config) error {
+	doc := make(map[string]json.RawMessage, len(sections))
+	for _, s := range sections {
+		var buf bytes.Buffer
+		if err := PrintResultsWithTotals(&buf, s.stats, s.totals, cfg); err != nil {
+			return err
+		}
+		doc[s.name] = buf.Bytes()
+	}
+	// encoding/json sorts the keys and re-indents the nested documents
+	return writeJSON(w, doc)
+}
+
+// printArchCSV writes the csv rows of every section after an arch column, under a single header
+func printArchCSV(w io.Writer, sections []archSection, cfg *Config) error {
+	cw := csv.NewWriter(w)
+	for i, s := range sections {
+		var buf bytes.Buffer
+		if err := PrintResultsWithTotals(&buf, s.stats, s.totals, cfg); err != nil {
+			return err
+		}
+		records, err := csv.NewReader(&buf).ReadAll()
+		if err != nil {
+			return err
+		}
+		for j, record := range records {
+			if j == 0 {
+				if i == 0 {
+					_ = cw.Write(append([]string{"arch"}, record...))
+				}
+				continue
+			}
+			_ = cw.Write(append([]string{s.name}, record...))
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// printArchTSV writes the tsv rows of every section after an arch column, under a single header
+func printArchTSV(w io.Writer, sections []archSection, cfg *Config) error {
+	bw := bufio.NewWriter(w)
+	for i, s := range sections {
+		var buf bytes.Buffer
+		if err := PrintResultsWithTotals(&buf, s.stats, s.totals, cfg); err != nil {
+			return err
+		}
+		// PrintTSV keeps every row on one line
+		header, rows, _ := strings.Cut(buf.String(), "\n")
+		if i == 0 {
+			fmt.Fprintf(bw, "arch\t%s\n", header)
+		}
+		for row := range strings.Lines(rows) {
+			fmt.Fprintf(bw, "%s\t%s", s.name, row)
+		}
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,383 @@
+package app
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/canonical-dev/package_statistics/internal/cache"
+)
+
+// newContentsServer serves gzip fixtures keyed by request path, e.g. "/Contents-amd64.gz"
+func newContentsServer(t *testing.T, fixtures map[string]string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := fixtures[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		_, _ = gz.Write([]byte(body))
+		gz.Close()
+		_, _ = w.Write(buf.Bytes())
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestAllArchesCombinedReport(t *testing.T) {
+	server := newContentsServer(t, map[string]string{
+		"/Contents-amd64.gz": "usr/bin/a shared\nusr/bin/b shared\nusr/lib/c amd64-only\n",
+		"/Contents-arm64.gz": "usr/bin/a shared\nusr/lib/d arm64-only\n",
+	})
+
+	cfg := &Config{CacheDir: t.TempDir(), CacheTTL: time.Hour, TopCount: 10, AllArches: true, Combined: true}
+	app := NewApp(cfg)
+	app.baseURL = server.URL + "/Contents-{arch}.gz"
+
+	results := app.AnalyzeArchitectures(context.Background(), []string{"amd64", "arm64"})
+	for _, r := range results {
+		if r.Err != nil {
+			t.Fatalf("%s: %v", r.Architecture, r.Err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := PrintArchReport(&buf, results, cfg); err != nil {
+		t.Fatal(err)
+	}
+	output := buf.String()
+
+	for _, want := range []string{"== amd64 ==", "== arm64 ==", "== combined (2 architectures) ==", "amd64-only", "arm64-only"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("missing %q in:\n%s", want, output)
+		}
+	}
+	combined := output[strings.Index(output, "== combined"):]
+	if !strings.Contains(combined, "shared") || !strings.Contains(combined, " 3\n") {
+		t.Errorf("combined section should sum shared to 3:\n%s", combined)
+	}
+}
+
+func TestPrintArchReportStructured(t *testing.T) {
+	results := []ArchResult{
+		{Architecture: "amd64", Stats: []cache.PackageStats{{Name: "shared", FileCount: 2}, {Name: "amd64-only", FileCount: 1}}},
+		{Architecture: "i386", Err: errors.New("404 Not Found")},
+		{Architecture: "arm64", Stats: []cache.PackageStats{{Name: "shared", FileCount: 1}}},
+	}
+	for i := range results {
+		results[i].Raw = results[i].Stats
+	}
+	render := func(format string) string {
+		t.Helper()
+		var buf bytes.Buffer
+		if err := PrintArchReport(&buf, results, &Config{Format: format, TopCount: 10, Combined: true}); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(buf.String(), "i386") || strings.Contains(buf.String(), "404") {
+			t.Errorf("%s: a failed architecture belongs on stderr:\n%s", format, buf.String())
+		}
+		return buf.String()
+	}
+
+	var doc map[string][]RankedPackage
+	if err := json.Unmarshal([]byte(render(FormatJSON)), &doc); err != nil {
+		t.Fatalf("json should be a single document: %v", err)
+	}
+	if len(doc) != 3 || len(doc["amd64"]) != 2 || len(doc["arm64"]) != 1 || doc["combined"][0] != (RankedPackage{Rank: 1, Name: "shared", FileCount: 3}) {
+		t.Errorf("json: got %+v", doc)
+	}
+
+	var counts map[string]map[string]int
+	if err := json.Unmarshal([]byte(render(FormatMap)), &counts); err != nil {
+		t.Fatalf("map should be a single document: %v", err)
+	}
+	if counts["amd64"]["amd64-only"] != 1 || counts["arm64"]["shared"] != 1 || counts["combined"]["shared"] != 3 {
+		t.Errorf("map: got %v", counts)
+	}
+
+	records, err := csv.NewReader(strings.NewReader(render(FormatCSV))).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"arch", "rank", "name", "file_count"},
+		{"amd64", "1", "shared", "2"},
+		{"amd64", "2", "amd64-only", "1"},
+		{"arm64", "1", "shared", "1"},
+		{"combined", "1", "shared", "3"},
+		{"combined", "2", "amd64-only", "1"},
+	}
+	if fmt.Sprint(records) != fmt.Sprint(want) {
+		t.Errorf("csv: got %v, want %v", records, want)
+	}
+
+	wantTSV := "arch\trank\tname\tfile_count\namd64\t1\tshared\t2\namd64\t2\tamd64-only\t1\narm64\t1\tshared\t1\n" +
+		"combined\t1\tshared\t3\ncombined\t2\tamd64-only\t1\n"
+	if got := render(FormatTSV); got != wantTSV {
+		t.Errorf("tsv: got %q, want %q", got, wantTSV)
+	}
+
+	text := render(FormatText)
+	for _, want := range []string{"== amd64 ==", "== arm64 ==", "== combined (2 architectures) =="} {
+		if !strings.Contains(text, want) {
+			t.Errorf("text: missing %q in:\n%s", want, text)
+		}
+	}
+}
+
+func TestCombinedAppliesMinCountToMergedCounts(t *testing.T) {
+	server := newContentsServer(t, map[string]string{
+		"/Contents-amd64.gz": "usr/bin/a big\nusr/bin/b big\nusr/bin/c big\nusr/lib/d spread\nusr/lib/e rare\n",
+		"/Contents-arm64.gz": "usr/lib/d spread\n",
+		"/Contents-i386.gz":  "usr/lib/d spread\n",
+	})
+	cfg := &Config{CacheDir: t.TempDir(), CacheTTL: time.Hour, TopCount: 10, Combined: true, MinCount: 3, Format: FormatJSON}
+	app := NewApp(cfg, WithLogger(log.New(io.Discard, "", 0)))
+	app.baseURL = server.URL + "/Contents-{arch}.gz"
+
+	results := app.AnalyzeArchitectures(context.Background(), []string{"amd64", "arm64", "i386"})
+	var buf bytes.Buffer
+	if err := PrintArchReport(&buf, results, cfg); err != nil {
+		t.Fatal(err)
+	}
+	var doc map[string][]RankedPackage
+	if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	// spread has a single file on each architecture but three together, rare stays below -min-count
+	if fmt.Sprint(doc["amd64"]) != "[{1 big 3}]" || len(doc["arm64"]) != 0 {
+		t.Errorf("each architecture keeps its own -min-count: got %v", doc)
+	}
+	if want := "[{1 big 3} {2 spread 3}]"; fmt.Sprint(doc["combined"]) != want {
+		t.Errorf("combined: got %v, want %s", doc["combined"], want)
+	}
+}
+
+func TestAnalyzeArchitecturesPartialFailure(t *testing.T) {
+	server := newContentsServer(t, map[string]string{
+		"/Contents-amd64.gz": "usr/bin/a pkg1\n",
+	})
+
+	app := NewApp(&Config{CacheDir: t.TempDir(), CacheTTL: time.Hour})
+	app.baseURL = server.URL + "/Contents-{arch}.gz"
+
+	results := app.AnalyzeArchitectures(context.Background(), []string{"amd64", "bogus"})
+
+	if results[0].Err != nil || len(results[0].Stats) != 1 {
+		t.Errorf("amd64: got %+v", results[0])
+	}
+	if results[1].Err == nil {
+		t.Error("bogus architecture should fail")
+	}
+}
+
+func TestMergeStats(t *testing.T) {
+	merged := MergeStats(
+		[]cache.PackageStats{{Name: "pkg1", FileCount: 2}, {Name: "pkg2", FileCount: 1}},
+		[]cache.PackageStats{{Name: "pkg1", FileCount: 3}},
+	)
+
+	if len(merged) != 2 || merged[0] != (cache.PackageStats{Name: "pkg1", FileCount: 5}) {
+		t.Errorf("got %+v", merged)
+	}
+}
+
+func TestParseFlagsMultipleArchitectures(t *testing.T) {
+	cfg, err := parseArgs(t, "-combined", "amd64", "arm64", "amd64", "i386")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(cfg.Architectures) != "[amd64 arm64 i386]" || cfg.Architecture != "amd64" {
+		t.Errorf("got %v (%s)", cfg.Architectures, cfg.Architecture)
+	}
+
+	cfg, err = parseArgs(t, "-all-arches")
+	if err != nil || len(cfg.Architectures) != len(KnownArchitectures) {
+		t.Errorf("got %v, %v", cfg, err)
+	}
+
+	if _, err := parseArgs(t, "-combined", "amd64"); err == nil {
+		t.Error("-combined with a single architecture should fail")
+	}
+}
+
+func TestDiffArchitectures(t *testing.T) {
+	server := newContentsServer(t, map[string]string{
+		"/Contents-amd64.gz": "usr/bin/a shared\nusr/bin/b shared\nusr/lib/c amd64-only\nusr/lib/e same\n",
+		"/Contents-arm64.gz": "usr/bin/a shared\nusr/lib/d arm64-only\nusr/lib/f arm64-only\nusr/lib/g arm64-only\nusr/lib/e same\n",
+	})
+
+	cfg := &Config{CacheDir: t.TempDir(), CacheTTL: time.Hour, DiffArch: true, Format: FormatText}
+	app := NewApp(cfg)
+	app.baseURL = server.URL + "/Contents-{arch}.gz"
+
+	diffs, err := app.DiffArchitectures(context.Background(), "amd64", "arm64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PackageDiff{
+		{Name: "arm64-only", Status: DiffAdded, New: 3, Delta: 3},
+		{Name: "amd64-only", Status: DiffRemoved, Old: 1, Delta: -1},
+		{Name: "shared", Status: DiffChanged, Old: 2, New: 1, Delta: -1},
+	}
+	if fmt.Sprint(diffs) != fmt.Sprint(want) {
+		t.Errorf("got %+v, want %+v", diffs, want)
+	}
+
+	var buf bytes.Buffer
+	if err := PrintArchDiff(&buf, "amd64", "arm64", diffs, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "== amd64 -> arm64 ") || !strings.Contains(buf.String(), "1 added, 1 removed, 1 changed") {
+		t.Errorf("got:\n%s", buf.String())
+	}
+
+	if _, err := app.DiffArchitectures(context.Background(), "amd64", "bogus"); err == nil || !strings.HasPrefix(err.Error(), "bogus: ") {
+		t.Errorf("a failed architecture should fail the diff, got %v", err)
+	}
+}
+
+func TestParseFlagsDiffArch(t *testing.T) {
+	cfg, err := parseArgs(t, "-diff-arch", "amd64", "arm64")
+	if err != nil || !cfg.DiffArch || fmt.Sprint(cfg.Architectures) != "[amd64 arm64]" {
+		t.Errorf("got %+v, %v", cfg, err)
+	}
+	for _, args := range [][]string{
+		{"-diff-arch", "amd64"},
+		{"-diff-arch", "amd64", "arm64", "i386"},
+		{"-diff-arch", "-all-arches"},
+		{"-diff-arch", "-combined", "amd64", "arm64"},
+	} {
+		if _, err := parseArgs(t, args...); err == nil {
+			t.Errorf("%v should fail", args)
+		}
+	}
+}
+
+func TestParseFlagsValidatesArchitecture(t *testing.T) {
+	for _, arch := range []string{"amd64", "arm64", "armhf", "i386", "ppc64el", "s390x", "mips64el", "source", "all", "loong64"} {
+		if _, err := parseArgs(t, arch); err != nil {
+			t.Errorf("%s: %v", arch, err)
+		}
+	}
+
+	_, err := parseArgs(t, "amd46")
+	if err == nil || !strings.Contains(err.Error(), `unknown architecture "amd46"`) || !strings.Contains(err.Error(), "amd64, arm64") {
+		t.Errorf("got %v", err)
+	}
+	if _, err := parseArgs(t, "amd64", "arm46"); err == nil {
+		t.Error("every architecture should be checked")
+	}
+
+	cfg, err := parseArgs(t, "-allow-unknown-arch", "newport64")
+	if err != nil || cfg.Architecture != "newport64" {
+		t.Errorf("got %+v, %v", cfg, err)
+	}
+}
+
+func TestAnalyzeArchitecturesBoundedConcurrency(t *testing.T) {
+	var mu sync.Mutex
+	active, maxActive := 0, 0
+	requested := make(map[string]bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			return
+		}
+		mu.Lock()
+		active++
+		maxActive = max(maxActive, active)
+		requested[r.URL.Path] = true
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		active--
+		mu.Unlock()
+
+		arch := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/stable/Contents-"), ".gz")
+		gz := gzip.NewWriter(w)
+		fmt.Fprintf(gz, "usr/lib/%s/a %s-pkg\n", arch, arch)
+		gz.Close()
+	}))
+	defer server.Close()
+
+	cfg, err := parseArgs(t, "-all-arches", "-arch-concurrency", "2", "stable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.CacheDir = t.TempDir()
+	app := NewApp(cfg, WithLogger(log.New(io.Discard, "", 0)))
+	app.baseURL = server.URL + "/{suite}/Contents-{arch}.gz"
+
+	results := app.AnalyzeArchitectures(context.Background(), cfg.Architectures)
+	for _, r := range results {
+		if r.Err != nil || len(r.Stats) != 1 || r.Stats[0].Name != r.Architecture+"-pkg" {
+			t.Errorf("%s: got %+v", r.Architecture, r)
+		}
+	}
+	if len(requested) != len(KnownArchitectures) {
+		t.Errorf("got %d architectures fetched, want %d", len(requested), len(KnownArchitectures))
+	}
+	if maxActive != 2 {
+		t.Errorf("got %d downloads at once, want 2", maxActive)
+	}
+}
+
+func TestAnalyzeArchitecturesCancel(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	app := NewApp(&Config{CacheDir: t.TempDir(), ArchConcurrency: 2, RequestTimeout: time.Minute}, WithLogger(log.New(io.Discard, "", 0)))
+	app.baseURL = server.URL + "/Contents-{arch}.gz"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	results := app.AnalyzeArchitectures(ctx, []string{"amd64", "arm64", "i386", "armhf"})
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("cancel should stop every fetch, took %v", elapsed)
+	}
+	for _, r := range results {
+		if r.Err == nil {
+			t.Errorf("%s should fail once cancelled", r.Architecture)
+		}
+	}
+}
+
+func TestParseFlagsAllArchesSuite(t *testing.T) {
+	cfg, err := parseArgs(t, "-all-arches", "testing")
+	if err != nil || cfg.Suite != "testing" || cfg.ArchConcurrency != defaultArchConcurrency {
+		t.Errorf("got %+v, %v", cfg, err)
+	}
+	for _, args := range [][]string{
+		{"-all-arches", "amd64"},
+		{"-all-arches", "stable", "testing"},
+		{"-all-arches", "-suite", "unstable", "testing"},
+		{"-all-arches", "-arch-concurrency", "0"},
+	} {
+		if _, err := parseArgs(t, args...); err == nil {
+			t.Errorf("%v should fail", args)
+		}
+	}
+}
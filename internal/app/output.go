@@ -0,0 +1,325 @@
+package app
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/canonical-dev/package_statistics/internal/cache"
+	"github.com/canonical-dev/package_statistics/internal/progress"
+)
+
+// Output formats
+const (
+	FormatText     = "text"
+	FormatJSON     = "json"
+	FormatCSV      = "csv"
+	FormatTSV      = "tsv"
+	FormatMap      = "map"
+	FormatMarkdown = "markdown"
+)
+
+// OutputStdout is the -output value that selects stdout.
+const OutputStdout = "-"
+
+// Color modes accepted by -color.
+const (
+	ColorAuto   = "auto"
+	ColorAlways = "always"
+	ColorNever  = "never"
+)
+
+// UseColor resolves the -color setting: auto colors the text table only when it goes to a terminal
+// and NO_COLOR is unset, an empty setting (a Config built in code) never colors
+func (c *Config) UseColor() bool {
+	switch c.Color {
+	case ColorAlways:
+		return true
+	case ColorAuto:
+		toStdout := c.Output == "" || c.Output == OutputStdout
+		return toStdout && os.Getenv("NO_COLOR") == "" && progress.IsTerminal(os.Stdout)
+	default:
+		return false
+	}
+}
+
+// nopWriteCloser keeps Close from closing stdout
+type nopWriteCloser struct{ io.Writer }
+
+// Close does nothing
+func (nopWriteCloser) Close() error { return nil }
+
+// OpenOutput returns where results go for -output: stdout for "" and "-",
+// otherwise the file at path, truncated, with its parent directories created
+func OpenOutput(path string) (io.WriteCloser, error) {
+	if path == "" || path == OutputStdout {
+		return nopWriteCloser{os.Stdout}, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("create output dir: %w", err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("open output: %w", err)
+	}
+	return f, nil
+}
+
+// RankedPackage is a single row of the json output.
+type RankedPackage struct {
+	Rank      int    `json:"rank"`
+	Name      string `json:"name"`
+	FileCount int    `json:"file_count"`
+}
+
+// PrintResults writes stats to w according to the output options in cfg,
+// stats being the whole parse: the text footer counts them
+func PrintResults(w io.Writer, stats []cache.PackageStats, cfg *Config) error {
+	return PrintResultsWithTotals(w, stats, TotalsOf(stats), cfg)
+}
+
+// PrintResultsWithTotals is PrintResults with the totals of the parse behind stats (see Result.Totals) for the text footer
+func PrintResultsWithTotals(w io.Writer, stats []cache.PackageStats, totals Totals, cfg *Config) error {
+	if cfg.SummaryOnly {
+		if cfg.Format == FormatJSON {
+			return writeJSON(w, Summarize(stats))
+		}
+		PrintSummary(w, Summarize(stats))
+		return nil
+	}
+	if cfg.ProvidersHistogram {
+		return PrintProvidersHistogram(w, stats, cfg.Format)
+	}
+	top := cfg.TopCount
+	if cfg.Bottom > 0 {
+		// rank the least populated packages first, without reordering the caller's slice
+		stats = slices.Clone(stats)
+		SortStats(stats, true)
+		top = cfg.Bottom
+	}
+	if cfg.Sort == SortName {
+		stats = slices.Clone(stats)
+		SortStatsBy(stats, SortName)
+	}
+	switch cfg.Format {
+	case FormatJSON:
+		return PrintJSON(w, stats, top)
+	case FormatCSV:
+		return PrintCSV(w, stats, top)
+	case FormatTSV:
+		return PrintTSV(w, stats, top)
+	case FormatMarkdown:
+		return PrintMarkdown(w, stats, top, cfg.RawNumbers)
+	case FormatMap:
+		return PrintMap(w, stats, top)
+	default:
+		PrintTop(w, stats, top, totals, TableStyle{RawNumbers: cfg.RawNumbers, Color: cfg.UseColor(), NameWidth: cfg.NameWidth})
+		return nil
+	}
+}
+
+/*
+PrintJSON writes the top packages as an array of ranked rows
+output: [{"rank":1,"name":"pkg1","file_count":10}]
+*/
+func PrintJSON(w io.Writer, stats []cache.PackageStats, top int) error {
+	return streamJSON(w, firstN(stats, top), streamFlushRows)
+}
+
+/*
+streamJSON writes stats as the indented array of ranked rows writeJSON would produce,
+encoding one row at a time and flushing every flushEvery rows,
+so exporting a huge top never holds the whole document in memory
+*/
+func streamJSON(w io.Writer, stats []cache.PackageStats, flushEvery int) error {
+	if len(stats) == 0 {
+		_, err := io.WriteString(w, "[]\n")
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	_, _ = bw.WriteString("[\n")
+	for i, s := range stats {
+		data, err := json.MarshalIndent(RankedPackage{Rank: i + 1, Name: s.Name, FileCount: s.FileCount}, "  ", "  ")
+		if err != nil {
+			return err
+		}
+		_, _ = bw.WriteString("  ")
+		_, _ = bw.Write(data)
+		if i < len(stats)-1 {
+			_ = bw.WriteByte(',')
+		}
+		_ = bw.WriteByte('\n')
+		if flushEvery > 0 && (i+1)%flushEvery == 0 {
+			if err := bw.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	_, _ = bw.WriteString("]\n")
+	return bw.Flush()
+}
+
+/*
+PrintCSV writes the top packages as csv with a header row
+output: rank,name,file_count
+
+	1,pkg1,10
+*/
+func PrintCSV(w io.Writer, stats []cache.PackageStats, top int) error {
+	return streamCSV(w, firstN(stats, top), streamFlushRows)
+}
+
+// streamCSV writes stats as ranked csv rows, flushing every flushEvery rows like StreamTop
+// and stopping at the first write error
+func streamCSV(w io.Writer, stats []cache.PackageStats, flushEvery int) error {
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"rank", "name", "file_count"})
+	for i, s := range stats {
+		_ = cw.Write([]string{strconv.Itoa(i + 1), s.Name, strconv.Itoa(s.FileCount)})
+		if flushEvery > 0 && (i+1)%flushEvery == 0 {
+			if cw.Flush(); cw.Error() != nil {
+				return cw.Error()
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+/*
+PrintTSV writes the top packages as tab-separated rows with a header row
+output: rank\tname\tfile_count
+
+	1\tpkg1\t10
+
+TSV has no quoting, so tabs and newlines in a name become spaces to keep the columns aligned
+*/
+func PrintTSV(w io.Writer, stats []cache.PackageStats, top int) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "rank\tname\tfile_count")
+	for i, s := range firstN(stats, top) {
+		fmt.Fprintf(bw, "%d\t%s\t%d\n", i+1, tsvField(s.Name), s.FileCount)
+	}
+	return bw.Flush()
+}
+
+// tsvField replaces the characters that would split a TSV field or row: "devel/\tpiglit" -> "devel/ piglit"
+func tsvField(s string) string {
+	return tsvEscaper.Replace(s)
+}
+
+var tsvEscaper = strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+
+/*
+PrintMarkdown writes the top packages as a GitHub-flavored Markdown table, counts formatted like the text table
+output:
+
+	| Rank | Package Name | Count |
+	| --- | --- | --- |
+	| 1 | pkg1 | 1,234 |
+
+pipes in a name are escaped and tabs or newlines become spaces so a row stays a single table row
+*/
+func PrintMarkdown(w io.Writer, stats []cache.PackageStats, top int, raw bool) error {
+	count := countFormatter(raw)
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "| Rank | Package Name | Count |")
+	fmt.Fprintln(bw, "| --- | --- | --- |")
+	for i, s := range firstN(stats, top) {
+		fmt.Fprintf(bw, "| %d | %s | %s |\n", i+1, markdownCell(s.Name), count(s.FileCount))
+	}
+	return bw.Flush()
+}
+
+// markdownCell escapes s for a table cell: "a|b" -> `a\|b`
+func markdownCell(s string) string {
+	return strings.ReplaceAll(tsvField(s), "|", `\|`)
+}
+
+/*
+PrintMap writes the top packages (all if top <= 0) as a JSON object keyed by package name
+output: {"pkg1": 10, "pkg2": 5}
+keys are sorted so unchanged data always produces byte-identical output
+*/
+func PrintMap(w io.Writer, stats []cache.PackageStats, top int) error {
+	selected := firstN(stats, top)
+	m := make(map[string]int, len(selected))
+	for _, s := range selected {
+		m[s.Name] = s.FileCount
+	}
+	// encoding/json sorts map keys
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(data))
+	return err
+}
+
+// ProvidersBucket is a single row of the providers histogram.
+type ProvidersBucket struct {
+	Providers int `json:"providers"`
+	Files     int `json:"files"`
+}
+
+/*
+PrintProvidersHistogram writes the providers histogram ordered by provider count
+input stats are keyed by provider count: [{"1" 900} {"2" 40}]
+text output:
+
+	Providers  Files
+	1          900
+	2          40
+*/
+func PrintProvidersHistogram(w io.Writer, stats []cache.PackageStats, format string) error {
+	buckets := make([]ProvidersBucket, 0, len(stats))
+	for _, s := range stats {
+		n, err := strconv.Atoi(s.Name)
+		if err != nil {
+			return fmt.Errorf("invalid providers bucket %q", s.Name)
+		}
+		buckets = append(buckets, ProvidersBucket{Providers: n, Files: s.FileCount})
+	}
+	slices.SortFunc(buckets, func(a, b ProvidersBucket) int { return a.Providers - b.Providers })
+
+	switch format {
+	case FormatJSON:
+		return writeJSON(w, buckets)
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		_ = cw.Write([]string{"providers", "files"})
+		for _, b := range buckets {
+			_ = cw.Write([]string{strconv.Itoa(b.Providers), strconv.Itoa(b.Files)})
+		}
+		cw.Flush()
+		return cw.Error()
+	default:
+		fmt.Fprintf(w, "%-10s %s\n", "Providers", "Files")
+		for _, b := range buckets {
+			fmt.Fprintf(w, "%-10d %d\n", b.Providers, b.Files)
+		}
+		return nil
+	}
+}
+
+// firstN returns the first top entries of stats (fewer if stats is shorter), all of them if top <= 0 like -top 0
+func firstN(stats []cache.PackageStats, top int) []cache.PackageStats {
+	if top <= 0 || len(stats) < top {
+		return stats
+	}
+	return stats[:top]
+}
+
+// writeJSON encodes v as indented JSON followed by a newline
+func writeJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
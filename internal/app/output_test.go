@@ -0,0 +1,371 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/canonical-dev/package_statistics/internal/cache"
+)
+
+var outputStats = []cache.PackageStats{
+	{Name: "zlib", FileCount: 30},
+	{Name: "alpha", FileCount: 20},
+	{Name: "middle", FileCount: 10},
+}
+
+func TestPrintResultsText(t *testing.T) {
+	var buf bytes.Buffer
+	if err := PrintResults(&buf, outputStats, &Config{TopCount: 2, Format: FormatText}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "Rank Package Name Count\n" +
+		strings.Repeat("-", 23) + "\n" +
+		"1    zlib            30\n" +
+		"2    alpha           20\n" +
+		"\nParsed 60 file entries across 3 packages\n"
+	if buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+}
+
+func TestPrintResultsTextLongName(t *testing.T) {
+	long := "kernel/linux-headers-6.12.43+deb13-cloud-arm64-with-a-very-long-suffix"
+	stats := []cache.PackageStats{{Name: "short", FileCount: 123456}, {Name: long, FileCount: 7}}
+	var buf bytes.Buffer
+	if err := PrintResults(&buf, stats, &Config{TopCount: 2, Format: FormatText}); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(buf.String(), "\n")
+	if !strings.Contains(lines[3], long+" ") {
+		t.Fatalf("long name truncated: %q", lines[3])
+	}
+	// every column starts and ends at the same offset on the header, separator and rows
+	width := len(lines[0])
+	for _, line := range lines[1:4] {
+		if len(line) != width {
+			t.Errorf("misaligned line %q (%d wide, header %d)", line, len(line), width)
+		}
+	}
+	nameCol := strings.Index(lines[0], "Package Name")
+	if strings.Index(lines[2], "short") != nameCol || strings.Index(lines[3], long) != nameCol {
+		t.Errorf("names should start under the header:\n%s", buf.String())
+	}
+	if !strings.HasSuffix(lines[2], " 123,456") || !strings.HasSuffix(lines[3], "       7") {
+		t.Errorf("counts should be right-aligned:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	if err := PrintResults(&buf, stats[:1], &Config{TopCount: 1, Format: FormatText, NameWidth: 30}); err != nil {
+		t.Fatal(err)
+	}
+	if header := strings.Split(buf.String(), "\n")[0]; header != "Rank "+fmt.Sprintf("%-30s", "Package Name")+"   Count" {
+		t.Errorf("-name-width should set the minimum width, got %q", header)
+	}
+}
+
+func TestPrintResultsJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := PrintResults(&buf, outputStats, &Config{TopCount: 2, Format: FormatJSON}); err != nil {
+		t.Fatal(err)
+	}
+
+	var rows []RankedPackage
+	if err := json.Unmarshal(buf.Bytes(), &rows); err != nil {
+		t.Fatal(err)
+	}
+	want := []RankedPackage{{Rank: 1, Name: "zlib", FileCount: 30}, {Rank: 2, Name: "alpha", FileCount: 20}}
+	if len(rows) != len(want) || rows[0] != want[0] || rows[1] != want[1] {
+		t.Errorf("got %+v", rows)
+	}
+}
+
+func TestPrintResultsCSV(t *testing.T) {
+	var buf bytes.Buffer
+	stats := []cache.PackageStats{{Name: "odd,name", FileCount: 3}, {Name: "pkg", FileCount: 1}}
+	if err := PrintResults(&buf, stats, &Config{TopCount: 10, Format: FormatCSV}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "rank,name,file_count\n1,\"odd,name\",3\n2,pkg,1\n"
+	if buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+}
+
+func TestPrintResultsTSV(t *testing.T) {
+	var buf bytes.Buffer
+	stats := []cache.PackageStats{{Name: "devel/\tpiglit", FileCount: 3}, {Name: "odd,name", FileCount: 1}}
+	if err := PrintResults(&buf, stats, &Config{TopCount: 10, Format: FormatTSV}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "rank\tname\tfile_count\n1\tdevel/ piglit\t3\n2\todd,name\t1\n"
+	if buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		if n := strings.Count(line, "\t"); n != 2 {
+			t.Errorf("%q has %d tabs, want 2", line, n)
+		}
+	}
+}
+
+func TestPrintResultsMarkdown(t *testing.T) {
+	var buf bytes.Buffer
+	stats := []cache.PackageStats{{Name: "big", FileCount: 12345}, {Name: "a|b", FileCount: 2}}
+	if err := PrintResults(&buf, stats, &Config{TopCount: 10, Format: FormatMarkdown}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "| Rank | Package Name | Count |\n" +
+		"| --- | --- | --- |\n" +
+		"| 1 | big | 12,345 |\n" +
+		"| 2 | a\\|b | 2 |\n"
+	if buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+
+	buf.Reset()
+	if err := PrintResults(&buf, stats[:1], &Config{TopCount: 10, Format: FormatMarkdown, RawNumbers: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(buf.String(), "| 1 | big | 12345 |\n") {
+		t.Errorf("-raw-numbers should apply: %q", buf.String())
+	}
+}
+
+func TestPrintResultsMapFormat(t *testing.T) {
+	var buf bytes.Buffer
+	if err := PrintResults(&buf, outputStats, &Config{TopCount: 2, Format: FormatMap}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "{\n  \"alpha\": 20,\n  \"zlib\": 30\n}\n"
+	if buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+
+	var all bytes.Buffer
+	_ = PrintResults(&all, outputStats, &Config{TopCount: 0, Format: FormatMap})
+	if !strings.Contains(all.String(), `"middle": 10`) {
+		t.Errorf("top 0 should include all packages: %s", all.String())
+	}
+}
+
+func TestPrintResultsTopZeroPrintsAll(t *testing.T) {
+	for _, format := range []string{FormatJSON, FormatCSV, FormatTSV, FormatMarkdown, FormatMap} {
+		var buf bytes.Buffer
+		if err := PrintResults(&buf, outputStats, &Config{TopCount: 0, Format: format}); err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range outputStats {
+			if !strings.Contains(buf.String(), s.Name) {
+				t.Errorf("%s with -top 0 is missing %s:\n%s", format, s.Name, buf.String())
+			}
+		}
+	}
+}
+
+func TestPrintResultsSummaryOnly(t *testing.T) {
+	stats := []cache.PackageStats{
+		{Name: "pkg1", FileCount: 100},
+		{Name: "pkg2", FileCount: 10},
+	}
+
+	var buf bytes.Buffer
+	_ = PrintResults(&buf, stats, &Config{TopCount: 10, SummaryOnly: true})
+	output := buf.String()
+
+	if strings.Contains(output, "Rank") || strings.Contains(output, "pkg2") {
+		t.Errorf("ranked rows should not be printed:\n%s", output)
+	}
+	if !strings.Contains(output, "Total packages:") || !strings.Contains(output, "pkg1 (100)") {
+		t.Errorf("missing summary:\n%s", output)
+	}
+
+	buf.Reset()
+	_ = PrintResults(&buf, stats, &Config{TopCount: 10, SummaryOnly: true, Format: FormatJSON})
+	var s Summary
+	if err := json.Unmarshal(buf.Bytes(), &s); err != nil || s.TotalAssociations != 110 {
+		t.Errorf("got %+v, %v", s, err)
+	}
+}
+
+func TestPrintResultsBottom(t *testing.T) {
+	stats := append([]cache.PackageStats(nil), outputStats...)
+
+	var buf bytes.Buffer
+	if err := PrintResults(&buf, stats, &Config{TopCount: 10, Bottom: 2, Format: FormatCSV}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "rank,name,file_count\n1,middle,10\n2,alpha,20\n"; buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+	if stats[0].Name != "zlib" {
+		t.Error("the caller's slice should not be reordered")
+	}
+}
+
+func TestPrintResultsSortByName(t *testing.T) {
+	stats := []cache.PackageStats{{Name: "zlib", FileCount: 30}, {Name: "mid", FileCount: 20}, {Name: "alpha", FileCount: 10}}
+	var buf bytes.Buffer
+	if err := PrintResults(&buf, stats, &Config{TopCount: 2, Format: FormatCSV, Sort: SortName}); err != nil {
+		t.Fatal(err)
+	}
+
+	// -top keeps the first rows in name order
+	want := "rank,name,file_count\n1,alpha,10\n2,mid,20\n"
+	if buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+	if stats[0].Name != "zlib" {
+		t.Error("the caller's slice was reordered")
+	}
+}
+
+func TestParseFlagsTopAndBottom(t *testing.T) {
+	if _, err := parseArgs(t, "-top", "5", "-bottom", "5", "amd64"); err == nil {
+		t.Error("expected error for -top with -bottom")
+	}
+	cfg, err := parseArgs(t, "-bottom", "3", "amd64")
+	if err != nil || cfg.Bottom != 3 {
+		t.Errorf("got %+v, %v", cfg, err)
+	}
+}
+
+func TestPrintProvidersHistogram(t *testing.T) {
+	stats := []cache.PackageStats{{Name: "1", FileCount: 900}, {Name: "10", FileCount: 1}, {Name: "2", FileCount: 40}}
+
+	var buf bytes.Buffer
+	if err := PrintResults(&buf, stats, &Config{ProvidersHistogram: true}); err != nil {
+		t.Fatal(err)
+	}
+	want := "Providers  Files\n1          900\n2          40\n10         1\n"
+	if buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+
+	buf.Reset()
+	if err := PrintResults(&buf, stats, &Config{ProvidersHistogram: true, Format: FormatJSON}); err != nil {
+		t.Fatal(err)
+	}
+	var buckets []ProvidersBucket
+	if err := json.Unmarshal(buf.Bytes(), &buckets); err != nil || len(buckets) != 3 || buckets[2] != (ProvidersBucket{Providers: 10, Files: 1}) {
+		t.Errorf("got %+v, %v", buckets, err)
+	}
+}
+
+func TestOpenOutputFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reports", "amd64.json")
+	out, err := OpenOutput(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := PrintResults(out, outputStats, &Config{TopCount: 2, Format: FormatJSON}); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rows []RankedPackage
+	if err := json.Unmarshal(data, &rows); err != nil || len(rows) != 2 || rows[0].Name != "zlib" {
+		t.Errorf("got %q, %v", data, err)
+	}
+}
+
+func TestOpenOutputStdoutAndErrors(t *testing.T) {
+	for _, path := range []string{"", OutputStdout} {
+		out, err := OpenOutput(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w, ok := out.(nopWriteCloser); !ok || w.Writer != os.Stdout {
+			t.Errorf("%q should write to stdout, got %T", path, out)
+		}
+		_ = out.Close()
+	}
+
+	// a regular file can't be a parent directory
+	blocker := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenOutput(filepath.Join(blocker, "out.txt")); err == nil {
+		t.Error("unwritable path should fail")
+	}
+}
+
+func TestStreamJSONMatchesWriteJSON(t *testing.T) {
+	for _, n := range []int{0, 1, 3, 1000} {
+		var stats []cache.PackageStats
+		var rows []RankedPackage
+		for i := 0; i < n; i++ {
+			name := fmt.Sprintf("pkg<%d>&\"q\"", i)
+			stats = append(stats, cache.PackageStats{Name: name, FileCount: n - i})
+			rows = append(rows, RankedPackage{Rank: i + 1, Name: name, FileCount: n - i})
+		}
+		var want bytes.Buffer
+		if rows == nil {
+			rows = []RankedPackage{}
+		}
+		_ = writeJSON(&want, rows)
+
+		var got countingWriter
+		if err := streamJSON(&got, stats, 100); err != nil {
+			t.Fatal(err)
+		}
+		if got.String() != want.String() {
+			t.Errorf("n=%d: streamed JSON differs:\n%s\nwant:\n%s", n, got.String(), want.String())
+		}
+		if n == 1000 && got.writes < 10 {
+			t.Errorf("got %d writes, want at least one per 100 rows", got.writes)
+		}
+	}
+}
+
+func TestStreamCSVFlushesIncrementally(t *testing.T) {
+	var stats []cache.PackageStats
+	for i := 0; i < 1000; i++ {
+		stats = append(stats, cache.PackageStats{Name: fmt.Sprintf("pkg%d", i), FileCount: 1000 - i})
+	}
+
+	var w countingWriter
+	if err := streamCSV(&w, stats, 100); err != nil {
+		t.Fatal(err)
+	}
+	if w.writes < 10 {
+		t.Errorf("got %d writes, want at least one per 100 rows", w.writes)
+	}
+	if lines := strings.Count(w.String(), "\n"); lines != 1001 {
+		t.Errorf("got %d lines, want a header and 1000 rows", lines)
+	}
+}
+
+// benchmarkExport ranks a large synthetic dataset once, then measures exporting every row
+func benchmarkExport(b *testing.B, print func(io.Writer, []cache.PackageStats, int) error) {
+	stats := SortMap(syntheticCounts(100000))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := print(io.Discard, stats, len(stats)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPrintJSON(b *testing.B) { benchmarkExport(b, PrintJSON) }
+
+func BenchmarkPrintCSV(b *testing.B) { benchmarkExport(b, PrintCSV) }
@@ -0,0 +1,74 @@
+package app
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Profile is a named bundle of output settings selected with -profile.
+type Profile struct {
+	Format      string
+	TopCount    int
+	Sort        string
+	SummaryOnly bool
+	NoProgress  bool
+}
+
+// Profiles holds the built-in output profiles, add an entry here to define a new one
+// or a [profile.<name>] table to the config file (see FileProfile).
+var Profiles = map[string]Profile{
+	// machine readable output for CI logs and artifacts
+	"ci-json": {Format: FormatJSON, TopCount: 50, Sort: SortCount, NoProgress: true},
+	// the default interactive table
+	"human-table": {Format: FormatText, TopCount: 10, Sort: SortCount},
+	// enough rows to paste into a spreadsheet, alphabetical for lookups
+	"csv-for-sheets": {Format: FormatCSV, TopCount: 1000, Sort: SortName, NoProgress: true},
+}
+
+// profileNames returns the names of the built-in and custom profiles sorted for help and error messages
+func profileNames(custom map[string]Profile) string {
+	names := make([]string, 0, len(Profiles)+len(custom))
+	for name := range Profiles {
+		names = append(names, name)
+	}
+	for name := range custom {
+		if _, ok := Profiles[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return strings.Join(names, ", ")
+}
+
+// applyProfile copies the named profile into cfg, skipping the settings given explicitly on the command line
+// custom holds the config file profiles, they replace built-in ones of the same name
+// explicit holds the names of the flags that were set
+func applyProfile(cfg *Config, name string, custom map[string]Profile, explicit map[string]bool) error {
+	if name == "" {
+		return nil
+	}
+	p, ok := custom[name]
+	if !ok {
+		p, ok = Profiles[name]
+	}
+	if !ok {
+		return fmt.Errorf("unknown profile %q (want %s)", name, profileNames(custom))
+	}
+	if !explicit["format"] {
+		cfg.Format = p.Format
+	}
+	if !explicit["top"] {
+		cfg.TopCount = p.TopCount
+	}
+	if !explicit["sort"] {
+		cfg.Sort = p.Sort
+	}
+	if !explicit["summary-only"] {
+		cfg.SummaryOnly = p.SummaryOnly
+	}
+	if !explicit["no-progress"] {
+		cfg.NoProgress = p.NoProgress
+	}
+	return nil
+}
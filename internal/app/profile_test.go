@@ -0,0 +1,88 @@
+package app
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuiltinProfiles(t *testing.T) {
+	tests := []struct {
+		profile string
+		want    Profile
+	}{
+		{"ci-json", Profile{Format: FormatJSON, TopCount: 50, Sort: SortCount, NoProgress: true}},
+		{"human-table", Profile{Format: FormatText, TopCount: 10, Sort: SortCount}},
+		{"csv-for-sheets", Profile{Format: FormatCSV, TopCount: 1000, Sort: SortName, NoProgress: true}},
+	}
+
+	for _, tt := range tests {
+		cfg, err := parseArgs(t, "-profile", tt.profile, "amd64")
+		if err != nil {
+			t.Fatalf("%s: %v", tt.profile, err)
+		}
+		got := Profile{Format: cfg.Format, TopCount: cfg.TopCount, Sort: cfg.Sort, SummaryOnly: cfg.SummaryOnly, NoProgress: cfg.NoProgress}
+		if got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.profile, got, tt.want)
+		}
+	}
+}
+
+func TestProfileExplicitFlagsOverride(t *testing.T) {
+	cfg, err := parseArgs(t, "-profile", "csv-for-sheets", "-top", "5", "-sort", "count", "-no-progress=false", "amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Format != FormatCSV || cfg.TopCount != 5 || cfg.Sort != SortCount || cfg.NoProgress {
+		t.Errorf("got format=%s top=%d sort=%s no-progress=%v", cfg.Format, cfg.TopCount, cfg.Sort, cfg.NoProgress)
+	}
+
+	if _, err := parseArgs(t, "-profile", "bogus", "amd64"); err == nil {
+		t.Error("expected error for unknown profile")
+	}
+}
+
+func TestConfigFileProfiles(t *testing.T) {
+	file := writeConfig(t, `
+[profile.weekly]
+format = "markdown"
+top = 25
+sort = "name"
+no_progress = true
+
+[profile.ci-json]
+format = "json"
+top = 0
+`)
+	tests := []struct {
+		profile string
+		want    Profile
+	}{
+		{"weekly", Profile{Format: FormatMarkdown, TopCount: 25, Sort: SortName, NoProgress: true}},
+		// a table of a built-in profile's name replaces it, keys left out keep the defaults
+		{"ci-json", Profile{Format: FormatJSON, TopCount: 0, Sort: SortCount}},
+		{"human-table", Profiles["human-table"]},
+	}
+	for _, tt := range tests {
+		cfg, err := parseArgs(t, "-config", file, "-profile", tt.profile, "amd64")
+		if err != nil {
+			t.Fatalf("%s: %v", tt.profile, err)
+		}
+		got := Profile{Format: cfg.Format, TopCount: cfg.TopCount, Sort: cfg.Sort, SummaryOnly: cfg.SummaryOnly, NoProgress: cfg.NoProgress}
+		if got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.profile, got, tt.want)
+		}
+	}
+
+	for _, content := range []string{
+		"[profile.bad]\nformat = \"yaml\"\n",
+		"[profile.bad]\nsort = \"size\"\n",
+		"[profile.bad]\ncolumns = \"name\"\n",
+	} {
+		if _, err := parseArgs(t, "-config", writeConfig(t, content), "-profile", "bad", "amd64"); err == nil {
+			t.Errorf("%q: want an error", content)
+		}
+	}
+	if _, err := parseArgs(t, "-config", file, "-profile", "monthly", "amd64"); err == nil || !strings.Contains(err.Error(), "weekly") {
+		t.Errorf("unknown profile error should list the config file profiles, got %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"golang.org/x/time/rate"
+)
+
+// byteUnits maps the -max-rate and -max-cache-size suffixes to their size, binary multiples like the MB in the progress bar
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+	{"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10},
+	{"B", 1},
+}
+
+/*
+ParseByteSize parses a byte count with an optional K, M or G suffix
+input: "2MB", "512K", "1.5M", "4096"
+output: 2097152, 524288, 1572864, 4096
+an empty value is 0
+*/
+func ParseByteSize(s string) (int64, error) {
+	num := strings.ToUpper(strings.TrimSpace(s))
+	if num == "" {
+		return 0, nil
+	}
+	size := int64(1)
+	for _, u := range byteUnits {
+		if strings.HasSuffix(num, u.suffix) {
+			num, size = strings.TrimSpace(strings.TrimSuffix(num, u.suffix)), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q is not a size (want bytes such as 500MB or 2G)", s)
+	}
+	return int64(n * float64(size)), nil
+}
+
+// ParseByteRate parses a -max-rate value in bytes per second like ParseByteSize, empty is 0 (unlimited)
+func ParseByteRate(s string) (int64, error) {
+	n, err := ParseByteSize(s)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a rate (want bytes per second such as 2MB or 512K)", s)
+	}
+	return n, nil
+}
+
+// throttledReader reads from r no faster than its limiter allows
+type throttledReader struct {
+	ctx context.Context
+	r   io.Reader
+	lim *rate.Limiter
+}
+
+// throttle limits r to bytesPerSec (r itself if 0)
+// the burst is a tenth of a second worth of data so the rate holds from the first read
+func throttle(ctx context.Context, r io.Reader, bytesPerSec int64) io.Reader {
+	if bytesPerSec <= 0 {
+		return r
+	}
+	burst := int(max(bytesPerSec/10, 1))
+	return &throttledReader{ctx: ctx, r: r, lim: rate.NewLimiter(rate.Limit(bytesPerSec), burst)}
+}
+
+// Read reads at most a burst and waits until the limiter covers it, returning early when ctx is done
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > t.lim.Burst() {
+		p = p[:t.lim.Burst()]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if werr := t.lim.WaitN(t.ctx, n); werr != nil {
+			return n, t.ctx.Err()
+		}
+	}
+	return n, err
+}
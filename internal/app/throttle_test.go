@@ -0,0 +1,87 @@
+package app
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseByteRate(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+	}{
+		{"", 0},
+		{"4096", 4096},
+		{"2MB", 2 << 20},
+		{"512k", 512 << 10},
+		{"1.5M", 3 << 19},
+		{"1G", 1 << 30},
+		{"100B", 100},
+	}
+	for _, tt := range tests {
+		if got, err := ParseByteRate(tt.in); err != nil || got != tt.want {
+			t.Errorf("%q: got %d, %v", tt.in, got, err)
+		}
+	}
+	for _, bad := range []string{"fast", "-1MB", "MB"} {
+		if _, err := ParseByteRate(bad); err == nil {
+			t.Errorf("%q should fail", bad)
+		}
+	}
+}
+
+func TestDownloadMaxRate(t *testing.T) {
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(gz, "usr/share/doc/file%d pkg%d\n", i, i)
+	}
+	gz.Close()
+	size := body.Len()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(body.Bytes())
+	}))
+	defer server.Close()
+
+	// the whole body should take about half a second
+	maxRate := int64(size * 2)
+	app := NewApp(&Config{Architecture: "amd64", CacheDir: t.TempDir(), NoProgress: true, MaxRate: maxRate}, WithLogger(log.New(io.Discard, "", 0)))
+	start := time.Now()
+	stats, _, _, err := app.Download(context.Background(), server.URL, nil)
+	elapsed := time.Since(start)
+
+	if err != nil || len(stats) != 2000 {
+		t.Fatalf("got %d packages, %v", len(stats), err)
+	}
+	if elapsed < 400*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("%d bytes at %d B/s took %v, want about 500ms", size, maxRate, elapsed)
+	}
+}
+
+func TestThrottleCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := throttle(ctx, strings.NewReader(strings.Repeat("x", 1<<20)), 100)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	_, err := io.ReadAll(r)
+	if err != context.Canceled {
+		t.Errorf("got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("cancellation took %v", elapsed)
+	}
+}
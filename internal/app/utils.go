@@ -1,60 +1,556 @@
 package app
 
 import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/canonical-dev/package_statistics/internal/cache"
 )
 
 /*
-ProcessLine parses a single line into counts
-input line: "usr/bin/file1 pkg1,pkg2,pkg3"
+ProcessLine parses a single line into counts, skipping files whose path doesn't start with pathPrefix
+input line: "usr/bin/file1 pkg1,pkg2,pkg3", pathPrefix: "usr/bin/" (or "" for every file)
 output map: {"pkg1": 1, "pkg2": 1, "pkg3": 1}
 */
-func ProcessLine(line string, m map[string]int) {
+func ProcessLine(line string, m map[string]int, pathPrefix string) {
+	LineParser{PathPrefix: pathPrefix}.Process(line, m)
+}
+
+// LineParser holds the options controlling how contents lines are split into packages.
+type LineParser struct {
+	// SourceFormat splits on the last whitespace run instead of the first space
+	// Contents-source.gz separates path and packages with tabs: "debian/control\t\tdevel/foo"
+	SourceFormat bool
+	// SampleRate keeps only this fraction of lines (0 or 1 = every line)
+	// the decision is a hash of the line salted by Seed, so the same seed always picks the same lines
+	SampleRate float64
+	Seed       int64
+	// PathDepth > 0 counts files by their first PathDepth path components instead of by package
+	// "usr/lib/x86_64-linux-gnu/libc.so" with depth 2 -> "usr/lib"
+	PathDepth int
+	// PackagePrefix only counts matching packages, checked before anything is inserted in the map
+	PackagePrefix string
+	// Providers counts files by the number of packages listed on their line instead of by package
+	// "usr/bin/file1 pkg1,pkg2" -> "2"
+	Providers bool
+	// PathPrefix only counts files whose path (everything before the separator) starts with it
+	PathPrefix string
+	// Legend is the first columns of the line ending the file header (DefaultLegend if empty)
+	Legend string
+	// StripSection counts every package under its bare name: "admin/cron" -> "cron"
+	StripSection bool
+	// Workers > 1 counts lines on that many goroutines (see countConcurrent), not used by -low-memory
+	Workers int
+	// GroupBy selects the counting key: GroupByPackage (also when empty) or GroupByExtension
+	GroupBy string
+	// IncludeUdeb counts installer packages too, by default IsUdeb packages are skipped
+	// and a file provided only by them isn't counted by path, extension or providers either
+	IncludeUdeb bool
+	// Dedupe counts a path listed twice for the same key only once (Parse only, Process counts every line)
+	// it remembers every path, so it costs memory and always parses on a single goroutine
+	Dedupe bool
+}
+
+// Counting keys accepted by -group-by.
+const (
+	GroupByPackage   = "package"
+	GroupByExtension = "extension"
+)
+
+// NoExtension is the GroupByExtension key for files without an extension.
+const NoExtension = "(none)"
+
+// Process parses a single line into counts
+func (p LineParser) Process(line string, m map[string]int) {
+	p.forEachKey(line, func(pkg string) {
+		m[pkg]++ // increments the count outside of this function
+	})
+}
+
+// forEachKey calls fn for every counting key on a contents line
+// keys are the listed packages, the path prefix when PathDepth is set, the file extension with GroupByExtension
+// or the package count with Providers
+func (p LineParser) forEachKey(line string, fn func(key string)) {
+	p.forEachEntry(line, func(_, key string) { fn(key) })
+}
+
+// isLegendLine reports whether line is a "FILE   LOCATION" legend that reached the parser
+// only a whole FILE column matches, data paths such as "FILES/readme" are still counted
+func isLegendLine(line string) bool {
+	first, _, _ := strings.Cut(line, " ")
+	first, _, _ = strings.Cut(first, "\t")
+	return first == DefaultLegend
+}
+
+// forEachEntry is forEachKey that also passes the path the key was counted for
+func (p LineParser) forEachEntry(line string, fn func(path, key string)) {
 	line = strings.TrimSpace(line)
-	if line == "" || strings.HasPrefix(line, "FILE") {
+	if line == "" || isLegendLine(line) || !p.sampled(line) {
 		return
 	}
 	idx := strings.Index(line, " ")
-	if idx == -1 {
+	if p.SourceFormat {
+		idx = strings.LastIndexAny(line, " \t")
+	}
+	if idx == -1 || !strings.HasPrefix(line, p.PathPrefix) || len(p.PathPrefix) > idx {
 		return
 	}
+	path := strings.TrimSpace(line[:idx])
+	if !p.IncludeUdeb && (p.PathDepth > 0 || p.GroupBy == GroupByExtension) && onlyUdebs(line[idx+1:]) {
+		return
+	}
+	if p.PathDepth > 0 {
+		fn(path, pathPrefix(path, p.PathDepth))
+		return
+	}
+	if p.GroupBy == GroupByExtension {
+		fn(path, fileExtension(path))
+		return
+	}
+	providers := 0
 	for _, pkg := range strings.Split(strings.TrimSpace(line[idx+1:]), ",") {
 		pkg = strings.TrimSpace(pkg)
-		if pkg != "" {
-			m[pkg]++ // increments the count outside of this function
+		if pkg == "" || (!p.IncludeUdeb && IsUdeb(pkg)) {
+			continue
+		}
+		providers++
+		if !p.Providers && HasPackagePrefix(pkg, p.PackagePrefix) {
+			if p.StripSection {
+				pkg = pkg[strings.LastIndex(pkg, "/")+1:]
+			}
+			fn(path, pkg)
+		}
+	}
+	if p.Providers && providers > 0 {
+		fn(path, strconv.Itoa(providers))
+	}
+}
+
+/*
+IsUdeb reports whether a qualified package name is a udeb (a debian-installer package).
+
+Contents lines don't mark udebs, so this goes by the archive's naming conventions:
+the section is debian-installer, possibly under an area ("non-free/debian-installer/foo"),
+or the name ends in -udeb ("admin/cdebconf-udeb")
+*/
+func IsUdeb(pkg string) bool {
+	section, name := "", pkg
+	if i := strings.LastIndex(pkg, "/"); i >= 0 {
+		section, name = pkg[:i], pkg[i+1:]
+	}
+	return strings.HasSuffix(name, "-udeb") || section == "debian-installer" || strings.HasSuffix(section, "/debian-installer")
+}
+
+// onlyUdebs reports whether every package of a comma separated list is a udeb, false for an empty list
+func onlyUdebs(packages string) bool {
+	found := false
+	for _, pkg := range strings.Split(packages, ",") {
+		pkg = strings.TrimSpace(pkg)
+		if pkg == "" {
+			continue
+		}
+		if !IsUdeb(pkg) {
+			return false
+		}
+		found = true
+	}
+	return found
+}
+
+// pathSet remembers which paths were counted for each key, used by LineParser.Dedupe
+type pathSet map[string]map[string]struct{}
+
+// add records path for key and reports whether it is new
+func (s pathSet) add(path, key string) bool {
+	paths, ok := s[key]
+	if !ok {
+		paths = make(map[string]struct{})
+		s[key] = paths
+	}
+	if _, seen := paths[path]; seen {
+		return false
+	}
+	// path is a slice of the whole line, copy it so the package list can be freed
+	paths[strings.Clone(path)] = struct{}{}
+	return true
+}
+
+/*
+pathPrefix returns the first depth components of path
+input: "usr/lib/x86_64-linux-gnu/libc.so", 2
+output: "usr/lib"
+paths with fewer components are returned whole
+*/
+func pathPrefix(path string, depth int) string {
+	parts := strings.SplitN(strings.TrimSpace(path), "/", depth+1)
+	if len(parts) > depth {
+		parts = parts[:depth]
+	}
+	return strings.Join(parts, "/")
+}
+
+/*
+fileExtension returns the extension of the file at path, NoExtension if it has none
+input: "usr/lib/x86_64-linux-gnu/libc.so.6"
+output: ".so"
+trailing numeric parts (library versions) are skipped, otherwise the last part wins: "a.tar.gz" -> ".gz"
+a leading dot doesn't start an extension: ".bashrc" -> NoExtension
+*/
+func fileExtension(path string) string {
+	name := strings.TrimSpace(path)
+	name = name[strings.LastIndex(name, "/")+1:]
+	for {
+		dot := strings.LastIndex(name, ".")
+		if dot <= 0 || dot == len(name)-1 {
+			return NoExtension
 		}
+		if _, err := strconv.Atoi(name[dot+1:]); err != nil {
+			return name[dot:]
+		}
+		name = name[:dot]
+	}
+}
+
+/*
+HasPackagePrefix reports whether pkg matches prefix
+a prefix without "/" is matched against the name after the section: "libdevel/libboost-dev" matches "lib"
+a prefix with "/" is matched against the full token: "libdevel/libboost-dev" matches "libdevel/"
+*/
+func HasPackagePrefix(pkg, prefix string) bool {
+	if prefix == "" {
+		return true
 	}
+	if !strings.Contains(prefix, "/") {
+		pkg = pkg[strings.LastIndex(pkg, "/")+1:]
+	}
+	return strings.HasPrefix(pkg, prefix)
+}
+
+// FilterPrefix keeps only the packages matching prefix
+func FilterPrefix(stats []cache.PackageStats, prefix string) []cache.PackageStats {
+	if prefix == "" {
+		return stats
+	}
+	filtered := make([]cache.PackageStats, 0, len(stats))
+	for _, s := range stats {
+		if HasPackagePrefix(s.Name, prefix) {
+			filtered = append(filtered, s)
+		}
+	}
+	return filtered
+}
+
+// FilterRegexp keeps only the packages whose name matches re (everything if re is nil)
+func FilterRegexp(stats []cache.PackageStats, re *regexp.Regexp) []cache.PackageStats {
+	if re == nil {
+		return stats
+	}
+	filtered := make([]cache.PackageStats, 0, len(stats))
+	for _, s := range stats {
+		if re.MatchString(s.Name) {
+			filtered = append(filtered, s)
+		}
+	}
+	return filtered
+}
+
+// FilterMinCount keeps only the packages with at least min files, order is preserved
+func FilterMinCount(stats []cache.PackageStats, min int) []cache.PackageStats {
+	if min <= 1 {
+		return stats
+	}
+	filtered := make([]cache.PackageStats, 0, len(stats))
+	for _, s := range stats {
+		if s.FileCount >= min {
+			filtered = append(filtered, s)
+		}
+	}
+	return filtered
+}
+
+// prefixed reports whether a package or path prefix drops lines, so a valid file can yield no packages
+func (p LineParser) prefixed() bool {
+	return p.PackagePrefix != "" || p.PathPrefix != ""
 }
 
-// SortMap converts map to sorted slice
+// sampled decides whether a line is part of the sample
+func (p LineParser) sampled(line string) bool {
+	if p.SampleRate <= 0 || p.SampleRate >= 1 {
+		return true
+	}
+	h := fnv.New64a()
+	_ = binary.Write(h, binary.LittleEndian, p.Seed)
+	_, _ = h.Write([]byte(line))
+	return float64(h.Sum64()) < p.SampleRate*math.MaxUint64
+}
+
+// Package orders accepted by -sort.
+const (
+	SortCount = "count"
+	SortName  = "name"
+)
+
+// SortMap converts map to a slice sorted by count, see SortMapBy
 func SortMap(m map[string]int) []cache.PackageStats {
+	return SortMapBy(m, SortCount)
+}
+
+// SortMapBy converts map to a slice sorted by SortCount (descending) or SortName (ascending)
+func SortMapBy(m map[string]int, by string) []cache.PackageStats {
 	stats := make([]cache.PackageStats, 0, len(m))
 	for k, v := range m {
 		stats = append(stats, cache.PackageStats{Name: k, FileCount: v})
 	}
-	sort.Slice(stats, func(i, j int) bool { return stats[i].FileCount > stats[j].FileCount })
+	SortStatsBy(stats, by)
 	return stats
 }
 
-// PrintTop displays top packages with rank
-func PrintTop(stats []cache.PackageStats, top int) {
-	if len(stats) < top {
+// topNRatio is how much larger than top a map must be before TopN beats sorting everything
+const topNRatio = 8
+
+// RankMap returns the top packages of m sorted by count (all of them if top <= 0)
+// small tops over big maps use the TopN heap, anything else sorts the whole map
+func RankMap(m map[string]int, top int) []cache.PackageStats {
+	if top > 0 && top*topNRatio < len(m) {
+		return TopN(m, top)
+	}
+	stats := SortMap(m)
+	if top > 0 && len(stats) > top {
+		stats = stats[:top]
+	}
+	return stats
+}
+
+/*
+TopN returns the n packages with the highest counts, sorted by count descending.
+
+A min-heap of size n holds the best packages seen so far, so memory stays O(n)
+and the cost is O(N log n) instead of sorting all N entries.
+*/
+func TopN(m map[string]int, n int) []cache.PackageStats {
+	if n <= 0 {
+		return []cache.PackageStats{}
+	}
+	h := make(statsHeap, 0, n)
+	for k, v := range m {
+		switch {
+		case len(h) < n:
+			heap.Push(&h, cache.PackageStats{Name: k, FileCount: v})
+		case ranksAbove(cache.PackageStats{Name: k, FileCount: v}, h[0]):
+			h[0] = cache.PackageStats{Name: k, FileCount: v}
+			heap.Fix(&h, 0)
+		}
+	}
+	stats := []cache.PackageStats(h)
+	SortStats(stats, false)
+	return stats
+}
+
+// ranksAbove reports whether a is listed before b: more files first, equal counts by name
+// so which packages make the cut never depends on map iteration order
+func ranksAbove(a, b cache.PackageStats) bool {
+	if a.FileCount == b.FileCount {
+		return a.Name < b.Name
+	}
+	return a.FileCount > b.FileCount
+}
+
+// statsHeap is a min-heap of package stats, the lowest ranked package at the root
+type statsHeap []cache.PackageStats
+
+func (h statsHeap) Len() int            { return len(h) }
+func (h statsHeap) Less(i, j int) bool  { return ranksAbove(h[j], h[i]) }
+func (h statsHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *statsHeap) Push(x interface{}) { *h = append(*h, x.(cache.PackageStats)) }
+func (h *statsHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// SortStats sorts stats in place by file count, descending unless ascending is set
+// equal counts are ordered by name so the same counts always give the same order
+func SortStats(stats []cache.PackageStats, ascending bool) {
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].FileCount == stats[j].FileCount {
+			return stats[i].Name < stats[j].Name
+		}
+		if ascending {
+			return stats[i].FileCount < stats[j].FileCount
+		}
+		return stats[i].FileCount > stats[j].FileCount
+	})
+}
+
+// SortStatsBy sorts stats in place by SortName (ascending) or, for anything else, SortCount (descending)
+func SortStatsBy(stats []cache.PackageStats, by string) {
+	if by != SortName {
+		SortStats(stats, false)
+		return
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+}
+
+// FormatTimestamp renders t as RFC3339 in UTC
+// every printed timestamp goes through here so output is comparable across machines
+func FormatTimestamp(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// streamFlushRows is how many table rows are buffered between flushes
+const streamFlushRows = 256
+
+// TableStyle controls how PrintTop and StreamTop render the ranking table.
+type TableStyle struct {
+	// RawNumbers prints counts as plain digits instead of grouping thousands
+	RawNumbers bool
+	// Color adds ANSI styling: rank 1 bold, every other row cyan, counts dimmed
+	Color bool
+	// NameWidth is the minimum width of the package name column, which always widens to the longest printed name
+	// (0 = just fit the names)
+	NameWidth int
+}
+
+// ANSI escape sequences used by TableStyle.Color
+const (
+	ansiReset = "\x1b[0m"
+	ansiBold  = "\x1b[1m"
+	ansiDim   = "\x1b[2m"
+	ansiCyan  = "\x1b[36m"
+)
+
+// PrintTop displays top packages with rank (all packages if top <= 0)
+// followed by a footer with the totals of the parse, before any filtering or truncation
+func PrintTop(w io.Writer, stats []cache.PackageStats, top int, t Totals, style TableStyle) {
+	StreamTop(w, stats, top, streamFlushRows, style)
+	count := countFormatter(style.RawNumbers)
+	fmt.Fprintf(w, "\nParsed %s file entries across %s packages\n", count(t.Files), count(t.Packages))
+}
+
+// formatCount renders n with thousands separators: 1234567 -> 1,234,567
+func formatCount(n int) string {
+	s := strconv.Itoa(n)
+	if n < 0 {
+		return "-" + formatCount(-n)
+	}
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return s
+}
+
+// countFormatter returns how table counts are printed: plain digits when raw (-raw-numbers), grouped otherwise
+func countFormatter(raw bool) func(int) string {
+	if raw {
+		return strconv.Itoa
+	}
+	return formatCount
+}
+
+/*
+StreamTop writes the ranked table through a buffer that is flushed every flushEvery rows,
+so a huge table (-top 0) appears progressively instead of in one write at the end
+and small tables still cost a single write
+*/
+func StreamTop(w io.Writer, stats []cache.PackageStats, top, flushEvery int, style TableStyle) {
+	if top <= 0 || len(stats) < top {
 		top = len(stats)
 	}
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
 
-	fmt.Printf("%-5s %-30s %s\n", "Rank", "Package Name", "Count")
-	fmt.Println(strings.Repeat("-", 50))
+	count := countFormatter(style.RawNumbers)
+	rankW, nameW, countW := tableWidths(stats[:top], style, count)
+	fmt.Fprintf(bw, "%-*s %-*s %*s\n", rankW, "Rank", nameW, "Package Name", countW, "Count")
+	fmt.Fprintln(bw, strings.Repeat("-", rankW+nameW+countW+2))
 
 	for i := 0; i < top; i++ {
-		// Clean package name by replacing tabs with spaces and trimming whitespace
-		// Contents-source.gz had tabs "\t" in the package name
-		cleanName := strings.ReplaceAll(stats[i].Name, "\t", " ")
-		cleanName = strings.TrimSpace(cleanName)
+		row := fmt.Sprintf("%-*d %-*s", rankW, i+1, nameW, stats[i].Name)
+		n := fmt.Sprintf("%*s", countW, count(stats[i].FileCount))
+		if style.Color {
+			// styled after padding so the escapes don't count towards the column widths
+			switch {
+			case i == 0:
+				row = ansiBold + row + ansiReset
+			case i%2 == 1:
+				row = ansiCyan + row + ansiReset
+			}
+			n = ansiDim + n + ansiReset
+		}
+		fmt.Fprintf(bw, "%s %s\n", row, n)
+		if flushEvery > 0 && (i+1)%flushEvery == 0 {
+			_ = bw.Flush()
+		}
+	}
+}
+
+// tableWidths sizes the StreamTop columns to their headers and the widest printed value
+// names are never truncated, so a long one widens its column for every row
+func tableWidths(rows []cache.PackageStats, style TableStyle, count func(int) string) (rank, name, counts int) {
+	rank = max(len("Rank"), len(strconv.Itoa(len(rows))))
+	name = max(len("Package Name"), style.NameWidth)
+	counts = len("Count")
+	for _, s := range rows {
+		name = max(name, utf8.RuneCountInString(s.Name))
+		counts = max(counts, len(count(s.FileCount)))
+	}
+	return rank, name, counts
+}
+
+// TotalsOf returns the totals of a complete set of stats, e.g. a cache written before the totals were stored
+func TotalsOf(stats []cache.PackageStats) Totals {
+	t := Totals{Packages: len(stats)}
+	for _, s := range stats {
+		t.Files += s.FileCount
+	}
+	return t
+}
+
+// ParseResult is the outcome of a parse: the sorted stats and the totals counted while scanning.
+type ParseResult struct {
+	Stats  []cache.PackageStats
+	Totals Totals
+}
+
+// Summary holds aggregate metrics computed over package statistics.
+type Summary struct {
+	TotalPackages     int    `json:"total_packages"`
+	TotalAssociations int    `json:"total_associations"`
+	TopPackage        string `json:"top_package,omitempty"`
+	TopCount          int    `json:"top_count,omitempty"`
+}
+
+// Summarize computes the summary metrics for stats
+// TotalAssociations is the sum of all file counts (file -> package pairs)
+func Summarize(stats []cache.PackageStats) Summary {
+	s := Summary{TotalPackages: len(stats)}
+	for _, st := range stats {
+		s.TotalAssociations += st.FileCount
+		if s.TopPackage == "" || st.FileCount > s.TopCount {
+			s.TopPackage = st.Name
+			s.TopCount = st.FileCount
+		}
+	}
+	return s
+}
 
-		fmt.Printf("%-5d %-40s %d\n", i+1, cleanName, stats[i].FileCount)
+// PrintSummary displays the summary block
+func PrintSummary(w io.Writer, s Summary) {
+	fmt.Fprintf(w, "%-20s %d\n", "Total packages:", s.TotalPackages)
+	fmt.Fprintf(w, "%-20s %d\n", "Total associations:", s.TotalAssociations)
+	if s.TopPackage != "" {
+		fmt.Fprintf(w, "%-20s %s (%d)\n", "Top package:", strings.TrimSpace(s.TopPackage), s.TopCount)
 	}
 }
@@ -2,16 +2,20 @@ package app
 
 import (
 	"bytes"
-	"os"
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/canonical-dev/package_statistics/internal/cache"
 )
 
 func TestProcessLine(t *testing.T) {
 	m := make(map[string]int)
-	ProcessLine("usr/bin/file1 pkg1,pkg2,pkg3", m)
+	ProcessLine("usr/bin/file1 pkg1,pkg2,pkg3", m, "")
 
 	if m["pkg1"] != 1 || m["pkg2"] != 1 || m["pkg3"] != 1 {
 		t.Errorf("got %v", m)
@@ -25,19 +29,386 @@ func TestProcessLineEdgeCases(t *testing.T) {
 	}{
 		{"", 0},
 		{"FILE header", 0},
-		{"usr/bin/file1pkg1", 0}, // no space
+		{"FILE\tLOCATION", 0},
+		{"FILES/readme misc/pkg", 1}, // a path that only starts like the legend
+		{"usr/bin/file1pkg1", 0},     // no space
 		{"usr/bin/file1 single-pkg", 1},
 	}
 
 	for _, tt := range tests {
 		m := make(map[string]int)
-		ProcessLine(tt.line, m)
+		ProcessLine(tt.line, m, "")
 		if len(m) != tt.want {
 			t.Errorf("line %q: got %d packages, want %d", tt.line, len(m), tt.want)
 		}
 	}
 }
 
+func TestProcessLinePathPrefix(t *testing.T) {
+	lines := []string{
+		"usr/bin/ls utils/coreutils",
+		"usr/bin/cat utils/coreutils",
+		"usr/bin/python3 python/python3-minimal,python/python3",
+		"usr/binutils/readme devel/binutils",
+		"usr/lib/libc.so.6 libs/libc6",
+		"usr/bin libs/weird-directory-entry",
+	}
+
+	m := make(map[string]int)
+	for _, line := range lines {
+		ProcessLine(line, m, "usr/bin/")
+	}
+	want := map[string]int{"utils/coreutils": 2, "python/python3-minimal": 1, "python/python3": 1}
+	if fmt.Sprint(m) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", m, want)
+	}
+
+	all := make(map[string]int)
+	for _, line := range lines {
+		ProcessLine(line, all, "")
+	}
+	if len(all) != 6 {
+		t.Errorf("empty prefix should count every line, got %v", all)
+	}
+}
+
+func TestLineParserSourceFormat(t *testing.T) {
+	line := "debian/source/format\t\t\t\tdevel/foo,libs/bar"
+
+	standard := make(map[string]int)
+	LineParser{}.Process(line, standard)
+	if len(standard) != 0 {
+		t.Errorf("standard parsing should not find a space separator, got %v", standard)
+	}
+
+	source := make(map[string]int)
+	LineParser{SourceFormat: true}.Process(line, source)
+	if source["devel/foo"] != 1 || source["libs/bar"] != 1 || len(source) != 2 {
+		t.Errorf("got %v", source)
+	}
+}
+
+func TestLineParserSamplingSeed(t *testing.T) {
+	data := strings.Split(syntheticContents(100), "\n")
+	run := func(seed int64) map[string]int {
+		m := make(map[string]int)
+		p := LineParser{SampleRate: 0.3, Seed: seed}
+		for _, line := range data {
+			p.Process(line, m)
+		}
+		return m
+	}
+
+	first, second := run(42), run(42)
+	if len(first) == 0 {
+		t.Fatal("sample should not be empty")
+	}
+	if fmt.Sprint(first) != fmt.Sprint(second) {
+		t.Error("same seed should produce identical sampled counts")
+	}
+	if fmt.Sprint(first) == fmt.Sprint(run(7)) {
+		t.Error("different seeds should sample different lines")
+	}
+
+	total := 0
+	for _, c := range first {
+		total += c
+	}
+	if total == 0 || total >= len(data) {
+		t.Errorf("sampled %d of %d lines", total, len(data))
+	}
+}
+
+func TestLineParserPathDepth(t *testing.T) {
+	lines := []string{
+		"usr/lib/x86_64-linux-gnu/libc.so.6 libs/libc6",
+		"usr/lib/python3/dist-packages/foo.py python/python3-foo",
+		"usr/bin/ls utils/coreutils",
+		"README misc/readme",
+	}
+	tests := []struct {
+		depth int
+		want  map[string]int
+	}{
+		{1, map[string]int{"usr": 3, "README": 1}},
+		{2, map[string]int{"usr/lib": 2, "usr/bin": 1, "README": 1}},
+		{3, map[string]int{"usr/lib/x86_64-linux-gnu": 1, "usr/lib/python3": 1, "usr/bin/ls": 1, "README": 1}},
+	}
+
+	for _, tt := range tests {
+		m := make(map[string]int)
+		p := LineParser{PathDepth: tt.depth}
+		for _, line := range lines {
+			p.Process(line, m)
+		}
+		if fmt.Sprint(m) != fmt.Sprint(tt.want) {
+			t.Errorf("depth %d: got %v, want %v", tt.depth, m, tt.want)
+		}
+	}
+}
+
+func TestFileExtension(t *testing.T) {
+	for path, want := range map[string]string{
+		"usr/include/stdio.h":                   ".h",
+		"usr/lib/python3/dist-packages/foo.py":  ".py",
+		"usr/share/doc/foo/changelog.Debian.gz": ".gz",
+		"usr/share/foo/data.tar.xz":             ".xz",
+		"usr/lib/x86_64-linux-gnu/libc.so.6":    ".so",
+		"usr/lib/libfoo.so.1.2.3":               ".so",
+		"usr/bin/ls":                            NoExtension,
+		"usr/bin/python3.11":                    NoExtension,
+		"etc/skel/.bashrc":                      NoExtension,
+		"etc/skel/.config.bak":                  ".bak",
+		"usr/share/foo/trailing.":               NoExtension,
+		"README":                                NoExtension,
+	} {
+		if got := fileExtension(path); got != want {
+			t.Errorf("%s: got %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestLineParserGroupByExtension(t *testing.T) {
+	lines := []string{
+		"usr/lib/x86_64-linux-gnu/libc.so.6 libs/libc6",
+		"usr/lib/x86_64-linux-gnu/libm.so.6 libs/libc6",
+		"usr/include/boost/a.hpp libdevel/libboost-dev,devel/boost-tools",
+		"usr/bin/ls utils/coreutils",
+		"usr/share/doc/coreutils/changelog.Debian.gz doc/coreutils",
+	}
+	m := make(map[string]int)
+	p := LineParser{GroupBy: GroupByExtension}
+	for _, line := range lines {
+		p.Process(line, m)
+	}
+	// a file is counted once however many packages ship it
+	want := map[string]int{".so": 2, ".hpp": 1, NoExtension: 1, ".gz": 1}
+	if fmt.Sprint(m) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", m, want)
+	}
+}
+
+func TestLineParserUdeb(t *testing.T) {
+	input := "usr/bin/a admin/cron\n" +
+		"lib/debian-installer/menu debian-installer/main-menu\n" +
+		"usr/lib/cdebconf/a.so admin/cdebconf-udeb,admin/cdebconf\n" +
+		"usr/lib/fw non-free/debian-installer/firmware-foo\n"
+	for _, tt := range []struct {
+		parser LineParser
+		want   string
+	}{
+		{LineParser{}, "[{admin/cdebconf 1} {admin/cron 1}]"},
+		{LineParser{IncludeUdeb: true}, "[{admin/cdebconf 1} {admin/cdebconf-udeb 1} {admin/cron 1} {debian-installer/main-menu 1} {non-free/debian-installer/firmware-foo 1}]"},
+		// files provided only by udebs aren't counted by path either
+		{LineParser{PathDepth: 1}, "[{usr 2}]"},
+		{LineParser{PathDepth: 1, IncludeUdeb: true}, "[{usr 3} {lib 1}]"},
+		{LineParser{Providers: true}, "[{1 2}]"},
+	} {
+		stats, err := tt.parser.Parse(context.Background(), strings.NewReader(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(stats); got != tt.want {
+			t.Errorf("%+v: got %s, want %s", tt.parser, got, tt.want)
+		}
+	}
+
+	for pkg, want := range map[string]bool{
+		"debian-installer/main-menu":      true,
+		"contrib/debian-installer/foo":    true,
+		"admin/cdebconf-udeb":             true,
+		"cdebconf-udeb":                   true,
+		"admin/cdebconf":                  false,
+		"debian-installer-launcher":       false,
+		"admin/debian-installer-launcher": false,
+	} {
+		if IsUdeb(pkg) != want {
+			t.Errorf("IsUdeb(%q) = %v, want %v", pkg, !want, want)
+		}
+	}
+}
+
+func TestLineParserDedupe(t *testing.T) {
+	input := "usr/bin/a pkg1\n" +
+		"usr/bin/a pkg1\n" + // listed twice, e.g. through a diversion
+		"usr/bin/a pkg2\n" + // same path, another package
+		"usr/bin/b pkg1,pkg2\n" +
+		"usr/bin/b pkg2\n"
+	for _, tt := range []struct {
+		parser LineParser
+		want   string
+	}{
+		{LineParser{}, "[{pkg1 3} {pkg2 3}]"},
+		{LineParser{Dedupe: true}, "[{pkg1 2} {pkg2 2}]"},
+		{LineParser{Dedupe: true, Workers: 4}, "[{pkg1 2} {pkg2 2}]"},
+	} {
+		stats, err := tt.parser.Parse(context.Background(), strings.NewReader(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(stats); got != tt.want {
+			t.Errorf("%+v: got %s, want %s", tt.parser, got, tt.want)
+		}
+	}
+
+	// the duplicated line alone: 1 with -dedupe, 2 without
+	dup := "usr/share/doc/foo/copyright doc/foo\nusr/share/doc/foo/copyright doc/foo\n"
+	for dedupe, want := range map[bool]int{false: 2, true: 1} {
+		stats, err := LineParser{Dedupe: dedupe}.Parse(context.Background(), strings.NewReader(dup))
+		if err != nil || len(stats) != 1 || stats[0].FileCount != want {
+			t.Errorf("dedupe %v: got %v, %v, want a count of %d", dedupe, stats, err, want)
+		}
+	}
+}
+
+func TestLineParserPackagePrefix(t *testing.T) {
+	lines := []string{
+		"usr/lib/libc.so.6 libs/libc6",
+		"usr/include/boost/a.hpp libdevel/libboost-dev,devel/boost-tools",
+		"usr/bin/ls utils/coreutils",
+	}
+	tests := []struct {
+		prefix string
+		want   map[string]int
+	}{
+		{"lib", map[string]int{"libs/libc6": 1, "libdevel/libboost-dev": 1}},
+		{"libdevel/", map[string]int{"libdevel/libboost-dev": 1}},
+		{"core", map[string]int{"utils/coreutils": 1}},
+		{"nomatch", map[string]int{}},
+	}
+
+	for _, tt := range tests {
+		m := make(map[string]int)
+		p := LineParser{PackagePrefix: tt.prefix}
+		for _, line := range lines {
+			p.Process(line, m)
+		}
+		if fmt.Sprint(m) != fmt.Sprint(tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.prefix, m, tt.want)
+		}
+	}
+}
+
+func TestLineParserStripSection(t *testing.T) {
+	tests := []struct {
+		line string
+		want map[string]int
+	}{
+		{"usr/sbin/cron admin/cron", map[string]int{"cron": 1}},
+		{"usr/bin/foo universe/utils/foo", map[string]int{"foo": 1}},
+		{"usr/bin/bar bar", map[string]int{"bar": 1}},
+		{"usr/share/x admin/cron,utils/coreutils, cron", map[string]int{"cron": 2, "coreutils": 1}},
+		{"usr/share/y net/curl,wget", map[string]int{"curl": 1, "wget": 1}},
+	}
+
+	for _, tt := range tests {
+		m := make(map[string]int)
+		LineParser{StripSection: true}.Process(tt.line, m)
+		if fmt.Sprint(m) != fmt.Sprint(tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.line, m, tt.want)
+		}
+	}
+}
+
+func TestLineParserProviders(t *testing.T) {
+	lines := []string{
+		"FILE LOCATION",
+		"usr/bin/a pkg1",
+		"usr/bin/b pkg2",
+		"usr/share/c pkg1,pkg2",
+		"usr/share/d pkg1, pkg2 ,pkg3",
+		"usr/share/e pkg1,,",
+	}
+
+	m := make(map[string]int)
+	p := LineParser{Providers: true}
+	for _, line := range lines {
+		p.Process(line, m)
+	}
+	if want := map[string]int{"1": 3, "2": 1, "3": 1}; fmt.Sprint(m) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", m, want)
+	}
+}
+
+func TestFilterPrefix(t *testing.T) {
+	stats := []cache.PackageStats{{Name: "libs/libc6", FileCount: 3}, {Name: "utils/coreutils", FileCount: 2}}
+
+	got := FilterPrefix(stats, "lib")
+	if len(got) != 1 || got[0].Name != "libs/libc6" {
+		t.Errorf("got %+v", got)
+	}
+	if len(FilterPrefix(stats, "")) != 2 {
+		t.Error("empty prefix should keep everything")
+	}
+}
+
+func TestFilterMinCount(t *testing.T) {
+	stats := []cache.PackageStats{{Name: "a", FileCount: 5}, {Name: "b", FileCount: 2}, {Name: "c", FileCount: 1}}
+
+	got := FilterMinCount(stats, 2)
+	if len(got) != 2 || got[1].Name != "b" {
+		t.Errorf("got %+v", got)
+	}
+	if len(FilterMinCount(stats, 0)) != 3 {
+		t.Error("0 should keep everything")
+	}
+}
+
+func TestFilterRegexp(t *testing.T) {
+	stats := []cache.PackageStats{
+		{Name: "libs/libc6", FileCount: 3},
+		{Name: "libdevel/libboost-dev", FileCount: 2},
+		{Name: "utils/coreutils", FileCount: 1},
+	}
+
+	got := FilterRegexp(stats, regexp.MustCompile(`^lib`))
+	if len(got) != 2 || got[0].Name != "libs/libc6" || got[1].Name != "libdevel/libboost-dev" {
+		t.Errorf("got %+v", got)
+	}
+	got = FilterRegexp(stats, regexp.MustCompile(`/lib.*-dev$`))
+	if len(got) != 1 || got[0].Name != "libdevel/libboost-dev" {
+		t.Errorf("got %+v", got)
+	}
+	if len(FilterRegexp(stats, nil)) != 3 {
+		t.Error("nil filter should keep everything")
+	}
+}
+
+func TestParseFlagsFilter(t *testing.T) {
+	cfg, err := parseArgs(t, "-filter", "^lib", "amd64")
+	if err != nil || cfg.Filter == nil || cfg.Filter.String() != "^lib" {
+		t.Errorf("got %+v, %v", cfg, err)
+	}
+	if cfg, err := parseArgs(t, "amd64"); err != nil || cfg.Filter != nil {
+		t.Errorf("unset filter should be nil, got %+v, %v", cfg, err)
+	}
+	if _, err := parseArgs(t, "-filter", "lib(", "amd64"); err == nil {
+		t.Error("expected error for invalid pattern")
+	}
+}
+
+func BenchmarkProcessLinePackagePrefix(b *testing.B) {
+	lines := strings.Split(syntheticContents(300), "\n")
+	for _, bc := range []struct {
+		name   string
+		parser LineParser
+	}{
+		{"all", LineParser{}},
+		{"prefix", LineParser{PackagePrefix: "pkg1"}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			var m map[string]int
+			for i := 0; i < b.N; i++ {
+				m = make(map[string]int)
+				for _, line := range lines {
+					bc.parser.Process(line, m)
+				}
+			}
+			b.ReportMetric(float64(len(m)), "keys")
+		})
+	}
+}
+
 func TestSortMap(t *testing.T) {
 	m := map[string]int{
 		"pkg-low":  5,
@@ -55,21 +426,292 @@ func TestSortMap(t *testing.T) {
 	}
 }
 
-func TestPrintTop(t *testing.T) {
-	r, w, _ := os.Pipe()
-	old := os.Stdout
-	defer func() { os.Stdout = old }()
-	os.Stdout = w
+func TestSortMapBy(t *testing.T) {
+	m := map[string]int{"b": 3, "a": 3, "c": 9, "d": 1}
+	for _, tt := range []struct {
+		by   string
+		want []string
+	}{
+		// equal counts fall back to the name
+		{SortCount, []string{"c", "a", "b", "d"}},
+		{SortName, []string{"a", "b", "c", "d"}},
+	} {
+		var got []string
+		for _, s := range SortMapBy(m, tt.by) {
+			got = append(got, s.Name)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.by, got, tt.want)
+		}
+	}
+}
 
-	stats := []cache.PackageStats{{Name: "pkg1", FileCount: 100}}
-	PrintTop(stats, 5)
-	w.Close()
+func TestRankingBreaksTiesByName(t *testing.T) {
+	m := map[string]int{"top": 9, "delta": 4, "alpha": 4, "echo": 4, "charlie": 4, "bravo": 4, "low": 1}
+	want := []string{"top", "alpha", "bravo", "charlie", "delta", "echo", "low"}
+
+	// map iteration order changes between runs, so repeat to catch an order that only holds by luck
+	for range 20 {
+		for name, got := range map[string][]cache.PackageStats{
+			"SortMap": SortMap(m),
+			"TopN":    TopN(m, 3),
+			"RankMap": RankMap(m, 0),
+		} {
+			var names []string
+			for _, s := range got {
+				names = append(names, s.Name)
+			}
+			if !slices.Equal(names, want[:len(names)]) {
+				t.Fatalf("%s: got %v, want a prefix of %v", name, names, want)
+			}
+		}
+	}
+}
+
+func TestTopNMatchesSortMap(t *testing.T) {
+	m := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		m[fmt.Sprintf("pkg%d", i)] = (i * 7919) % 1000
+	}
+
+	for _, n := range []int{1, 10, 999, 1000, 2000} {
+		got := TopN(m, n)
+		want := SortMap(m)
+		if len(want) > n {
+			want = want[:n]
+		}
+		if len(got) != len(want) {
+			t.Fatalf("n=%d: got %d entries, want %d", n, len(got), len(want))
+		}
+		for i := range got {
+			if got[i].FileCount != want[i].FileCount || m[got[i].Name] != got[i].FileCount {
+				t.Errorf("n=%d: entry %d got %+v, want count %d", n, i, got[i], want[i].FileCount)
+				break
+			}
+		}
+	}
+	if len(TopN(m, 0)) != 0 {
+		t.Error("n=0 should be empty")
+	}
+	if len(RankMap(m, 0)) != len(m) || len(RankMap(m, 5)) != 5 {
+		t.Error("RankMap should keep all packages for top 0 and truncate otherwise")
+	}
+}
+
+// syntheticCounts builds a counts map with n packages
+func syntheticCounts(n int) map[string]int {
+	m := make(map[string]int, n)
+	for i := 0; i < n; i++ {
+		m[fmt.Sprintf("section/pkg%d", i)] = (i * 7919) % 50000
+	}
+	return m
+}
+
+func BenchmarkTopN(b *testing.B) {
+	m := syntheticCounts(100_000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = TopN(m, 10)
+	}
+}
+
+func BenchmarkSortMap(b *testing.B) {
+	m := syntheticCounts(100_000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = SortMap(m)[:10]
+	}
+}
+
+func TestSortStatsAscending(t *testing.T) {
+	stats := []cache.PackageStats{{Name: "mid", FileCount: 5}, {Name: "high", FileCount: 50}, {Name: "low", FileCount: 1}}
+
+	SortStats(stats, true)
+	if stats[0].Name != "low" || stats[1].Name != "mid" || stats[2].Name != "high" {
+		t.Errorf("got %+v", stats)
+	}
+	SortStats(stats, false)
+	if stats[0].Name != "high" || stats[2].Name != "low" {
+		t.Errorf("got %+v", stats)
+	}
+}
 
+func TestPrintTop(t *testing.T) {
 	var buf bytes.Buffer
-	_, _ = buf.ReadFrom(r)
-	output := buf.String()
+	stats := []cache.PackageStats{{Name: "pkg1", FileCount: 100}}
+	PrintTop(&buf, stats, 5, TotalsOf(stats), TableStyle{})
 
-	if !strings.Contains(output, "pkg1") {
+	if !strings.Contains(buf.String(), "pkg1") {
 		t.Error("missing pkg1")
 	}
 }
+
+func TestPrintTopFooter(t *testing.T) {
+	var buf bytes.Buffer
+	stats := []cache.PackageStats{{Name: "pkg1", FileCount: 1234000}, {Name: "pkg2", FileCount: 567}}
+	PrintTop(&buf, stats, 1, TotalsOf(stats), TableStyle{})
+
+	if !strings.HasSuffix(buf.String(), "\nParsed 1,234,567 file entries across 2 packages\n") {
+		t.Errorf("got %q", buf.String())
+	}
+}
+
+func TestPrintTopGroupsThousands(t *testing.T) {
+	stats := []cache.PackageStats{
+		{Name: "huge", FileCount: 1234567},
+		{Name: "big", FileCount: 15432},
+		{Name: "thousand", FileCount: 1000},
+		{Name: "small", FileCount: 999},
+		{Name: "one", FileCount: 1},
+	}
+	for _, tt := range []struct {
+		raw  bool
+		want []string
+	}{
+		{false, []string{"1,234,567", "15,432", "1,000", "999", "1"}},
+		{true, []string{"1234567", "15432", "1000", "999", "1"}},
+	} {
+		var buf bytes.Buffer
+		PrintTop(&buf, stats, 0, TotalsOf(stats), TableStyle{RawNumbers: tt.raw})
+		lines := strings.Split(buf.String(), "\n")
+		for i, want := range tt.want {
+			fields := strings.Fields(lines[i+2])
+			if got := fields[len(fields)-1]; got != want {
+				t.Errorf("raw %v: row %d got count %q, want %q", tt.raw, i+1, got, want)
+			}
+		}
+		if footer := "Parsed " + countFormatter(tt.raw)(1251999) + " file entries"; !strings.Contains(buf.String(), footer) {
+			t.Errorf("raw %v: missing %q in %q", tt.raw, footer, buf.String())
+		}
+	}
+}
+
+func TestPrintTopColor(t *testing.T) {
+	stats := []cache.PackageStats{{Name: "first", FileCount: 3000}, {Name: "second", FileCount: 20}, {Name: "third", FileCount: 1}}
+
+	var plain bytes.Buffer
+	PrintTop(&plain, stats, 0, TotalsOf(stats), TableStyle{})
+	if strings.Contains(plain.String(), "\x1b") {
+		t.Errorf("uncolored output must not contain escape sequences, got %q", plain.String())
+	}
+
+	var colored bytes.Buffer
+	PrintTop(&colored, stats, 0, TotalsOf(stats), TableStyle{Color: true})
+	lines := strings.Split(colored.String(), "\n")
+	if !strings.HasPrefix(lines[2], ansiBold+"1 ") || !strings.Contains(lines[2], ansiDim+"3,000"+ansiReset) {
+		t.Errorf("rank 1 should be bold with a dimmed count, got %q", lines[2])
+	}
+	if !strings.HasPrefix(lines[3], ansiCyan+"2 ") || strings.HasPrefix(lines[4], "\x1b[3") {
+		t.Errorf("every other row should be cyan, got %q and %q", lines[3], lines[4])
+	}
+	// the escapes wrap padded columns, so stripping them gives the plain table back
+	stripped := regexp.MustCompile("\x1b\\[[0-9;]*m").ReplaceAllString(colored.String(), "")
+	if stripped != plain.String() {
+		t.Errorf("colors changed the layout:\n%s\nwant:\n%s", stripped, plain.String())
+	}
+}
+
+func TestUseColor(t *testing.T) {
+	// go test's stdout is not a terminal, so auto never colors here
+	for _, tt := range []struct {
+		cfg  Config
+		want bool
+	}{
+		{Config{}, false},
+		{Config{Color: ColorNever}, false},
+		{Config{Color: ColorAuto}, false},
+		{Config{Color: ColorAlways}, true},
+		{Config{Color: ColorAlways, Output: "out.txt"}, true},
+	} {
+		if got := tt.cfg.UseColor(); got != tt.want {
+			t.Errorf("-color %q -output %q: got %v", tt.cfg.Color, tt.cfg.Output, got)
+		}
+	}
+
+	var buf bytes.Buffer
+	stats := []cache.PackageStats{{Name: "pkg1", FileCount: 1}, {Name: "pkg2", FileCount: 1}}
+	for _, color := range []string{ColorNever, ColorAuto} {
+		buf.Reset()
+		if err := PrintResults(&buf, stats, &Config{Color: color, Format: FormatText}); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(buf.String(), "\x1b") {
+			t.Errorf("-color %s: got escape sequences in %q", color, buf.String())
+		}
+	}
+}
+
+func TestParseWithTotals(t *testing.T) {
+	input := "usr/bin/a pkg1\nusr/bin/b pkg1,pkg2\n\nusr/bin/c pkg3\n"
+	res, err := ParseContentsWithTotals(context.Background(), strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// b is shipped by two packages and counts for both
+	if res.Totals != (Totals{Files: 4, Packages: 3}) || res.Totals != TotalsOf(res.Stats) {
+		t.Errorf("got %+v for %v", res.Totals, res.Stats)
+	}
+}
+
+// countingWriter records how many writes reach it
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.writes++
+	return c.Buffer.Write(p)
+}
+
+func TestStreamTopFlushesIncrementally(t *testing.T) {
+	var stats []cache.PackageStats
+	for i := 0; i < 1000; i++ {
+		stats = append(stats, cache.PackageStats{Name: fmt.Sprintf("pkg%d", i), FileCount: 1000 - i})
+	}
+
+	var w countingWriter
+	StreamTop(&w, stats, 0, 100, TableStyle{})
+
+	if w.writes < 10 {
+		t.Errorf("got %d writes, want at least one per 100 rows", w.writes)
+	}
+	if lines := strings.Count(w.String(), "\n"); lines != 1002 {
+		t.Errorf("got %d lines, want header, separator and 1000 rows", lines)
+	}
+
+	var small countingWriter
+	StreamTop(&small, stats, 5, 100, TableStyle{})
+	if small.writes != 1 {
+		t.Errorf("small tables should be written at once, got %d writes", small.writes)
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	stats := []cache.PackageStats{
+		{Name: "pkg-high", FileCount: 50},
+		{Name: "pkg-low", FileCount: 5},
+	}
+
+	s := Summarize(stats)
+
+	if s.TotalPackages != 2 || s.TotalAssociations != 55 {
+		t.Errorf("got %+v", s)
+	}
+	if s.TopPackage != "pkg-high" || s.TopCount != 50 {
+		t.Errorf("got top %s (%d)", s.TopPackage, s.TopCount)
+	}
+}
+
+func TestFormatTimestamp(t *testing.T) {
+	local := time.Date(2025, 9, 10, 4, 45, 23, 444001455, time.FixedZone("CEST", 2*60*60))
+
+	got := FormatTimestamp(local)
+
+	if got != "2025-09-10T02:45:23Z" {
+		t.Errorf("got %s", got)
+	}
+	if _, err := time.Parse(time.RFC3339, got); err != nil {
+		t.Errorf("not RFC3339: %v", err)
+	}
+}
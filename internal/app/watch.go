@@ -0,0 +1,118 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// Porcelain tokens, stable for scripts to branch on
+const (
+	PorcelainChanged   = "CHANGED"
+	PorcelainUnchanged = "UNCHANGED"
+)
+
+// watchBackoff adapts the watch interval to how often the data changes.
+type watchBackoff struct {
+	base    time.Duration
+	max     time.Duration
+	current time.Duration
+}
+
+// newWatchBackoff starts at base and never grows beyond max (max < base means no backoff)
+func newWatchBackoff(base, max time.Duration) *watchBackoff {
+	if max < base {
+		max = base
+	}
+	return &watchBackoff{base: base, max: max, current: base}
+}
+
+// next returns the wait before the following run
+// unchanged data doubles the interval up to max, a change resets it to base
+func (b *watchBackoff) next(changed bool) time.Duration {
+	if changed {
+		b.current = b.base
+		return b.current
+	}
+	b.current *= 2
+	if b.current > b.max {
+		b.current = b.max
+	}
+	return b.current
+}
+
+/*
+Watch re-runs Analyze every interval until ctx is cancelled, keeping the cache warm.
+
+The short cache window is skipped so every run revalidates with the mirror.
+When consecutive runs see unchanged data (HEAD not modified), the interval
+backs off up to WatchMaxInterval to reduce load on the mirror, and resets to
+the base interval as soon as a change is detected.
+
+Runs never overlap: the next one starts an interval after the previous one started,
+and a run that takes longer than the interval skips the checks it missed instead of
+starting the next run straight away.
+Every run's outcome is logged, onResult is called after every successful run.
+*/
+func (a *App) Watch(ctx context.Context, onResult func(Result)) error {
+	a.cfg.ShortCacheWindow = 0
+	backoff := newWatchBackoff(a.cfg.Watch, a.cfg.WatchMaxInterval)
+	interval := backoff.base
+
+	for run := 1; ; run++ {
+		start := time.Now()
+		res, err := a.Analyze(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		elapsed := time.Since(start)
+		if err != nil {
+			logAt(a.logger, slog.LevelError, nil, "Watch run %d failed after %v: %v", run, elapsed.Truncate(time.Millisecond), err)
+		} else {
+			interval = backoff.next(a.changed)
+			outcome := "unchanged"
+			if a.changed {
+				outcome = "changed"
+			}
+			a.logger.Printf("Watch run %d finished in %v: %d packages, %s", run, elapsed.Truncate(time.Millisecond), len(res.Stats), outcome)
+			if onResult != nil {
+				onResult(res)
+			}
+		}
+
+		wait := interval - time.Since(start)
+		if wait > 0 {
+			a.logger.Printf("Next check in %v", interval)
+		} else {
+			elapsed = time.Since(start)
+			wait = interval - elapsed%interval
+			a.logger.Printf("Watch run %d took longer than the %v interval, skipping %d missed checks, next check in %v",
+				run, interval, elapsed/interval, wait.Truncate(time.Millisecond))
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+/*
+PrintPorcelain writes the outcome of the last analysis as a single line
+output: CHANGED "v2" or UNCHANGED "v1"
+a missing ETag is written as "-" so the line always has two fields
+*/
+func (a *App) PrintPorcelain(w io.Writer) error {
+	token := PorcelainUnchanged
+	if a.changed {
+		token = PorcelainChanged
+	}
+	etag := a.etag
+	if etag == "" {
+		etag = "-"
+	}
+	_, err := fmt.Fprintf(w, "%s %s\n", token, etag)
+	return err
+}
@@ -0,0 +1,223 @@
+package app
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWatchBackoff(t *testing.T) {
+	b := newWatchBackoff(time.Minute, 5*time.Minute)
+
+	var got []time.Duration
+	for i := 0; i < 4; i++ {
+		got = append(got, b.next(false))
+	}
+	want := []time.Duration{2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("step %d: got %v, want %v", i, got[i], want[i])
+		}
+	}
+
+	if d := b.next(true); d != time.Minute {
+		t.Errorf("change should reset to base, got %v", d)
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for use as a log sink
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.String()
+}
+
+func TestWatchBacksOffOnNotModified(t *testing.T) {
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	_, _ = gz.Write([]byte("usr/bin/a pkg1\n"))
+	gz.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == "v1" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", "v1")
+		_, _ = w.Write(body.Bytes())
+	}))
+	defer server.Close()
+
+	var logs syncBuffer
+	app := NewApp(&Config{
+		Architecture:     "amd64",
+		CacheDir:         t.TempDir(),
+		CacheTTL:         time.Hour,
+		ShortCacheWindow: time.Hour,
+		NoProgress:       true,
+		Watch:            10 * time.Millisecond,
+		WatchMaxInterval: 40 * time.Millisecond,
+	}, WithLogger(log.New(&logs, "", 0)))
+	app.baseURL = server.URL + "/Contents-{arch}.gz"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runs := 0
+	err := app.Watch(ctx, func(Result) {
+		runs++
+		if runs == 5 {
+			cancel()
+		}
+	})
+	if err != context.Canceled {
+		t.Fatalf("got %v", err)
+	}
+
+	var intervals []string
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if strings.HasPrefix(line, "Next check in ") {
+			intervals = append(intervals, strings.TrimPrefix(line, "Next check in "))
+		}
+	}
+	want := []string{"10ms", "20ms", "40ms", "40ms", "40ms"}
+	if strings.Join(intervals, ",") != strings.Join(want, ",") {
+		t.Errorf("got intervals %v, want %v", intervals, want)
+	}
+}
+
+func TestWatchPorcelain(t *testing.T) {
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	_, _ = gz.Write([]byte("usr/bin/a pkg1\n"))
+	gz.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == "v1" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", "v1")
+		_, _ = w.Write(body.Bytes())
+	}))
+	defer server.Close()
+
+	app := NewApp(&Config{
+		Architecture:     "amd64",
+		CacheDir:         t.TempDir(),
+		CacheTTL:         time.Hour,
+		NoProgress:       true,
+		Porcelain:        true,
+		Watch:            time.Millisecond,
+		WatchMaxInterval: time.Millisecond,
+	}, WithLogger(log.New(io.Discard, "", 0)))
+	app.baseURL = server.URL + "/Contents-{arch}.gz"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var out bytes.Buffer
+	runs := 0
+	_ = app.Watch(ctx, func(Result) {
+		_ = app.PrintPorcelain(&out)
+		runs++
+		if runs == 3 {
+			cancel()
+		}
+	})
+
+	want := "CHANGED v1\nUNCHANGED v1\nUNCHANGED v1\n"
+	if out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+}
+
+func TestPrintPorcelainWithoutETag(t *testing.T) {
+	app := NewApp(&Config{}, WithLogger(log.New(io.Discard, "", 0)))
+	app.changed = true
+
+	var out bytes.Buffer
+	_ = app.PrintPorcelain(&out)
+	if out.String() != "CHANGED -\n" {
+		t.Errorf("got %q", out.String())
+	}
+}
+
+func TestWatchSkipsMissedChecks(t *testing.T) {
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	_, _ = gz.Write([]byte("usr/bin/a pkg1\n"))
+	gz.Close()
+
+	var mu sync.Mutex
+	active, maxActive := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			mu.Lock()
+			active++
+			maxActive = max(maxActive, active)
+			mu.Unlock()
+			// every run takes longer than the watch interval
+			time.Sleep(30 * time.Millisecond)
+			mu.Lock()
+			active--
+			mu.Unlock()
+		}
+		_, _ = w.Write(body.Bytes())
+	}))
+	defer server.Close()
+
+	var logs syncBuffer
+	app := NewApp(&Config{
+		Architecture: "amd64",
+		CacheDir:     t.TempDir(),
+		CacheTTL:     time.Hour,
+		NoProgress:   true,
+		Watch:        10 * time.Millisecond,
+	}, WithLogger(log.New(&logs, "", 0)))
+	app.baseURL = server.URL + "/Contents-{arch}.gz"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runs := 0
+	_ = app.Watch(ctx, func(Result) {
+		runs++
+		if runs == 3 {
+			cancel()
+		}
+	})
+
+	if maxActive != 1 {
+		t.Errorf("runs overlapped: %d downloads at once", maxActive)
+	}
+	output := logs.String()
+	for _, want := range []string{"Watch run 1 finished in ", ": 1 packages, changed", "Watch run 1 took longer than the 10ms interval, skipping "} {
+		if !strings.Contains(output, want) {
+			t.Errorf("missing %q in:\n%s", want, output)
+		}
+	}
+}
+
+func TestParseFlagsPrintEach(t *testing.T) {
+	cfg, err := parseArgs(t, "-watch", "1h", "-print-each", "amd64")
+	if err != nil || !cfg.PrintEach {
+		t.Errorf("got %+v, %v", cfg, err)
+	}
+	if _, err := parseArgs(t, "-print-each", "amd64"); err == nil {
+		t.Error("-print-each without -watch should fail")
+	}
+}
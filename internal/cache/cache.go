@@ -2,12 +2,18 @@
 package cache
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/md5"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/gofrs/flock"
@@ -21,14 +27,54 @@ const (
 	LockTimeout = 30 * time.Second
 	// LockStaleTTL is when to consider a lock file stale and remove it.
 	LockStaleTTL = 1 * time.Hour
+	// TempStaleTTL is when to consider a .tmp left behind by an interrupted SaveCache orphaned.
+	TempStaleTTL = 1 * time.Hour
+
+	// CompressedExt marks a gzip-compressed cache, SaveCache compresses files ending with it.
+	CompressedExt = ".gz"
 )
 
+// cachePatterns match every cache file in a cache dir, plain and compressed
+var cachePatterns = []string{"contents-*.json", "contents-*.json" + CompressedExt}
+
+// globCaches returns the files matching any of patterns in dir and in its <suite>/<component>
+// subdirectories, where -cache-dir-per-suite keeps its caches
+func globCaches(dir string, patterns []string) ([]string, error) {
+	var files []string
+	for _, pattern := range patterns {
+		for _, nested := range []string{pattern, filepath.Join("*", "*", pattern)} {
+			matches, err := filepath.Glob(filepath.Join(dir, nested))
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, matches...)
+		}
+	}
+	return files, nil
+}
+
+// gzipMagic starts every gzip stream
+var gzipMagic = []byte{0x1f, 0x8b}
+
 // PackageStats holds the name and file count for a package.
 type PackageStats struct {
 	Name      string `json:"name"`
 	FileCount int    `json:"file_count"`
 }
 
+// Totals counts what a parse saw.
+// Files counts file references: a path shipped by two packages counts for both,
+// so on the full data it always equals the sum of the FileCounts.
+type Totals struct {
+	Files    int `json:"files"`
+	Packages int `json:"packages"`
+}
+
+// Logger is the printf-style logger used to report lock problems, *log.Logger satisfies it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
 // CacheEntry represents a complete cache entry with metadata.
 type CacheEntry struct {
 	Architecture string         `json:"architecture"`
@@ -38,35 +84,117 @@ type CacheEntry struct {
 	LastModified string         `json:"last_modified,omitempty"`
 	URL          string         `json:"url"`
 	Checksum     string         `json:"checksum,omitempty"`
+	// Totals is what the parse counted, nil in entries written before it was stored
+	Totals *Totals `json:"totals,omitempty"`
+	// File is the path the entry was read from by ListEntries or ReadEntry, it isn't stored
+	File string `json:"-"`
 }
 
 // LoadCache loads JSON cache and validates TTL
+// gzip-compressed files are detected by content, whatever their name
+// a checksum that doesn't match the stats removes the file, entries written without one are trusted
 func LoadCache(file string, ttl time.Duration) (*CacheEntry, error) {
+	return LoadCacheAt(file, ttl, time.Now())
+}
+
+// LoadCacheAt is LoadCache with the entry's age measured at now instead of the current time
+func LoadCacheAt(file string, ttl time.Duration, now time.Time) (*CacheEntry, error) {
 	data, err := os.ReadFile(file)
 	if err != nil {
 		return nil, err
 	}
 	var entry CacheEntry
-	if err := json.Unmarshal(data, &entry); err != nil {
+	if err := decodeEntry(data, &entry); err != nil {
 		_ = os.Remove(file)
 		return nil, fmt.Errorf("corrupt cache removed")
 	}
-	if time.Since(entry.Timestamp) > ttl {
+	if entry.Checksum != "" {
+		sum, err := checksum(entry.Stats)
+		if err != nil || sum != entry.Checksum {
+			_ = os.Remove(file)
+			return nil, fmt.Errorf("cache checksum mismatch, removed")
+		}
+	}
+	if now.Sub(entry.Timestamp) > ttl {
 		return nil, fmt.Errorf("cache expired")
 	}
 	return &entry, nil
 }
 
+// ReadEntry reads the cache at file for inspection: no TTL or checksum check, and nothing is removed
+func ReadEntry(file string) (*CacheEntry, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var entry CacheEntry
+	if err := decodeEntry(data, &entry); err != nil {
+		return nil, fmt.Errorf("corrupt cache %s: %w", file, err)
+	}
+	entry.File = file
+	return &entry, nil
+}
+
+// decodeEntry parses the JSON of a cache file, decompressing it first when it is gzipped
+func decodeEntry(data []byte, entry *CacheEntry) error {
+	if bytes.HasPrefix(data, gzipMagic) {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		if data, err = io.ReadAll(zr); err != nil {
+			return err
+		}
+	}
+	return json.Unmarshal(data, entry)
+}
+
+/*
+ListEntries reads every cache (contents-*.json and .json.gz) in dir and its <suite>/<component> subdirectories,
+sorted by path, without TTL or checksum checks.
+
+The stats are decoded as well since they give the package count.
+Unreadable or corrupt files are skipped and reported together in the error,
+the readable entries are returned either way. Nothing is removed.
+*/
+func ListEntries(dir string) ([]CacheEntry, error) {
+	files, err := globCaches(dir, cachePatterns)
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(files)
+	var entries []CacheEntry
+	var errs []error
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		var entry CacheEntry
+		if err := decodeEntry(data, &entry); err != nil {
+			errs = append(errs, fmt.Errorf("corrupt cache %s: %w", file, err))
+			continue
+		}
+		entry.File = file
+		entries = append(entries, entry)
+	}
+	return entries, errors.Join(errs...)
+}
+
 // SaveCache writes JSON cache safely with checksum
+// a file name ending in CompressedExt is written gzip-compressed
 func SaveCache(file string, entry *CacheEntry) error {
-	data, err := json.Marshal(entry.Stats)
+	sum, err := checksum(entry.Stats)
 	if err != nil {
 		return err
 	}
-	// we are not handling checksum logics for now
-	entry.Checksum = fmt.Sprintf("%x", md5.Sum(data))
+	entry.Checksum = sum
 
 	tmp := file + ".tmp"
+	// a previous save killed before its rename may have left the tmp behind
+	_ = os.Remove(tmp)
 	out, err := os.Create(tmp)
 	if err != nil {
 		return err
@@ -76,11 +204,25 @@ func SaveCache(file string, entry *CacheEntry) error {
 		_ = os.Remove(tmp)
 	}()
 
-	enc := json.NewEncoder(out)
-	enc.SetIndent("", "  ")
+	var w io.Writer = out
+	var zw *gzip.Writer
+	if strings.HasSuffix(file, CompressedExt) {
+		zw = gzip.NewWriter(out)
+		w = zw
+	}
+	enc := json.NewEncoder(w)
+	if zw == nil {
+		// compressed caches aren't read by hand, indenting would only cost space
+		enc.SetIndent("", "  ")
+	}
 	if err := enc.Encode(entry); err != nil {
 		return err
 	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	}
 
 	if err := out.Sync(); err != nil {
 		return err
@@ -99,6 +241,158 @@ func SaveCache(file string, entry *CacheEntry) error {
 	return fmt.Errorf("failed to rename tmp cache file: %s", file)
 }
 
+/*
+ClearAll removes every cache file (contents-*.json and .json.gz) in dir and its <suite>/<component> subdirectories
+together with its .lock, .tmp, .partial and .partial.etag files
+and returns how many files were removed.
+
+Each cache's lock is taken without waiting first: a cache locked by another process
+is being written and is left in place.
+*/
+func ClearAll(dir string) (int, error) {
+	patterns := slices.Clone(cachePatterns)
+	for _, suffix := range cacheSidecars {
+		patterns = append(patterns, suffixed(suffix)...)
+	}
+	matches, err := globCaches(dir, patterns)
+	if err != nil {
+		return 0, err
+	}
+	var bases []string
+	for _, m := range matches {
+		if base := cacheBase(m); !slices.Contains(bases, base) {
+			bases = append(bases, base)
+		}
+	}
+
+	removed := 0
+	for _, base := range bases {
+		lockFile := base + ".lock"
+		_, statErr := os.Stat(lockFile)
+		f := flock.New(lockFile)
+		locked, err := f.TryLock()
+		if err != nil {
+			return removed, err
+		}
+		if !locked {
+			continue
+		}
+		for _, file := range []string{base, base + ".tmp", base + ".partial", base + ".partial.etag"} {
+			if os.Remove(file) == nil {
+				removed++
+			}
+		}
+		_ = f.Unlock()
+		if os.Remove(lockFile) == nil && statErr == nil {
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+/*
+EnforceSizeLimit evicts the least recently modified caches in dir until their total size is at most maxBytes.
+
+Only cache files (contents-*.json and .json.gz) and the .partial downloads and .partial.etag files next to them,
+nested <suite>/<component> ones included, count towards the limit.
+A file whose cache lock is held, e.g. the cache just saved by a running analysis, is never evicted,
+so the dir can stay above the limit until that lock is released.
+*/
+func EnforceSizeLimit(dir string, maxBytes int64) error {
+	type cacheFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	matches, err := globCaches(dir, slices.Concat(cachePatterns, suffixed(".partial"), suffixed(".partial.etag")))
+	if err != nil {
+		return err
+	}
+	var files []cacheFile
+	var total int64
+	for _, m := range matches {
+		info, err := os.Stat(m)
+		if err != nil {
+			continue
+		}
+		files = append(files, cacheFile{m, info.Size(), info.ModTime()})
+		total += info.Size()
+	}
+	slices.SortFunc(files, func(a, b cacheFile) int { return a.modTime.Compare(b.modTime) })
+
+	for _, f := range files {
+		if total <= maxBytes {
+			break
+		}
+		lockFile := cacheBase(f.path) + ".lock"
+		_, statErr := os.Stat(lockFile)
+		lock := flock.New(lockFile)
+		locked, err := lock.TryLock()
+		if err != nil {
+			return err
+		}
+		if !locked {
+			continue
+		}
+		if err := os.Remove(f.path); err == nil {
+			total -= f.size
+		}
+		_ = lock.Unlock()
+		if statErr != nil {
+			// only remove the lock file taking the lock created
+			_ = os.Remove(lockFile)
+		}
+	}
+	return nil
+}
+
+// cacheSidecars are the files kept next to a cache: its lock, an interrupted save and an interrupted download
+var cacheSidecars = []string{".lock", ".tmp", ".partial", ".partial.etag"}
+
+// cacheBase returns the cache a sidecar file belongs to: "contents-amd64.json.partial" -> "contents-amd64.json"
+func cacheBase(file string) string {
+	for _, suffix := range cacheSidecars {
+		if strings.HasSuffix(file, suffix) {
+			return strings.TrimSuffix(file, suffix)
+		}
+	}
+	return file
+}
+
+// suffixed returns cachePatterns with suffix appended, e.g. the lock files of every cache
+func suffixed(suffix string) []string {
+	patterns := make([]string, len(cachePatterns))
+	for i, p := range cachePatterns {
+		patterns[i] = p + suffix
+	}
+	return patterns
+}
+
+// checksum returns the md5 of the JSON encoded stats, verified by LoadCache
+func checksum(stats []PackageStats) (string, error) {
+	data, err := json.Marshal(stats)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", md5.Sum(data)), nil
+}
+
+// CleanupStaleTemp removes .tmp files in dir and its <suite>/<component> subdirectories older than ttl,
+// left behind by interrupted saves, and returns how many were removed
+func CleanupStaleTemp(dir string, ttl time.Duration) (int, error) {
+	matches, err := globCaches(dir, []string{"*.json.tmp", "*.json" + CompressedExt + ".tmp"})
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, m := range matches {
+		if info, err := os.Stat(m); err == nil && time.Since(info.ModTime()) > ttl && os.Remove(m) == nil {
+			removed++
+		}
+	}
+	return removed, nil
+}
+
 // CleanupStaleLock removes old lock files
 func CleanupStaleLock(file string, ttl time.Duration) {
 	if info, err := os.Stat(file); err == nil && time.Since(info.ModTime()) > ttl {
@@ -130,7 +424,7 @@ func AcquireLockWithContext(ctx context.Context, file string, timeout time.Durat
 }
 
 // ReleaseLock unlocks and deletes lock file
-func ReleaseLock(f *flock.Flock, file string, logger *log.Logger) {
+func ReleaseLock(f *flock.Flock, file string, logger Logger) {
 	if f == nil {
 		return
 	}
@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
@@ -85,6 +86,37 @@ func TestLoadCacheCorrupt(t *testing.T) {
 	}
 }
 
+func TestLoadCacheChecksumMismatch(t *testing.T) {
+	cacheFile := filepath.Join(t.TempDir(), "tampered.json")
+	entry := &CacheEntry{Stats: []PackageStats{{Name: "pkg1", FileCount: 10}}, Timestamp: time.Now().UTC()}
+	if err := SaveCache(cacheFile, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	// still valid JSON, but the stats no longer match the stored checksum
+	data, _ := os.ReadFile(cacheFile)
+	_ = os.WriteFile(cacheFile, []byte(strings.Replace(string(data), `"file_count": 10`, `"file_count": 99`, 1)), 0644)
+
+	_, err := LoadCache(cacheFile, time.Hour)
+	if err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Fatalf("got %v, want checksum error", err)
+	}
+	if _, err := os.Stat(cacheFile); !os.IsNotExist(err) {
+		t.Error("tampered cache should be removed")
+	}
+}
+
+func TestLoadCacheWithoutChecksum(t *testing.T) {
+	cacheFile := filepath.Join(t.TempDir(), "old.json")
+	old := fmt.Sprintf(`{"architecture":"amd64","stats":[{"name":"pkg1","file_count":10}],"timestamp":%q}`, time.Now().UTC().Format(time.RFC3339))
+	_ = os.WriteFile(cacheFile, []byte(old), 0644)
+
+	entry, err := LoadCache(cacheFile, time.Hour)
+	if err != nil || entry.Stats[0].FileCount != 10 {
+		t.Errorf("got %+v, %v", entry, err)
+	}
+}
+
 func TestCleanupStaleLock(t *testing.T) {
 	lockFile := filepath.Join(t.TempDir(), "test.lock")
 	_ = os.WriteFile(lockFile, []byte("lock"), 0644)
@@ -113,3 +145,281 @@ func TestLocks(t *testing.T) {
 		t.Error("lock file should be removed")
 	}
 }
+
+func TestClearAll(t *testing.T) {
+	dir := t.TempDir()
+	entry := &CacheEntry{Stats: []PackageStats{{Name: "pkg", FileCount: 1}}, Timestamp: time.Now()}
+	for _, name := range []string{"contents-amd64.json", "contents-arm64.path2.json", "contents-i386.json"} {
+		if err := SaveCache(filepath.Join(dir, name), entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// leftovers of a killed run, an interrupted download and an unrelated file
+	_ = os.WriteFile(filepath.Join(dir, "contents-amd64.json.tmp"), []byte("partial"), 0o644)
+	_ = os.WriteFile(filepath.Join(dir, "contents-armel.json.lock"), nil, 0o644)
+	_ = os.WriteFile(filepath.Join(dir, "contents-armhf.json.partial"), []byte("half a download"), 0o644)
+	_ = os.WriteFile(filepath.Join(dir, "contents-armhf.json.partial.etag"), []byte(`"v1"`), 0o644)
+	_ = os.WriteFile(filepath.Join(dir, "contents-i386.json.partial"), []byte("being downloaded"), 0o644)
+	_ = os.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0o644)
+
+	// another process is writing i386
+	busy, err := AcquireLock(filepath.Join(dir, "contents-i386.json.lock"), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Unlock()
+
+	removed, err := ClearAll(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 6 {
+		t.Errorf("got %d removed, want 6", removed)
+	}
+
+	var left []string
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		left = append(left, e.Name())
+	}
+	want := []string{"contents-i386.json", "contents-i386.json.lock", "contents-i386.json.partial", "notes.txt"}
+	if fmt.Sprint(left) != fmt.Sprint(want) {
+		t.Errorf("got %v left, want %v", left, want)
+	}
+}
+
+func TestStaleTempCleanup(t *testing.T) {
+	dir := t.TempDir()
+	stale := filepath.Join(dir, "contents-amd64.json.tmp")
+	fresh := filepath.Join(dir, "contents-arm64.json.tmp")
+	_ = os.WriteFile(stale, []byte("partial"), 0o644)
+	_ = os.WriteFile(fresh, []byte("in progress"), 0o644)
+	old := time.Now().Add(-2 * TempStaleTTL)
+	_ = os.Chtimes(stale, old, old)
+
+	removed, err := CleanupStaleTemp(dir, TempStaleTTL)
+	if err != nil || removed != 1 {
+		t.Fatalf("got %d, %v", removed, err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Error("stale tmp should be removed")
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Error("a recent tmp may belong to a running save and must be kept")
+	}
+}
+
+func TestSaveCacheReplacesLeftoverTemp(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "contents-amd64.json")
+	// an orphan that os.Create can't reuse
+	if err := os.Mkdir(file+".tmp", 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	entry := &CacheEntry{Stats: []PackageStats{{Name: "pkg", FileCount: 1}}, Timestamp: time.Now()}
+	if err := SaveCache(file, entry); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := LoadCache(file, time.Hour); err != nil || loaded.Stats[0].Name != "pkg" {
+		t.Errorf("got %+v, %v", loaded, err)
+	}
+	if _, err := os.Stat(file + ".tmp"); !os.IsNotExist(err) {
+		t.Error("tmp should not survive the save")
+	}
+}
+
+func TestListEntries(t *testing.T) {
+	dir := t.TempDir()
+	for _, arch := range []string{"arm64", "amd64"} {
+		entry := &CacheEntry{Architecture: arch, Stats: []PackageStats{{Name: "pkg", FileCount: 1}}, Timestamp: time.Now()}
+		if err := SaveCache(filepath.Join(dir, "contents-"+arch+".json"), entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	corrupt := filepath.Join(dir, "contents-i386.json")
+	if err := os.WriteFile(corrupt, []byte("{broken"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := ListEntries(dir)
+	if err == nil || !strings.Contains(err.Error(), "contents-i386.json") {
+		t.Errorf("corrupt entry should be reported, got %v", err)
+	}
+	if len(entries) != 2 || entries[0].Architecture != "amd64" || entries[1].File != filepath.Join(dir, "contents-arm64.json") {
+		t.Errorf("got %+v", entries)
+	}
+	if _, err := os.Stat(corrupt); err != nil {
+		t.Error("listing must not remove anything")
+	}
+}
+
+func TestCompressedCacheRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "contents-amd64.json"+CompressedExt)
+	var stats []PackageStats
+	for i := 0; i < 200; i++ {
+		stats = append(stats, PackageStats{Name: fmt.Sprintf("admin/pkg%d", i), FileCount: i})
+	}
+	entry := &CacheEntry{Architecture: "amd64", Stats: stats, Timestamp: time.Now().UTC(), ETag: "v1"}
+	if err := SaveCache(file, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), string(gzipMagic)) {
+		t.Fatal("cache should be gzip-compressed")
+	}
+	plain := filepath.Join(dir, "contents-amd64.json")
+	if err := SaveCache(plain, entry); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(plain); int64(len(data)) >= info.Size() {
+		t.Errorf("compressed cache (%d bytes) should be smaller than the plain one (%d bytes)", len(data), info.Size())
+	}
+
+	loaded, err := LoadCache(file, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.ETag != "v1" || fmt.Sprint(loaded.Stats) != fmt.Sprint(stats) {
+		t.Errorf("got %+v", loaded)
+	}
+	if _, err := os.Stat(file + ".tmp"); !os.IsNotExist(err) {
+		t.Error("tmp should not survive the save")
+	}
+
+	entries, err := ListEntries(dir)
+	if err != nil || len(entries) != 2 || entries[1].File != file || len(entries[1].Stats) != 200 {
+		t.Errorf("got %d entries, %v", len(entries), err)
+	}
+	if removed, err := ClearAll(dir); err != nil || removed != 2 {
+		t.Errorf("got %d removed, %v", removed, err)
+	}
+}
+
+func TestLoadCacheDetectsCompression(t *testing.T) {
+	dir := t.TempDir()
+	entry := &CacheEntry{Architecture: "amd64", Stats: []PackageStats{{Name: "pkg", FileCount: 1}}, Timestamp: time.Now().UTC()}
+	compressed := filepath.Join(dir, "a.json"+CompressedExt)
+	if err := SaveCache(compressed, entry); err != nil {
+		t.Fatal(err)
+	}
+	// the content decides, not the name
+	renamed := filepath.Join(dir, "b.json")
+	if err := os.Rename(compressed, renamed); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := LoadCache(renamed, time.Hour); err != nil || loaded.Stats[0].Name != "pkg" {
+		t.Errorf("got %+v, %v", loaded, err)
+	}
+
+	truncated := filepath.Join(dir, "c.json"+CompressedExt)
+	_ = os.WriteFile(truncated, gzipMagic, 0o644)
+	if _, err := LoadCache(truncated, time.Hour); err == nil {
+		t.Error("a broken gzip stream should fail")
+	}
+	if _, err := os.Stat(truncated); !os.IsNotExist(err) {
+		t.Error("a corrupt compressed cache should be removed")
+	}
+}
+
+func TestNestedCaches(t *testing.T) {
+	dir := t.TempDir()
+	nested := filepath.Join(dir, "testing", "main")
+	if err := os.MkdirAll(nested, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{filepath.Join(dir, "contents-amd64.json"), filepath.Join(nested, "contents-amd64.json")} {
+		entry := &CacheEntry{Architecture: "amd64", Stats: []PackageStats{{Name: "pkg", FileCount: 1}}, Timestamp: time.Now()}
+		if err := SaveCache(file, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := ListEntries(dir)
+	if err != nil || len(entries) != 2 || entries[1].File != filepath.Join(nested, "contents-amd64.json") {
+		t.Errorf("got %+v, %v", entries, err)
+	}
+	if removed, err := ClearAll(dir); err != nil || removed != 2 {
+		t.Errorf("got %d removed, %v", removed, err)
+	}
+	if entries, _ := ListEntries(dir); len(entries) != 0 {
+		t.Errorf("left %+v", entries)
+	}
+}
+
+func TestEnforceSizeLimit(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	// 4 caches of 100 bytes, contents-0 is the oldest
+	for i := 0; i < 4; i++ {
+		file := filepath.Join(dir, fmt.Sprintf("contents-%d.json", i))
+		if err := os.WriteFile(file, []byte(strings.Repeat("x", 100)), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		mod := now.Add(time.Duration(i-4) * time.Hour)
+		_ = os.Chtimes(file, mod, mod)
+	}
+	_ = os.WriteFile(filepath.Join(dir, "notes.txt"), []byte(strings.Repeat("x", 1000)), 0o644)
+	// an abandoned download older than every cache, with its etag
+	for _, name := range []string{"contents-9.json.partial", "contents-9.json.partial.etag"} {
+		file := filepath.Join(dir, name)
+		_ = os.WriteFile(file, []byte(strings.Repeat("x", 100)), 0o644)
+		mod := now.Add(-10 * time.Hour)
+		_ = os.Chtimes(file, mod, mod)
+	}
+
+	// the oldest cache is being written by another process
+	busy, err := AcquireLock(filepath.Join(dir, "contents-0.json.lock"), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Unlock()
+
+	if err := EnforceSizeLimit(dir, 250); err != nil {
+		t.Fatal(err)
+	}
+
+	var left []string
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		left = append(left, e.Name())
+	}
+	want := []string{"contents-0.json", "contents-0.json.lock", "contents-3.json", "notes.txt"}
+	if fmt.Sprint(left) != fmt.Sprint(want) {
+		t.Errorf("got %v left, want %v", left, want)
+	}
+
+	if err := EnforceSizeLimit(dir, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "contents-3.json")); err != nil {
+		t.Error("nothing should be evicted under the limit")
+	}
+}
+
+func TestReadEntry(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "contents-amd64.json")
+	entry := &CacheEntry{Architecture: "amd64", Stats: []PackageStats{{Name: "pkg", FileCount: 1}}, Timestamp: time.Now().Add(-240 * time.Hour)}
+	if err := SaveCache(file, entry); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := ReadEntry(file)
+	if err != nil || loaded.Architecture != "amd64" || loaded.File != file {
+		t.Errorf("an expired cache should still be read, got %+v, %v", loaded, err)
+	}
+
+	corrupt := filepath.Join(dir, "contents-i386.json")
+	_ = os.WriteFile(corrupt, []byte("{broken"), 0o644)
+	if _, err := ReadEntry(corrupt); err == nil {
+		t.Error("corrupt cache should fail")
+	}
+	if _, err := os.Stat(corrupt); err != nil {
+		t.Error("reading must not remove anything")
+	}
+}
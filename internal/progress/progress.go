@@ -4,6 +4,8 @@ package progress
 import (
 	"fmt"
 	"io"
+	"math"
+	"os"
 	"strings"
 	"time"
 )
@@ -16,6 +18,44 @@ type ProgressReader struct {
 	Last      time.Time
 	StartTime time.Time
 	Logger    func(string, ...interface{})
+	// Silent suppresses the progress bar, e.g. when several downloads run at once
+	Silent bool
+	// Output is where the bar is drawn (os.Stdout if nil), e.g. os.Stderr to keep stdout for results
+	// every frame starts with a carriage return so it overwrites the previous one in place
+	Output io.Writer
+	// TTY draws the in-place bar, only a terminal handles the carriage returns
+	// without it progress goes to Logger as a line every logInterval (see IsTerminal)
+	TTY bool
+	// Telemetry receives a CSV row per tick: timestamp,bytes,bytes_per_sec
+	// it is closed at EOF when it is an io.Closer
+	Telemetry io.Writer
+	// OnProgress, when set, is called on every tick and at EOF instead of drawing the bar or logging progress lines
+	// speed is the average in bytes per second since the first read, total is <= 0 when the size is unknown
+	OnProgress func(curr, total int64, speed float64)
+
+	lastCurr    int64
+	wroteHeader bool
+	lastLog     time.Time
+	// frame is the spinner frame drawn next for downloads of unknown size
+	frame int
+}
+
+// spinnerFrames animate the unknown-size display, one frame per render
+var spinnerFrames = []string{"|", "/", "-", "\\"}
+
+// barWidth is how many cells the progress bar has, each one is 2%
+const barWidth = 50
+
+// tickInterval is how often the bar is redrawn and telemetry sampled
+var tickInterval = 500 * time.Millisecond
+
+// logInterval is how often progress is logged when the output isn't a terminal
+var logInterval = 5 * time.Second
+
+// IsTerminal reports whether f is a terminal (character device) rather than a file or pipe
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
 }
 
 // Read implements io.Reader and updates the progress bar.
@@ -29,22 +69,133 @@ func (p *ProgressReader) Read(b []byte) (int, error) {
 	n, err := p.Reader.Read(b)
 	if n > 0 {
 		p.Curr += int64(n)
-		if time.Since(p.Last) > 500*time.Millisecond {
-			p.render()
+		if time.Since(p.Last) > tickInterval {
+			if p.OnProgress != nil {
+				p.report()
+			} else if !p.Silent {
+				p.show()
+			}
+			p.sample()
 			p.Last = time.Now()
 		}
 	}
 	if err == io.EOF {
-		p.render()
+		drawn := p.OnProgress == nil && !p.Silent && p.TTY
+		if p.OnProgress != nil {
+			p.report()
+		} else if drawn {
+			p.render()
+		}
+		p.sample()
+		p.closeTelemetry()
 		if p.Logger != nil {
 			p.Logger("Download completed")
-		} else {
-			fmt.Println()
+		} else if drawn {
+			fmt.Fprintln(p.out())
 		}
 	}
 	return n, err
 }
 
+// Reset clears the progress state so a new download attempt starts from zero.
+func (p *ProgressReader) Reset() {
+	p.Curr = 0
+	p.lastCurr = 0
+	p.Last = time.Time{}
+	p.StartTime = time.Time{}
+	p.lastLog = time.Time{}
+	p.frame = 0
+}
+
+// sample appends a telemetry row with the speed since the previous tick
+func (p *ProgressReader) sample() {
+	if p.Telemetry == nil {
+		return
+	}
+	if !p.wroteHeader {
+		fmt.Fprintln(p.Telemetry, "timestamp,bytes,bytes_per_sec")
+		p.wroteHeader = true
+	}
+	now := time.Now()
+	speed := 0.0
+	if elapsed := now.Sub(p.Last).Seconds(); elapsed > 0 {
+		speed = float64(p.Curr-p.lastCurr) / elapsed
+	}
+	fmt.Fprintf(p.Telemetry, "%s,%d,%.0f\n", now.UTC().Format(time.RFC3339Nano), p.Curr, speed)
+	p.lastCurr = p.Curr
+}
+
+// report passes the current progress to OnProgress
+func (p *ProgressReader) report() {
+	speed := 0.0
+	if elapsed := time.Since(p.StartTime).Seconds(); elapsed > 0 {
+		speed = float64(p.Curr) / elapsed
+	}
+	p.OnProgress(p.Curr, p.Total, speed)
+}
+
+// closeTelemetry closes the telemetry writer once the download is complete
+func (p *ProgressReader) closeTelemetry() {
+	if c, ok := p.Telemetry.(io.Closer); ok {
+		_ = c.Close()
+	}
+	p.Telemetry = nil
+}
+
+// percent returns the completed percentage clamped to [0,100].
+func (p *ProgressReader) percent() float64 {
+	if p.Total <= 0 {
+		return 0
+	}
+	percent := float64(p.Curr) / float64(p.Total) * 100
+	if percent < 0 {
+		return 0
+	}
+	if percent > 100 {
+		return 100
+	}
+	return percent
+}
+
+// out returns the writer the bar is drawn on
+func (p *ProgressReader) out() io.Writer {
+	if p.Output == nil {
+		return os.Stdout
+	}
+	return p.Output
+}
+
+// show draws the bar on a terminal, otherwise logs a progress line every logInterval
+func (p *ProgressReader) show() {
+	if p.TTY {
+		p.render()
+		return
+	}
+	if p.Logger == nil || time.Since(p.lastLog) < logInterval {
+		return
+	}
+	p.lastLog = time.Now()
+	currMB := float64(p.Curr) / (1024 * 1024)
+	if p.Total <= 0 {
+		p.Logger("Downloaded %.1f MB", currMB)
+		return
+	}
+	p.Logger("Downloaded %.1f/%.1f MB (%.0f%%)", currMB, float64(p.Total)/(1024*1024), p.percent())
+}
+
+// estimate returns how long the remaining bytes take at speed bytes per second,
+// 0 when nothing is left (Curr past a wrong Total) or the speed is not known yet
+func estimate(remaining int64, speed float64) time.Duration {
+	if remaining <= 0 || !(speed > 0) || math.IsInf(speed, 0) {
+		return 0
+	}
+	eta := float64(remaining) / speed * float64(time.Second)
+	if eta >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(eta)
+}
+
 // render displays the current progress bar with download speed and ETA.
 func (p *ProgressReader) render() {
 	elapsed := time.Since(p.StartTime)
@@ -52,23 +203,26 @@ func (p *ProgressReader) render() {
 	speedMB := speed / (1024 * 1024)
 	currMB := float64(p.Curr) / (1024 * 1024)
 
-	if p.Total == 0 {
-		// Unknown total size - show only downloaded amount and speed
-		fmt.Printf("\rDownloading: %.1f MB downloaded (%.1f MB/s)", currMB, speedMB)
+	if p.Total <= 0 {
+		// Unknown total size (-1 from a response without Content-Length) - a spinner and the elapsed time show the download is still alive
+		spinner := spinnerFrames[p.frame%len(spinnerFrames)]
+		p.frame++
+		fmt.Fprintf(p.out(), "\r%s Downloading: %.1f MB downloaded (%.1f MB/s, elapsed %v)",
+			spinner, currMB, speedMB, elapsed.Truncate(time.Second))
 		return
 	}
 
-	percent := float64(p.Curr) / float64(p.Total) * 100
-	bar := strings.Repeat("█", int(percent/2)) + strings.Repeat(" ", 50-int(percent/2))
+	percent := p.percent()
+	// percent is clamped, so a wrong Content-Length can't overflow the bar
+	filled := min(max(int(percent*barWidth/100), 0), barWidth)
+	bar := strings.Repeat("█", filled) + strings.Repeat(" ", barWidth-filled)
 
-	// Calculate ETA
-	remaining := float64(p.Total-p.Curr) / speed
-	eta := time.Duration(remaining) * time.Second
+	eta := estimate(p.Total-p.Curr, speed)
 
 	// Format sizes
 	totalMB := float64(p.Total) / (1024 * 1024)
 
-	// Always use direct stdout output for progress bar to enable in-place updates
-	fmt.Printf("\r[%s] %6.2f%% (%.1f/%.1f MB, %.1f MB/s, ETA: %v)",
+	// Always write the bar directly (unbuffered) to enable in-place updates
+	fmt.Fprintf(p.out(), "\r[%s] %6.2f%% (%.1f/%.1f MB, %.1f MB/s, ETA: %v)",
 		bar, percent, currMB, totalMB, speedMB, eta.Truncate(time.Second))
 }
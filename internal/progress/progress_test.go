@@ -2,8 +2,16 @@ package progress
 
 import (
 	"bytes"
+	"fmt"
 	"io"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+	"unicode/utf8"
 )
 
 func TestProgressReader(t *testing.T) {
@@ -49,6 +57,42 @@ func TestProgressRender(t *testing.T) {
 	pr.render() // Should not panic with zero total
 }
 
+func TestProgressRenderCurrPastTotal(t *testing.T) {
+	// a server that under-reports Content-Length, or a compressed size compared with the decompressed one
+	for _, curr := range []int64{100, 150, 1 << 40} {
+		var out bytes.Buffer
+		pr := &ProgressReader{Total: 100, Curr: curr, StartTime: time.Now().Add(-time.Second), Output: &out}
+		pr.render()
+
+		line := out.String()
+		if !strings.Contains(line, "100.00%") || !strings.Contains(line, "ETA: 0s") {
+			t.Errorf("curr %d: got %q, want 100%% and a 0s ETA", curr, line)
+		}
+		if bar := line[strings.Index(line, "[")+1 : strings.Index(line, "]")]; utf8.RuneCountInString(bar) != barWidth || strings.Contains(bar, " ") {
+			t.Errorf("curr %d: want a full bar of %d cells, got %q", curr, barWidth, bar)
+		}
+	}
+}
+
+func TestEstimate(t *testing.T) {
+	for _, tt := range []struct {
+		remaining int64
+		speed     float64
+		want      time.Duration
+	}{
+		{100, 50, 2 * time.Second},
+		{-50, 50, 0},
+		{100, 0, 0},
+		{100, math.NaN(), 0},
+		{100, math.Inf(1), 0},
+		{math.MaxInt64, 1e-9, math.MaxInt64},
+	} {
+		if got := estimate(tt.remaining, tt.speed); got != tt.want {
+			t.Errorf("estimate(%d, %v) = %v, want %v", tt.remaining, tt.speed, got, tt.want)
+		}
+	}
+}
+
 type errorReader struct{ err error }
 
 func (er *errorReader) Read(p []byte) (n int, err error) {
@@ -68,3 +112,230 @@ func TestProgressError(t *testing.T) {
 		t.Errorf("got %d, %v", n, err)
 	}
 }
+
+func TestProgressResetBetweenAttempts(t *testing.T) {
+	first := []byte("partial attempt data")
+	pr := &ProgressReader{
+		Reader: bytes.NewReader(first),
+		Total:  10,
+	}
+	_, _ = io.ReadAll(pr)
+
+	if got := pr.percent(); got != 100 {
+		t.Errorf("percent should be clamped to 100, got %.2f", got)
+	}
+
+	// second attempt with fresh body
+	second := []byte("0123456789")
+	pr.Reset()
+	pr.Reader = bytes.NewReader(second)
+
+	buf := make([]byte, 5)
+	_, _ = pr.Read(buf)
+
+	if pr.Curr != 5 {
+		t.Errorf("got position %d after reset", pr.Curr)
+	}
+	if got := pr.percent(); got != 50 {
+		t.Errorf("got percent %.2f", got)
+	}
+}
+
+// slowReader returns one byte per read, waiting between reads so ticks happen
+type slowReader struct{ data []byte }
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	if len(s.data) == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(2 * time.Millisecond)
+	p[0] = s.data[0]
+	s.data = s.data[1:]
+	return 1, nil
+}
+
+type closeBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (c *closeBuffer) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestProgressTelemetry(t *testing.T) {
+	old := tickInterval
+	tickInterval = time.Millisecond
+	defer func() { tickInterval = old }()
+
+	var out closeBuffer
+	pr := &ProgressReader{Reader: &slowReader{data: []byte("0123456789")}, Total: 10, Silent: true, Telemetry: &out}
+	if _, err := io.ReadAll(pr); err != nil {
+		t.Fatal(err)
+	}
+
+	if !out.closed {
+		t.Error("telemetry should be closed at EOF")
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if lines[0] != "timestamp,bytes,bytes_per_sec" || len(lines) < 3 {
+		t.Fatalf("got %q", out.String())
+	}
+	prev := int64(-1)
+	for _, line := range lines[1:] {
+		fields := strings.Split(line, ",")
+		if len(fields) != 3 {
+			t.Fatalf("bad row %q", line)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, fields[0]); err != nil {
+			t.Errorf("bad timestamp in %q: %v", line, err)
+		}
+		n, _ := strconv.ParseInt(fields[1], 10, 64)
+		if n < prev {
+			t.Errorf("byte counts should not decrease: %d after %d", n, prev)
+		}
+		prev = n
+	}
+	if prev != 10 {
+		t.Errorf("last row should hold all bytes, got %d", prev)
+	}
+}
+
+func TestProgressOutputSilent(t *testing.T) {
+	for _, silent := range []bool{false, true} {
+		var out bytes.Buffer
+		pr := &ProgressReader{Reader: bytes.NewReader([]byte("data")), Total: 4, Silent: silent, Output: &out, TTY: true}
+		_, _ = io.ReadAll(pr)
+
+		if silent && out.Len() != 0 {
+			t.Errorf("silent reader wrote %q", out.String())
+		}
+		if !silent && !strings.Contains(out.String(), "100.00%") {
+			t.Errorf("expected a final bar, got %q", out.String())
+		}
+	}
+}
+
+func TestProgressWithoutTTYLogsLines(t *testing.T) {
+	oldTick, oldLog := tickInterval, logInterval
+	tickInterval, logInterval = time.Millisecond, time.Millisecond
+	defer func() { tickInterval, logInterval = oldTick, oldLog }()
+
+	var out bytes.Buffer
+	var lines []string
+	pr := &ProgressReader{
+		Reader: &slowReader{data: []byte("0123456789")},
+		Total:  10,
+		Output: &out,
+		Logger: func(format string, v ...interface{}) { lines = append(lines, fmt.Sprintf(format, v...)) },
+	}
+	if _, err := io.ReadAll(pr); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.Len() != 0 {
+		t.Errorf("no bar should be drawn without a terminal, got %q", out.String())
+	}
+	if len(lines) < 2 || !strings.HasPrefix(lines[0], "Downloaded ") || lines[len(lines)-1] != "Download completed" {
+		t.Errorf("got %q", lines)
+	}
+}
+
+func TestIsTerminal(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if IsTerminal(f) {
+		t.Error("a regular file is not a terminal")
+	}
+}
+
+func TestProgressFramesOnOutput(t *testing.T) {
+	old := tickInterval
+	tickInterval = time.Millisecond
+	defer func() { tickInterval = old }()
+
+	var out bytes.Buffer
+	pr := &ProgressReader{Reader: &slowReader{data: []byte("0123456789")}, Total: 10, Output: &out, TTY: true}
+	if _, err := io.ReadAll(pr); err != nil {
+		t.Fatal(err)
+	}
+
+	frames := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\r")
+	if frames[0] != "" || len(frames) < 3 {
+		t.Fatalf("every frame should start with a carriage return, got %q", out.String())
+	}
+	for _, frame := range frames[1:] {
+		if !strings.HasPrefix(frame, "[") || strings.Contains(frame, "\n") {
+			t.Errorf("bad frame %q", frame)
+		}
+	}
+	if last := frames[len(frames)-1]; !strings.Contains(last, "100.00%") || !strings.HasSuffix(out.String(), "\n") {
+		t.Errorf("last frame should be complete and end the line, got %q", last)
+	}
+}
+
+func TestProgressSpinnerAdvances(t *testing.T) {
+	for _, total := range []int64{0, -1} {
+		var out bytes.Buffer
+		pr := &ProgressReader{Total: total, Curr: 1024 * 1024, StartTime: time.Now().Add(-3 * time.Second), Output: &out}
+
+		var frames []string
+		for i := 0; i < len(spinnerFrames)+1; i++ {
+			out.Reset()
+			pr.render()
+			line := strings.TrimPrefix(out.String(), "\r")
+			frames = append(frames, line[:strings.Index(line, " ")])
+			if !strings.Contains(line, "1.0 MB downloaded") || !strings.Contains(line, "elapsed 3s") {
+				t.Errorf("total %d: got %q", total, line)
+			}
+		}
+
+		want := append(slices.Clone(spinnerFrames), spinnerFrames[0])
+		if fmt.Sprint(frames) != fmt.Sprint(want) {
+			t.Errorf("total %d: got frames %q, want %q", total, frames, want)
+		}
+	}
+}
+
+func TestProgressOnProgressCallback(t *testing.T) {
+	old := tickInterval
+	tickInterval = time.Millisecond
+	defer func() { tickInterval = old }()
+
+	var out bytes.Buffer
+	var currs []int64
+	pr := &ProgressReader{
+		Reader: &slowReader{data: []byte("0123456789")},
+		Total:  10,
+		Output: &out,
+		TTY:    true,
+		OnProgress: func(curr, total int64, speed float64) {
+			if total != 10 || speed < 0 {
+				t.Errorf("got total %d, speed %f", total, speed)
+			}
+			currs = append(currs, curr)
+		},
+	}
+	if _, err := io.ReadAll(pr); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.Len() != 0 {
+		t.Errorf("the callback replaces the bar, got %q", out.String())
+	}
+	if len(currs) < 2 || currs[len(currs)-1] != 10 {
+		t.Fatalf("got %v", currs)
+	}
+	for i := 1; i < len(currs); i++ {
+		if currs[i] < currs[i-1] {
+			t.Errorf("curr should not decrease: %v", currs)
+		}
+	}
+	if currs[0] >= currs[len(currs)-1] {
+		t.Errorf("curr should increase: %v", currs)
+	}
+}